@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+REST API второй версии: ресурс /api/v2/users/{user_id}/events, тела запросов и ответов в JSON.
+Работает рядом со старыми методами и использует тот же Calendar.
+
+	POST   /api/v2/users/{user_id}/events              201 созданное событие
+	GET    /api/v2/users/{user_id}/events?date=&period=&tz= 200 события за day (по умолчанию), week или month,
+	                                                        параметры week и week_start как в period.go
+	GET    /api/v2/users/{user_id}/events/{id}         200 событие, 404
+	PUT    /api/v2/users/{user_id}/events/{id}         200 обновленное событие, 404
+	DELETE /api/v2/users/{user_id}/events/{id}         204, 404
+
+PUT и DELETE с параметром ?occurrence=YYYY-MM-DD меняют одно вхождение повторяющегося события, без него - всю серию.
+
+Невалидное тело события - 422, id или user_id в теле, не совпадающие с адресом ресурса, - 409.
+POST с параметром ?reject_conflicts=true отвечает 409 со списком ID, если событие пересекается с существующими.
+*/
+
+// тело запроса на создание и изменение события
+type eventRequest struct {
+	ID          string   `json:"id,omitempty"`
+	UserID      string   `json:"user_id,omitempty"`
+	Date        string   `json:"date,omitempty"`
+	Start       string   `json:"start,omitempty"`
+	End         string   `json:"end,omitempty"`
+	Duration    string   `json:"duration,omitempty"`
+	TimeZone    string   `json:"time_zone,omitempty"`
+	Description string   `json:"description"`
+	RRule       string   `json:"rrule,omitempty"`
+	ExDates     []string `json:"exdates,omitempty"`
+	Reminders   []int    `json:"reminders,omitempty"`
+	Attendees   []string `json:"attendees,omitempty"`
+	CalendarID  string   `json:"calendar_id,omitempty"`
+}
+
+// ошибка, которую обработчик отдает с указанным статусом
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+func registerV2Routes(mux *http.ServeMux) {
+	route(mux, "POST /api/v2/users/{user_id}/events", v2CreateEventHandler)
+	route(mux, "GET /api/v2/users/{user_id}/events", v2ListEventsHandler)
+	route(mux, "GET /api/v2/users/{user_id}/events/{id}", v2GetEventHandler)
+	route(mux, "PUT /api/v2/users/{user_id}/events/{id}", v2UpdateEventHandler)
+	route(mux, "DELETE /api/v2/users/{user_id}/events/{id}", v2DeleteEventHandler)
+}
+
+// writeV2Error отвечает ошибкой с кодами REST: в отличие от writeError, отсутствующее событие - 404,
+// пересечение - 409, невалидное событие - 422
+func writeV2Error(w http.ResponseWriter, err error) {
+	var (
+		validationErr *ValidationError
+		conflictErr   *ConflictError
+	)
+	switch {
+	case errors.As(err, &validationErr):
+		writeJSON(w, http.StatusUnprocessableEntity, APIResponse{Error: validationErr.Error(), Details: validationErr})
+	case errors.Is(err, ErrNotFound):
+		writeJSON(w, http.StatusNotFound, APIResponse{Error: "Event not found"})
+	case errors.As(err, &conflictErr):
+		writeJSON(w, http.StatusConflict, APIResponse{Error: conflictErr.Error(), Details: conflictErr})
+	default:
+		writeError(w, err)
+	}
+}
+
+// pathUserID достает и проверяет user_id из пути, а также право вызывающего на события этого пользователя
+func pathUserID(r *http.Request) (string, error) {
+	userID := r.PathValue("user_id")
+	if _, err := strconv.Atoi(userID); err != nil {
+		return "", &statusError{http.StatusBadRequest, "Invalid user_id"}
+	}
+	if !allowed(r, userID) {
+		return "", ErrForbidden
+	}
+	return userID, nil
+}
+
+// decodeEvent читает тело запроса и собирает событие для ресурса userID/id
+func decodeEvent(r *http.Request, userID, id string) (*Event, error) {
+	var body eventRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, &statusError{http.StatusBadRequest, "Malformed JSON body"}
+	}
+
+	if body.UserID != "" && body.UserID != userID {
+		return nil, &statusError{http.StatusConflict, "user_id in body does not match the path"}
+	}
+	if body.ID != "" && body.ID != id {
+		return nil, &statusError{http.StatusConflict, "id in body does not match the path"}
+	}
+	return body.event(userID, id)
+}
+
+// event собирает из тела запроса событие id пользователя userID и проверяет его
+func (body eventRequest) event(userID, id string) (*Event, error) {
+	event := &Event{
+		ID:          id,
+		UserID:      userID,
+		Description: body.Description,
+		RRule:       body.RRule,
+		ExDates:     body.ExDates,
+		Reminders:   body.Reminders,
+		CalendarID:  body.CalendarID,
+	}
+	if body.Attendees != nil {
+		event.Attendees = []Attendee{}
+		for _, attendeeID := range body.Attendees {
+			event.Attendees = append(event.Attendees, Attendee{UserID: attendeeID, Status: rsvpNeedsAction})
+		}
+	}
+
+	timing := eventTiming{
+		Date:     body.Date,
+		Start:    body.Start,
+		End:      body.End,
+		Duration: body.Duration,
+		TimeZone: body.TimeZone,
+	}
+	if err := timing.apply(event); err != nil {
+		return nil, err
+	}
+	return event, event.validate()
+}
+
+// queryOccurrence достает из строки запроса дату вхождения повторяющегося события
+func queryOccurrence(r *http.Request) (string, error) {
+	occurrence := r.URL.Query().Get("occurrence")
+	if occurrence == "" {
+		return "", nil
+	}
+
+	if _, err := time.Parse(dateLayout, occurrence); err != nil {
+		return "", &statusError{http.StatusBadRequest, "occurrence must be in YYYY-MM-DD format"}
+	}
+	return occurrence, nil
+}
+
+// userEvent возвращает событие id из календаря арендатора ctx, если его видит userID
+func userEvent(ctx context.Context, userID, id string) (Event, error) {
+	calendar := calendarFrom(ctx)
+	event, ok := calendar.GetEvent(id)
+	if !ok || !calendar.CanRead(event, userID) {
+		return Event{}, ErrNotFound
+	}
+	return event, nil
+}
+
+func v2CreateEventHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	event, err := decodeEvent(r, userID, "")
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	calendar := calendarFrom(r.Context())
+	var created Event
+	if r.URL.Query().Get("reject_conflicts") == "true" {
+		created, err = calendar.AddEventNoConflicts(r.Context(), *event)
+	} else {
+		created, err = calendar.AddEvent(r.Context(), *event)
+	}
+
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/users/%s/events/%s", userID, created.ID))
+	setETag(w, created)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func v2ListEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	switch period {
+	case "":
+		period = periodDay
+	case periodDay, periodWeek, periodMonth:
+	default:
+		writeV2Error(w, &statusError{http.StatusBadRequest, "period must be day, week or month"})
+		return
+	}
+	calendar := calendarFrom(r.Context())
+	q, err := parsePeriodParams(query, period, calendar.WeekStart())
+	if err != nil {
+		writeV2Error(w, &statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	q.UserID = userID
+	writeJSON(w, http.StatusOK, calendar.EventsFor(q))
+}
+
+func v2GetEventHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	event, err := userEvent(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+	if notModified(w, r, event) {
+		return
+	}
+
+	setETag(w, event)
+	writeJSON(w, http.StatusOK, event)
+}
+
+func v2UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	event, err := decodeEvent(r, userID, r.PathValue("id"))
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+	occurrence, err := queryOccurrence(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+	if event.Version, err = parseIfMatch(r); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	calendar := calendarFrom(r.Context())
+	var updated Event
+	if occurrence != "" {
+		updated, err = calendar.UpdateOccurrence(r.Context(), *event, occurrence)
+	} else {
+		updated, err = calendar.UpdateEvent(r.Context(), *event)
+	}
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	setETag(w, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func v2DeleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	occurrence, err := queryOccurrence(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	ref := Event{ID: r.PathValue("id"), UserID: userID}
+	if ref.Version, err = parseIfMatch(r); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+	calendar := calendarFrom(r.Context())
+	if occurrence != "" {
+		err = calendar.DeleteOccurrence(r.Context(), ref, occurrence)
+	} else {
+		err = calendar.DeleteEvent(r.Context(), ref)
+	}
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+Журнал аудита и отмена изменений.
+
+	GET  /audit?user_id=&event_id=&limit=   записи об изменениях пользователя и его событий, новые первыми
+	POST /undo  user_id=&n=                 отменить n последних операций пользователя, по умолчанию одну
+
+Каждое сохранение и удаление события записывается в журнал: кто (actor - аутентифицированный пользователь,
+без аутентификации - user_id запроса), когда, что было до и что стало после. Записи не меняются.
+Один вызов Calendar может изменить несколько событий (изменение вхождения серии, удаление серии с исключениями) -
+такие записи объединены номером операции op и отменяются вместе.
+
+Отмена строит для записей операции обратные команды, как Command в pattern/04_command.go, и выполняет их
+от новых к старым: созданное событие удаляется, измененное и удаленное восстанавливаются из снимка "до".
+Если событие после операции изменил кто-то еще, отмена не выполняется целиком и возвращает 412.
+Права проверяются на момент отмены: если пользователь уже не может менять событие или его общий календарь,
+отмена не выполняется и возвращает 403.
+Отмена - тоже операция в журнале, со ссылкой undoes на отмененную; отмененную операцию нельзя отменить второй раз.
+Когда хранилище файловое, журнал дописывается в audit.jsonl.
+*/
+
+const (
+	auditFile    = "audit.jsonl"
+	auditHistory = 10000 // сколько последних записей держится в памяти для запросов и отмены
+	maxUndo      = 100
+
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// AuditEntry запись журнала об изменении одного события
+type AuditEntry struct {
+	Seq     uint64    `json:"seq"`
+	Op      uint64    `json:"op"`
+	Undoes  uint64    `json:"undoes,omitempty"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	EventID string    `json:"event_id"`
+	Before  *Event    `json:"before,omitempty"`
+	After   *Event    `json:"after,omitempty"`
+}
+
+// concerns проверяет, относится ли запись к пользователю: он ее автор или владелец события
+func (e AuditEntry) concerns(userID string) bool {
+	return e.Actor == userID ||
+		e.Before != nil && e.Before.UserID == userID ||
+		e.After != nil && e.After.UserID == userID
+}
+
+// auditLog журнал аудита, все методы вызываются под блокировкой Calendar
+type auditLog struct {
+	entries []AuditEntry
+	history int // сколько последних записей держится в entries
+	seq     uint64
+	op      uint64
+	file    *os.File
+	size    int64 // длина файла до конца последней целой записи
+
+	// текущая операция, ее начинает каждый изменяющий метод Calendar
+	actor  string
+	undoes uint64
+
+	// записи атомарного пакета для его отката, собираются, пока capture
+	capture  bool
+	captured []AuditEntry
+}
+
+// begin начинает операцию пользователя actor, следующие записи журнала относятся к ней
+func (c *Calendar) begin(actor string) {
+	c.audit.op++
+	c.audit.actor = actor
+	c.audit.undoes = 0
+}
+
+// record добавляет запись журнала об изменении события, вызывается из save и remove
+func (c *Calendar) record(action string, before, after *Event) {
+	a := c.audit
+	a.seq++
+	entry := AuditEntry{
+		Seq:    a.seq,
+		Op:     a.op,
+		Undoes: a.undoes,
+		Time:   time.Now().UTC(),
+		Actor:  a.actor,
+		Action: action,
+		Before: before,
+		After:  after,
+	}
+	if after != nil {
+		entry.EventID = after.ID
+	} else {
+		entry.EventID = before.ID
+	}
+
+	if len(a.entries) == a.history {
+		a.entries = a.entries[1:]
+	}
+	a.entries = append(a.entries, entry)
+	if a.capture {
+		a.captured = append(a.captured, entry)
+	}
+
+	if a.file == nil {
+		return
+	}
+	if err := a.append(entry); err != nil {
+		slog.Error("failed to write audit entry", "seq", entry.Seq, "error", err)
+	}
+}
+
+// append дописывает запись в файл журнала с fsync. Если запись не удалась,
+// файл обрезается до последней целой записи, как журнал хранилища в storage.go
+func (a *auditLog) append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line := append(data, '\n')
+	if _, err = a.file.Write(line); err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		if terr := a.file.Truncate(a.size); terr != nil {
+			return errors.Join(err, terr)
+		}
+		_, serr := a.file.Seek(a.size, io.SeekStart)
+		return errors.Join(err, serr)
+	}
+	a.size += int64(len(line))
+	return nil
+}
+
+// OpenAuditLog загружает журнал из файла path и дальше дописывает его туда.
+// Недописанная при падении последняя запись отбрасывается, файл обрезается до последней целой записи.
+// Пустой path - журнал хранится только в памяти
+func (c *Calendar) OpenAuditLog(path string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			break
+		}
+		if len(c.audit.entries) == c.audit.history {
+			c.audit.entries = c.audit.entries[1:]
+		}
+		c.audit.entries = append(c.audit.entries, entry)
+		c.audit.seq = max(c.audit.seq, entry.Seq)
+		c.audit.op = max(c.audit.op, entry.Op)
+		valid += int64(len(line))
+	}
+
+	if err = file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	c.audit.file = file
+	c.audit.size = valid
+	return nil
+}
+
+// CloseAuditLog закрывает файл журнала
+func (c *Calendar) CloseAuditLog() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.audit.file == nil {
+		return nil
+	}
+	err := c.audit.file.Close()
+	c.audit.file = nil
+	return err
+}
+
+// AuditQuery фильтр журнала
+type AuditQuery struct {
+	UserID  string
+	EventID string
+	Limit   int
+}
+
+// Audit возвращает записи журнала, относящиеся к пользователю, от новых к старым
+func (c *Calendar) Audit(q AuditQuery) []AuditEntry {
+	if q.Limit <= 0 || q.Limit > maxPageLimit {
+		q.Limit = defaultPageLimit
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	result := []AuditEntry{}
+	for i := len(c.audit.entries) - 1; i >= 0 && len(result) < q.Limit; i-- {
+		entry := c.audit.entries[i]
+		if entry.concerns(q.UserID) && (q.EventID == "" || entry.EventID == q.EventID) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// command обратная операция для отмены записи журнала
+type command interface {
+	// check проверяет, что команду можно выполнить над состоянием state, и меняет его так же, как execute
+	check(state *undoState) error
+	execute(c *Calendar) error
+}
+
+// removeCommand удаляет событие, созданное отменяемой операцией
+type removeCommand struct {
+	after Event
+}
+
+func (cmd removeCommand) check(state *undoState) error {
+	if !state.unchanged(cmd.after.ID, &cmd.after) {
+		return ErrVersionMismatch
+	}
+	state.events[cmd.after.ID] = nil
+	return nil
+}
+
+func (cmd removeCommand) execute(c *Calendar) error {
+	return c.remove(cmd.after.ID)
+}
+
+// restoreCommand возвращает событие к снимку до отменяемой операции
+type restoreCommand struct {
+	before Event
+	after  *Event // nil - операция событие удалила
+}
+
+func (cmd restoreCommand) check(state *undoState) error {
+	var after *Event
+	if cmd.after != nil {
+		copied := *cmd.after
+		after = &copied
+	}
+	if !state.unchanged(cmd.before.ID, after) {
+		return ErrVersionMismatch
+	}
+	restored := cmd.before
+	state.events[restored.ID] = &restored
+	return nil
+}
+
+func (cmd restoreCommand) execute(c *Calendar) error {
+	restored := cmd.before
+	return c.save(&restored)
+}
+
+// inverse обратная команда для записи журнала
+func (e AuditEntry) inverse() command {
+	if e.Before == nil {
+		return removeCommand{after: *e.After}
+	}
+	return restoreCommand{before: *e.Before, after: e.After}
+}
+
+// undoState состояние событий поверх календаря, на котором команды отмены проверяются до выполнения
+type undoState struct {
+	calendar *Calendar
+	events   map[string]*Event // nil - событие удалено
+}
+
+func (s *undoState) find(id string) (Event, bool) {
+	if event, ok := s.events[id]; ok {
+		if event == nil {
+			return Event{}, false
+		}
+		return *event, true
+	}
+	return s.calendar.find(id)
+}
+
+// unchanged проверяет, что событие id в состоянии after, которое оставила отменяемая операция.
+// nil after - операция событие удалила. Версии не сравниваются: их меняют и предыдущие отмены
+func (s *undoState) unchanged(id string, after *Event) bool {
+	current, ok := s.find(id)
+	if after == nil || !ok {
+		return after == nil && !ok
+	}
+
+	current.Version, after.Version = 0, 0
+	a, errA := json.Marshal(current)
+	b, errB := json.Marshal(*after)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// Undo отменяет n последних еще не отмененных операций пользователя userID и возвращает записи журнала отмены.
+// Отмена выполняется целиком или не выполняется: если событие изменилось после операции, возвращается ErrVersionMismatch,
+// если userID больше не может менять событие - ErrForbidden
+func (c *Calendar) Undo(ctx context.Context, userID string, n int) ([]AuditEntry, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// операции пользователя от новых к старым, кроме отмен и уже отмененных
+	undone := make(map[uint64]bool)
+	var ops []uint64
+	byOp := make(map[uint64][]AuditEntry)
+	for i := len(c.audit.entries) - 1; i >= 0; i-- {
+		entry := c.audit.entries[i]
+		if entry.Undoes != 0 {
+			undone[entry.Undoes] = true
+		}
+		if entry.Actor != userID || entry.Undoes != 0 || undone[entry.Op] {
+			continue
+		}
+		if _, ok := byOp[entry.Op]; !ok {
+			if len(ops) == n {
+				break
+			}
+			ops = append(ops, entry.Op)
+		}
+		byOp[entry.Op] = append(byOp[entry.Op], entry)
+	}
+
+	// записи byOp уже идут от новых к старым, в этом порядке их и нужно отменять
+	state := &undoState{calendar: c, events: make(map[string]*Event)}
+	for _, op := range ops {
+		for _, entry := range byOp[op] {
+			if !c.canUndo(state, entry, userID) {
+				return nil, ErrForbidden
+			}
+			if err := entry.inverse().check(state); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	first := c.audit.seq + 1
+	actor := actorFrom(ctx, userID)
+	for _, op := range ops {
+		if err := c.revert(actor, op, byOp[op]); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []AuditEntry{}
+	for _, entry := range c.audit.entries {
+		if entry.Seq >= first {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// canUndo проверяет, что пользователь сейчас может менять событие записи в состоянии state и снимок "до",
+// а если они лежат в общем календаре - писать в этот календарь. Вызывается под блокировкой
+func (c *Calendar) canUndo(state *undoState, entry AuditEntry, userID string) bool {
+	writable := func(event Event) bool {
+		return c.canWrite(event, userID) && c.checkCalendar(event.CalendarID, userID) == nil
+	}
+	if current, ok := state.find(entry.EventID); ok && !writable(current) {
+		return false
+	}
+	return entry.Before == nil || writable(*entry.Before)
+}
+
+// revert выполняет обратные команды записей операции op, записи идут от новых к старым.
+// Отмена записывается в журнал новой операцией actor со ссылкой на op, вызывается под блокировкой
+func (c *Calendar) revert(actor string, op uint64, entries []AuditEntry) error {
+	c.begin(actor)
+	c.audit.undoes = op
+	for _, entry := range entries {
+		if err := entry.inverse().execute(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditLogPath файл журнала рядом с файловым хранилищем
+func auditLogPath(storageKind, dataDir string) string {
+	if storageKind != "file" {
+		return ""
+	}
+	return filepath.Join(dataDir, auditFile)
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	verr := &ValidationError{}
+	q := AuditQuery{UserID: query.Get("user_id"), EventID: query.Get("event_id")}
+	if _, err := strconv.Atoi(q.UserID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			verr.Add("limit", "must be between 1 and "+strconv.Itoa(maxPageLimit))
+		}
+	}
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, q.UserID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	writeResult(w, calendarFrom(r.Context()).Audit(q))
+}
+
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verr := &ValidationError{}
+	userID := parseUserParam(r, "user_id", verr)
+	n := 1
+	if value := r.FormValue("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 || n > maxUndo {
+			verr.Add("n", "must be between 1 and "+strconv.Itoa(maxUndo))
+		}
+	}
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	entries, err := calendarFrom(r.Context()).Undo(r.Context(), userID, n)
+	if errors.Is(err, ErrVersionMismatch) {
+		writeError(w, &statusError{http.StatusPreconditionFailed, "Events were modified after the operation, nothing was undone"})
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, entries)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Аутентификация запросов. Поддерживаются два способа:
+
+	X-API-Key: <ключ>                 ключи и их владельцы перечислены в конфиге (api_keys)
+	Authorization: Bearer <токен>     токен, подписанный HMAC-SHA256 секретом token_secret
+
+Токен - это base64url(JSON {"sub", "role", "tenant", "exp"}) и base64url(подпись) через точку, проверяется локально.
+Выпустить токен: task -issue-token 3 -role user -tenant team-a -token-ttl 24h.
+tenant у ключа или в токене привязывает учетные данные к арендатору, см. tenant.go.
+
+Пользователь работает только со своими событиями, роль admin - с событиями любого пользователя.
+Занятость (/freebusy) доступна любому аутентифицированному пользователю.
+Если в конфиге нет ни ключей, ни секрета, аутентификация отключена.
+*/
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+var (
+	errUnauthenticated = errors.New("missing credentials")
+	errInvalidToken    = errors.New("invalid token")
+	errTokenExpired    = errors.New("token expired")
+	errInvalidAPIKey   = errors.New("invalid API key")
+)
+
+// Principal аутентифицированный пользователь. Tenant - арендатор, к которому привязаны учетные данные
+type Principal struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func (p Principal) Admin() bool {
+	return p.Role == roleAdmin
+}
+
+// тело токена
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	Tenant  string `json:"tenant,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// Authenticator проверяет API ключи и токены
+type Authenticator struct {
+	apiKeys map[string]Principal
+	secret  []byte
+	now     func() time.Time
+}
+
+func NewAuthenticator(apiKeys map[string]Principal, secret string) *Authenticator {
+	return &Authenticator{apiKeys: apiKeys, secret: []byte(secret), now: time.Now}
+}
+
+// Enabled сообщает, требуется ли аутентификация
+func (a *Authenticator) Enabled() bool {
+	return a != nil && (len(a.apiKeys) > 0 || len(a.secret) > 0)
+}
+
+// Authenticate определяет пользователя по заголовкам запроса
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return a.checkAPIKey(key)
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return Principal{}, errUnauthenticated
+	}
+	return a.VerifyToken(strings.TrimSpace(token))
+}
+
+func (a *Authenticator) checkAPIKey(key string) (Principal, error) {
+	// сравниваем со всеми ключами за постоянное время, чтобы не подсказывать ключ временем ответа
+	var principal Principal
+	found := false
+	for known, owner := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(key)) == 1 {
+			principal, found = owner, true
+		}
+	}
+	if !found {
+		return Principal{}, errInvalidAPIKey
+	}
+	return principal, nil
+}
+
+func (a *Authenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueToken выпускает токен для principal, действующий ttl
+func (a *Authenticator) IssueToken(principal Principal, ttl time.Duration) (string, error) {
+	if len(a.secret) == 0 {
+		return "", errors.New("token_secret is not configured")
+	}
+
+	claims, err := json.Marshal(tokenClaims{
+		Subject: principal.UserID,
+		Role:    principal.Role,
+		Tenant:  principal.Tenant,
+		Expires: a.now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + a.sign(payload), nil
+}
+
+// VerifyToken проверяет подпись и срок действия токена
+func (a *Authenticator) VerifyToken(token string) (Principal, error) {
+	if len(a.secret) == 0 {
+		return Principal{}, errInvalidToken
+	}
+
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return Principal{}, errInvalidToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Principal{}, errInvalidToken
+	}
+	var claims tokenClaims
+	if err = json.Unmarshal(raw, &claims); err != nil {
+		return Principal{}, errInvalidToken
+	}
+	if a.now().Unix() >= claims.Expires {
+		return Principal{}, errTokenExpired
+	}
+
+	principal := Principal{UserID: claims.Subject, Role: claims.Role, Tenant: claims.Tenant}
+	if err = validatePrincipal(principal); err != nil {
+		return Principal{}, errInvalidToken
+	}
+	return principal, nil
+}
+
+func validatePrincipal(principal Principal) error {
+	if principal.Tenant != "" && !validTenantID(principal.Tenant) {
+		return fmt.Errorf("invalid tenant %q", principal.Tenant)
+	}
+	switch principal.Role {
+	case roleAdmin:
+		return nil
+	case roleUser:
+		if _, err := strconv.Atoi(principal.UserID); err != nil {
+			return fmt.Errorf("invalid user_id %q", principal.UserID)
+		}
+		return nil
+	default:
+		return fmt.Errorf("role must be %s or %s", roleUser, roleAdmin)
+	}
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom возвращает пользователя, которого аутентифицировал authenticate
+func principalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// actorFrom автор изменения для журнала аудита: аутентифицированный пользователь из ctx,
+// без аутентификации - userID из запроса
+func actorFrom(ctx context.Context, userID string) string {
+	if principal, ok := principalFrom(ctx); ok {
+		return principal.UserID
+	}
+	return userID
+}
+
+var authenticator *Authenticator
+
+// authenticate пропускает к next только аутентифицированные запросы
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authenticator.Enabled() {
+			next(w, r)
+			return
+		}
+
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			writeJSON(w, http.StatusUnauthorized, APIResponse{Error: err.Error()})
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// allowed проверяет, что вызывающий может работать с событиями пользователя userID
+func allowed(r *http.Request, userID string) bool {
+	return permitted(r.Context(), userID)
+}
+
+// allowedEvent проверяет, что вызывающий может видеть событие: свое, как участник или через общий календарь
+func allowedEvent(r *http.Request, event Event) bool {
+	return permittedEvent(r.Context(), event)
+}
+
+// permitted то же, что allowed, для пользователя из ctx любого транспорта
+func permitted(ctx context.Context, userID string) bool {
+	principal, ok := principalFrom(ctx)
+	if !ok {
+		return !authenticator.Enabled()
+	}
+	return principal.Admin() || principal.UserID == userID
+}
+
+// permittedEvent то же, что allowedEvent, для пользователя из ctx любого транспорта
+func permittedEvent(ctx context.Context, event Event) bool {
+	principal, ok := principalFrom(ctx)
+	if !ok {
+		return !authenticator.Enabled()
+	}
+	return principal.Admin() || calendarFrom(ctx).CanRead(event, principal.UserID)
+}
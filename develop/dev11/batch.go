@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Пакетные операции над событиями.
+
+	POST /events/batch?mode=atomic|best_effort   JSON-массив операций, ответ {"result": {"items": [...], ...}}
+	POST /events/batch/stream                    NDJSON: операция на строку, ответ NDJSON: результат на строку
+
+Операция - поля события как в теле API v2 и:
+
+	op                create, update или delete
+	id                событие для update и delete
+	occurrence        дата вхождения серии для update и delete, без нее - вся серия
+	version           ожидаемая версия события, как в If-Match
+	reject_conflicts  create не сохраняет событие, пересекающееся с существующими
+
+	{"op": "create", "user_id": "1", "date": "2026-10-19", "description": "Планерка"}
+	{"op": "delete", "user_id": "1", "id": "5f2b8a1c9d3e4f60"}
+
+Операции выполняются по порядку теми же методами Calendar, что и одиночные запросы. Результат операции -
+index, status - код, которым ответил бы одиночный метод, и result или error с details.
+
+mode=atomic (по умолчанию) выполняет пакет под одной блокировкой календаря: если операция не удалась,
+выполненные до нее откатываются обратными командами, как в /undo (в журнале аудита откат - отмена этих
+операций), остальные не выполняются. У всех операций, кроме неудавшейся, status 424.
+mode=best_effort выполняет каждую операцию независимо от ошибок остальных.
+
+Поток NDJSON не ограничен по размеру и работает только в режиме best_effort: операции выполняются пачками
+по batchChunk, результаты пачки отправляются сразу после ее выполнения. Строка - не больше max_body_bytes.
+*/
+
+const (
+	maxBatchOps = 1000
+	batchChunk  = 100
+
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+
+	batchAtomic     = "atomic"
+	batchBestEffort = "best_effort"
+)
+
+var (
+	// ErrBatchAborted операция пакета не выполнена или откачена, потому что не удалась другая операция
+	ErrBatchAborted = errors.New("not applied: another operation in the batch failed")
+
+	errIncompleteRollback = errors.New("batch rollback: audit entries of the batch are incomplete")
+)
+
+// BatchOp операция пакета. Для delete в Event достаточно ID, UserID и Version
+type BatchOp struct {
+	Action          string
+	Event           Event
+	Occurrence      string
+	RejectConflicts bool
+}
+
+// BatchResult итог операции пакета: сохраненное событие или ошибка
+type BatchResult struct {
+	Event Event
+	Err   error
+}
+
+// Batch выполняет операции по порядку. В режиме atomic первая ошибка откатывает выполненные операции,
+// остальные получают ErrBatchAborted; ошибка отката возвращается вторым значением
+func (c *Calendar) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// обратные команды берутся из записей самого пакета: история журнала в памяти ограничена
+	// и на большом пакете могла бы вытеснить его первые записи
+	first := c.audit.seq + 1
+	c.audit.capture, c.audit.captured = atomic, nil
+	defer func() {
+		c.audit.capture, c.audit.captured = false, nil
+	}()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		c.begin(actorFrom(ctx, op.Event.UserID))
+		event, err := c.apply(op)
+		results[i] = BatchResult{Event: event, Err: err}
+		if err == nil || !atomic {
+			continue
+		}
+
+		for j := range results {
+			if j != i {
+				results[j] = BatchResult{Err: ErrBatchAborted}
+			}
+		}
+		// неудавшаяся операция тоже откатывается: вхождение серии могло сохраниться без самой серии
+		entries := c.audit.captured
+		c.audit.capture = false
+		return results, c.rollback(first, entries)
+	}
+	return results, nil
+}
+
+// apply выполняет операцию пакета, вызывается под блокировкой
+func (c *Calendar) apply(op BatchOp) (Event, error) {
+	switch {
+	case op.Action == batchCreate:
+		return c.addEvent(op.Event, op.RejectConflicts)
+	case op.Action == batchUpdate && op.Occurrence != "":
+		return c.updateOccurrence(op.Event, op.Occurrence)
+	case op.Action == batchUpdate:
+		return c.updateEvent(op.Event)
+	case op.Action == batchDelete && op.Occurrence != "":
+		return Event{}, c.deleteOccurrence(op.Event, op.Occurrence)
+	case op.Action == batchDelete:
+		return Event{}, c.deleteEvent(op.Event)
+	default:
+		return Event{}, invalid("op", "must be create, update or delete")
+	}
+}
+
+// rollback отменяет записи журнала entries с номера first от новых к старым. Если записей с first
+// до последней не хватает, ничего не откатывается и возвращается ошибка. Вызывается под блокировкой
+func (c *Calendar) rollback(first uint64, entries []AuditEntry) error {
+	if first+uint64(len(entries)) != c.audit.seq+1 {
+		return errIncompleteRollback
+	}
+	for i, entry := range entries {
+		if entry.Seq != first+uint64(i) {
+			return errIncompleteRollback
+		}
+	}
+
+	var ops []uint64
+	byOp := make(map[uint64][]AuditEntry)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if _, ok := byOp[entry.Op]; !ok {
+			ops = append(ops, entry.Op)
+		}
+		byOp[entry.Op] = append(byOp[entry.Op], entry)
+	}
+
+	for _, op := range ops {
+		if err := c.revert(byOp[op][0].Actor, op, byOp[op]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// операция пакета в теле запроса
+type batchRequest struct {
+	eventRequest
+	Op              string `json:"op"`
+	Occurrence      string `json:"occurrence,omitempty"`
+	Version         int64  `json:"version,omitempty"`
+	RejectConflicts bool   `json:"reject_conflicts,omitempty"`
+}
+
+// результат операции пакета в ответе
+type batchItem struct {
+	Index   int         `json:"index"`
+	Status  int         `json:"status"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// ответ на JSON-массив операций
+type batchResponse struct {
+	Mode    string      `json:"mode"`
+	Applied int         `json:"applied"`
+	Failed  int         `json:"failed"`
+	Items   []batchItem `json:"items"`
+}
+
+// Apply выполняет одну операцию пакета
+func (c *Calendar) Apply(ctx context.Context, op BatchOp) (Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, op.Event.UserID))
+
+	return c.apply(op)
+}
+
+// parseBatchOp проверяет операцию пакета и право вызывающего из ctx на события ее пользователя
+func parseBatchOp(ctx context.Context, body batchRequest) (BatchOp, error) {
+	verr := &ValidationError{}
+	if _, err := strconv.Atoi(body.UserID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	switch body.Op {
+	case batchCreate:
+		if body.ID != "" {
+			verr.Add("id", "is assigned by the server")
+		}
+		if body.Occurrence != "" {
+			verr.Add("occurrence", "is supported only for update and delete")
+		}
+	case batchUpdate, batchDelete:
+		if body.ID == "" {
+			verr.Add("id", "is required")
+		}
+		if _, err := time.Parse(dateLayout, body.Occurrence); body.Occurrence != "" && err != nil {
+			verr.Add("occurrence", "expected YYYY-MM-DD")
+		}
+	default:
+		verr.Add("op", "must be create, update or delete")
+	}
+	if err := verr.Err(); err != nil {
+		return BatchOp{}, err
+	}
+	if !permitted(ctx, body.UserID) {
+		return BatchOp{}, ErrForbidden
+	}
+
+	op := BatchOp{Action: body.Op, Occurrence: body.Occurrence, RejectConflicts: body.RejectConflicts}
+	if body.Op == batchDelete {
+		op.Event = Event{ID: body.ID, UserID: body.UserID}
+	} else {
+		event, err := body.event(body.UserID, body.ID)
+		if err != nil {
+			return BatchOp{}, err
+		}
+		op.Event = *event
+	}
+	op.Event.Version = body.Version
+	return op, nil
+}
+
+// runBatch разбирает и выполняет операции. В режиме atomic ошибка разбора любой операции отменяет весь пакет
+func runBatch(ctx context.Context, raws []json.RawMessage, atomic bool, offset int) ([]batchItem, error) {
+	items := make([]batchItem, len(raws))
+	var (
+		ops       []BatchOp
+		indexes   []int
+		malformed bool
+	)
+	for i, raw := range raws {
+		var (
+			body batchRequest
+			op   BatchOp
+		)
+		err := json.Unmarshal(raw, &body)
+		if err != nil {
+			err = &statusError{http.StatusBadRequest, "Malformed operation"}
+		} else {
+			op, err = parseBatchOp(ctx, body)
+		}
+		if err != nil {
+			items[i] = newBatchItem(offset+i, BatchOp{}, BatchResult{Err: err})
+			malformed = true
+			continue
+		}
+		ops = append(ops, op)
+		indexes = append(indexes, i)
+	}
+
+	var results []BatchResult
+	if malformed && atomic {
+		results = make([]BatchResult, len(ops))
+		for i := range results {
+			results[i].Err = ErrBatchAborted
+		}
+	} else {
+		var err error
+		if results, err = calendarFrom(ctx).Batch(ctx, ops, atomic); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, result := range results {
+		items[indexes[i]] = newBatchItem(offset+indexes[i], ops[i], result)
+	}
+	return items, nil
+}
+
+// newBatchItem результат операции с кодом, которым ответил бы одиночный метод
+func newBatchItem(index int, op BatchOp, result BatchResult) batchItem {
+	item := batchItem{Index: index, Status: http.StatusOK}
+	switch {
+	case errors.Is(result.Err, ErrBatchAborted):
+		item.Status, item.Error = http.StatusFailedDependency, "Not applied: another operation in the batch failed"
+	case result.Err != nil:
+		var response APIResponse
+		item.Status, response = errorResponse(result.Err)
+		item.Error, item.Details = response.Error, response.Details
+	case op.Action == batchDelete:
+		item.Result = "Event deleted successfully"
+	default:
+		item.Result = result.Event
+	}
+	return item
+}
+
+// parseBatchMode читает режим пакета, по умолчанию atomic
+func parseBatchMode(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", batchAtomic:
+		return batchAtomic, nil
+	case batchBestEffort:
+		return mode, nil
+	default:
+		return "", invalid("mode", "must be atomic or best_effort")
+	}
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	mode, err := parseBatchMode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var raws []json.RawMessage
+	if err = json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, err)
+			return
+		}
+		writeError(w, &statusError{http.StatusBadRequest, "Expected a JSON array of operations"})
+		return
+	}
+	if len(raws) > maxBatchOps {
+		writeError(w, &statusError{http.StatusRequestEntityTooLarge, "At most " + strconv.Itoa(maxBatchOps) + " operations per batch, use /events/batch/stream"})
+		return
+	}
+
+	items, err := runBatch(r.Context(), raws, mode == batchAtomic, 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, newBatchResponse(mode, items))
+}
+
+func newBatchResponse(mode string, items []batchItem) batchResponse {
+	response := batchResponse{Mode: mode, Items: items}
+	for _, item := range items {
+		if item.Error == "" {
+			response.Applied++
+		} else {
+			response.Failed++
+		}
+	}
+	return response
+}
+
+// messageLimit наибольшая строка потоковых протоколов: поток NDJSON и JSON-RPC
+func messageLimit() int {
+	if maxBodyBytes > 0 {
+		return int(maxBodyBytes)
+	}
+	return maxImportFileBytes
+}
+
+func batchStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if mode, err := parseBatchMode(r); err != nil || r.URL.Query().Has("mode") && mode != batchBestEffort {
+		writeError(w, invalid("mode", "stream supports only best_effort"))
+		return
+	}
+
+	// поток читается и пишется дольше таймаутов сервера, ответы уходят до конца тела запроса
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeError(w, err)
+		return
+	}
+	// HTTP/2 дуплексный всегда, там EnableFullDuplex не поддерживается и не нужен
+	_ = rc.EnableFullDuplex()
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), messageLimit())
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+
+	index := 0
+	flush := func(chunk []json.RawMessage) bool {
+		items, err := runBatch(r.Context(), chunk, false, index)
+		if err != nil {
+			status, response := errorResponse(err)
+			items = []batchItem{{Index: index, Status: status, Error: response.Error}}
+		}
+		index += len(chunk)
+		for _, item := range items {
+			if encoder.Encode(item) != nil {
+				return false
+			}
+		}
+		return rc.Flush() == nil
+	}
+
+	var chunk []json.RawMessage
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		chunk = append(chunk, json.RawMessage(append([]byte(nil), line...)))
+		if len(chunk) == batchChunk {
+			if !flush(chunk) {
+				return
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 && !flush(chunk) {
+		return
+	}
+
+	if err := scanner.Err(); err != nil {
+		item := batchItem{Index: index, Status: http.StatusBadRequest, Error: "Failed to read operations: " + err.Error()}
+		if errors.Is(err, bufio.ErrTooLong) {
+			item.Status, item.Error = http.StatusRequestEntityTooLarge, "Operation line too large"
+		}
+		encoder.Encode(item)
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"wb-tech-level-2/develop/dev11/client"
+)
+
+/*
+=== Утилита calctl ===
+
+Клиент командной строки для HTTP API календаря из develop/dev11, работает через пакет client.
+
+	calctl <команда> [флаги] [аргументы]
+
+Команды:
+	add     создать событие
+	update  изменить событие -id, серию целиком или вхождение -occurrence
+	rm      удалить событие -id или вхождение -occurrence
+	day     события за день -date (по умолчанию сегодня)
+	week    события за неделю, в которую входит -date, или за неделю ISO -week 2026-W42
+	month   события за месяц, в который входит -date
+	export  выгрузить события пользователя в iCalendar
+	import  загрузить события из файла iCalendar (без аргумента или "-" - из stdin)
+
+Общие флаги:
+	-config  файл конфигурации, по умолчанию $CALCTL_CONFIG или <UserConfigDir>/calctl/config.json
+	-server  адрес сервера вместо указанного в конфиге
+	-user    пользователь вместо user_id из конфига
+	-tenant  арендатор вместо tenant из конфига, уходит в X-Tenant-ID
+	-o       формат вывода: table, json или ics
+
+Конфиг - JSON с адресом сервера и учетными данными:
+	{"server": "http://localhost:8080", "api_key": "...", "token": "...", "tenant": "team-a",
+	 "user_id": "1", "time_zone": "Europe/Moscow", "output": "table"}
+Файла по умолчанию может не быть, тогда сервер - http://localhost:8080 без учетных данных.
+
+Формат ics доступен командам add, update, day, week и month, export выводит только ics,
+rm и import - только table и json. Формат из конфига, который команда не поддерживает, заменяется ее форматом по умолчанию.
+
+Коды выхода соответствуют классам ошибок API:
+	0   успех
+	1   прочие ошибки
+	2   неверные аргументы или конфиг
+	3   ошибка входных данных: 400, 422, а также события, не загруженные import
+	4   нет доступа: 401, 403
+	5   событие не найдено: 404, 503 без max_events
+	6   пересечение с другими событиями: 409
+	7   событие изменено после чтения: 412
+	8   слишком большой запрос: 413
+	9   превышен лимит запросов: 429
+	10  сервер недоступен или ответил 5xx
+	11  исчерпана квота арендатора на события: 503 с max_events
+*/
+
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitInvalid
+	exitForbidden
+	exitNotFound
+	exitConflict
+	exitVersionMismatch
+	exitTooLarge
+	exitRateLimited
+	exitUnavailable
+	exitQuotaExceeded
+)
+
+const (
+	defaultServer  = "http://localhost:8080"
+	dateLayout     = "2006-01-02"
+	requestTimeout = 30 * time.Second
+)
+
+// config файл конфигурации calctl
+type config struct {
+	Server   string `json:"server"`
+	APIKey   string `json:"api_key"`
+	Token    string `json:"token"`
+	Tenant   string `json:"tenant"`
+	UserID   string `json:"user_id"`
+	TimeZone string `json:"time_zone"`
+	Output   string `json:"output"`
+}
+
+// loadConfig читает конфиг path. Если путь не задан явно, отсутствие файла по умолчанию не ошибка
+func loadConfig(path string) (config, error) {
+	cfg := config{Server: defaultServer}
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("CALCTL_CONFIG")
+		explicit = path != ""
+	}
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return cfg, nil
+		}
+		path = filepath.Join(dir, "calctl", "config.json")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Server == "" {
+		cfg.Server = defaultServer
+	}
+	return cfg, nil
+}
+
+// usageError ошибка аргументов командной строки
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// errRejected import загрузил не все события
+var errRejected = errors.New("some events were not imported")
+
+// exitCode код выхода для ошибки команды
+func exitCode(err error) int {
+	var usage usageError
+	if errors.As(err, &usage) {
+		return exitUsage
+	}
+	if errors.Is(err, errRejected) {
+		return exitInvalid
+	}
+
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) {
+			return exitUnavailable
+		}
+		return exitFailure
+	}
+	switch {
+	case apiErr.Conflict() || apiErr.StatusCode == http.StatusConflict:
+		return exitConflict
+	case apiErr.NotFound():
+		return exitNotFound
+	case apiErr.QuotaExceeded():
+		return exitQuotaExceeded
+	case apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnprocessableEntity:
+		return exitInvalid
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		return exitForbidden
+	case apiErr.StatusCode == http.StatusPreconditionFailed:
+		return exitVersionMismatch
+	case apiErr.StatusCode == http.StatusRequestEntityTooLarge:
+		return exitTooLarge
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return exitRateLimited
+	case apiErr.StatusCode >= 500:
+		return exitUnavailable
+	}
+	return exitFailure
+}
+
+// cli состояние запуска команды
+type cli struct {
+	api    *client.Client
+	config config
+	user   string
+	output string
+	stdout io.Writer
+	stdin  io.Reader
+}
+
+// command команда calctl. formats - допустимые форматы вывода, первый используется по умолчанию.
+// setup регистрирует флаги команды и возвращает действие, которое выполняется после их разбора
+type command struct {
+	name    string
+	args    string
+	summary string
+	formats []string
+	setup   func(fs *flag.FlagSet, c *cli) func(ctx context.Context, args []string) error
+}
+
+var eventFormats = []string{"table", "json", "ics"}
+
+var commands = []command{
+	{name: "add", summary: "Create an event", formats: eventFormats, setup: addCommand},
+	{name: "update", summary: "Update an event, a whole series or one occurrence", formats: eventFormats, setup: updateCommand},
+	{name: "rm", summary: "Delete an event or one occurrence", formats: []string{"table", "json"}, setup: rmCommand},
+	{name: "day", summary: "List events for a day", formats: eventFormats, setup: periodCommand("day")},
+	{name: "week", summary: "List events for a week", formats: eventFormats, setup: periodCommand("week")},
+	{name: "month", summary: "List events for a month", formats: eventFormats, setup: periodCommand("month")},
+	{name: "export", summary: "Export events to iCalendar", formats: []string{"ics"}, setup: exportCommand},
+	{name: "import", args: "[file]", summary: "Import events from an iCalendar file or stdin", formats: []string{"table", "json"}, setup: importCommand},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: calctl <command> [flags] [args]")
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, `run "calctl <command> -h" for command flags`)
+}
+
+// run выполняет команду и возвращает код выхода
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage(stdout)
+		return exitOK
+	}
+	index := slices.IndexFunc(commands, func(cmd command) bool { return cmd.name == args[0] })
+	if index < 0 {
+		fmt.Fprintf(stderr, "calctl: unknown command %q\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+	cmd := commands[index]
+
+	c := &cli{stdout: stdout, stdin: stdin}
+	fs := flag.NewFlagSet("calctl "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "Config file")
+	server := fs.String("server", "", "Server URL")
+	tenant := fs.String("tenant", "", "Tenant ID")
+	fs.StringVar(&c.user, "user", "", "User ID")
+	fs.StringVar(&c.output, "o", "", "Output format: "+strings.Join(cmd.formats, ", "))
+	action := cmd.setup(fs, c)
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "calctl: config: %v\n", err)
+		return exitUsage
+	}
+	if *server != "" {
+		cfg.Server = *server
+	}
+	if *tenant != "" {
+		cfg.Tenant = *tenant
+	}
+	c.config = cfg
+	if c.user == "" {
+		c.user = cfg.UserID
+	}
+	switch {
+	case c.output == "" && slices.Contains(cmd.formats, cfg.Output):
+		c.output = cfg.Output
+	case c.output == "":
+		c.output = cmd.formats[0]
+	case !slices.Contains(cmd.formats, c.output):
+		fmt.Fprintf(stderr, "calctl %s: output format %q is not supported, use %s\n", cmd.name, c.output, strings.Join(cmd.formats, ", "))
+		return exitUsage
+	}
+
+	c.api = client.New(cfg.Server)
+	c.api.HTTPClient = &http.Client{Timeout: requestTimeout}
+	c.api.APIKey = cfg.APIKey
+	c.api.Token = cfg.Token
+	c.api.Tenant = cfg.Tenant
+
+	if err = action(context.Background(), fs.Args()); err != nil {
+		fmt.Fprintf(stderr, "calctl %s: %v\n", cmd.name, err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// eventFlags регистрирует флаги полей события для add и update
+func eventFlags(fs *flag.FlagSet, c *cli, params *client.EventParams) func() error {
+	fs.StringVar(&params.Date, "date", "", "Date YYYY-MM-DD, all-day event without -start")
+	fs.StringVar(&params.Start, "start", "", "Start, RFC 3339 or YYYY-MM-DDTHH:MM in -tz")
+	fs.StringVar(&params.End, "end", "", "End")
+	fs.StringVar(&params.Duration, "duration", "", "Duration instead of -end, e.g. 1h30m")
+	fs.StringVar(&params.TimeZone, "tz", "", "IANA time zone")
+	fs.StringVar(&params.Description, "desc", "", "Description")
+	fs.StringVar(&params.RRule, "rrule", "", "Recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO")
+	fs.StringVar(&params.CalendarID, "calendar", "", "Shared calendar ID")
+	exdates := fs.String("exdate", "", "Comma-separated excluded dates of the series")
+	reminders := fs.String("remind", "", "Comma-separated reminders, minutes before start")
+	attendees := fs.String("attendees", "", "Comma-separated attendee user IDs")
+
+	return func() error {
+		params.UserID = c.user
+		if params.TimeZone == "" {
+			params.TimeZone = c.config.TimeZone
+		}
+		params.ExDates = splitList(*exdates)
+		params.Attendees = splitList(*attendees)
+		for _, value := range splitList(*reminders) {
+			minutes, err := strconv.Atoi(value)
+			if err != nil {
+				return usagef("invalid reminder %q", value)
+			}
+			params.Reminders = append(params.Reminders, minutes)
+		}
+		return nil
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func addCommand(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	var params client.EventParams
+	finish := eventFlags(fs, c, &params)
+	fs.BoolVar(&params.RejectConflicts, "reject-conflicts", false, "Fail if the event overlaps existing ones")
+
+	return func(ctx context.Context, _ []string) error {
+		if err := finish(); err != nil {
+			return err
+		}
+		event, err := c.api.CreateEvent(ctx, params)
+		if err != nil {
+			return err
+		}
+		return c.printEvents([]client.Event{event})
+	}
+}
+
+func updateCommand(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	var params client.EventParams
+	finish := eventFlags(fs, c, &params)
+	fs.StringVar(&params.ID, "id", "", "Event ID")
+	fs.StringVar(&params.Occurrence, "occurrence", "", "Date of the series occurrence to change")
+	fs.Int64Var(&params.Version, "version", 0, "Expected event version, 0 - do not check")
+
+	return func(ctx context.Context, _ []string) error {
+		if params.ID == "" {
+			return usagef("-id is required")
+		}
+		if err := finish(); err != nil {
+			return err
+		}
+		if _, err := c.api.UpdateEvent(ctx, params); err != nil {
+			return err
+		}
+		event, err := c.api.Event(ctx, params.ID)
+		if err != nil {
+			return err
+		}
+		return c.printEvents([]client.Event{event})
+	}
+}
+
+func rmCommand(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	var params client.EventParams
+	fs.StringVar(&params.ID, "id", "", "Event ID")
+	fs.StringVar(&params.Occurrence, "occurrence", "", "Date of the series occurrence to delete")
+	fs.Int64Var(&params.Version, "version", 0, "Expected event version, 0 - do not check")
+
+	return func(ctx context.Context, _ []string) error {
+		if params.ID == "" {
+			return usagef("-id is required")
+		}
+		params.UserID = c.user
+		if err := c.api.DeleteEvent(ctx, params); err != nil {
+			return err
+		}
+
+		if c.output == "json" {
+			return writeJSON(c.stdout, map[string]string{"deleted": params.ID, "occurrence": params.Occurrence})
+		}
+		if params.Occurrence != "" {
+			_, err := fmt.Fprintf(c.stdout, "deleted %s occurrence %s\n", params.ID, params.Occurrence)
+			return err
+		}
+		_, err := fmt.Fprintf(c.stdout, "deleted %s\n", params.ID)
+		return err
+	}
+}
+
+// periodCommand команда day, week или month
+func periodCommand(period string) func(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	return func(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+		date := fs.String("date", "", "Date YYYY-MM-DD, default today")
+		tz := fs.String("tz", "", "IANA time zone of the period")
+		var week string
+		if period == "week" {
+			fs.StringVar(&week, "week", "", "ISO 8601 week, e.g. 2026-W42, instead of -date")
+		}
+
+		return func(ctx context.Context, _ []string) error {
+			if *tz == "" {
+				*tz = c.config.TimeZone
+			}
+			if *date == "" {
+				*date = today(*tz)
+			}
+
+			var events []client.Event
+			var err error
+			switch {
+			case week != "":
+				events, err = c.api.EventsForISOWeek(ctx, c.user, week, *tz)
+			case period == "day":
+				events, err = c.api.EventsForDay(ctx, c.user, *date, *tz)
+			case period == "week":
+				events, err = c.api.EventsForWeek(ctx, c.user, *date, *tz)
+			default:
+				events, err = c.api.EventsForMonth(ctx, c.user, *date, *tz)
+			}
+			if err != nil {
+				return err
+			}
+			return c.printEvents(events)
+		}
+	}
+}
+
+// today сегодняшняя дата в зоне tz, при неизвестной зоне - в местной
+func today(tz string) string {
+	now := time.Now()
+	if loc, err := time.LoadLocation(tz); tz != "" && err == nil {
+		now = now.In(loc)
+	}
+	return now.Format(dateLayout)
+}
+
+func exportCommand(fs *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	out := fs.String("out", "", "Output file instead of stdout")
+
+	return func(ctx context.Context, _ []string) error {
+		data, err := c.api.Export(ctx, c.user)
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			return os.WriteFile(*out, data, 0o644)
+		}
+		_, err = c.stdout.Write(data)
+		return err
+	}
+}
+
+func importCommand(_ *flag.FlagSet, c *cli) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 1 {
+			return usagef("at most one file expected")
+		}
+		in := c.stdin
+		if len(args) == 1 && args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+
+		result, err := c.api.Import(ctx, c.user, in)
+		if err != nil {
+			return err
+		}
+		if c.output == "json" {
+			err = writeJSON(c.stdout, result)
+		} else {
+			err = printImportResult(c.stdout, result)
+		}
+		if err == nil && len(result.Errors) > 0 {
+			err = fmt.Errorf("%w: %d rejected", errRejected, len(result.Errors))
+		}
+		return err
+	}
+}
+
+func printImportResult(w io.Writer, result client.ImportResult) error {
+	fmt.Fprintf(w, "created %d, updated %d\n", result.Created, result.Updated)
+	if len(result.Errors) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tUID\tERROR")
+	for _, item := range result.Errors {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", item.Index, item.UID, item.Error)
+	}
+	return tw.Flush()
+}
+
+// printEvents выводит события в формате c.output
+func (c *cli) printEvents(events []client.Event) error {
+	switch c.output {
+	case "json":
+		if events == nil {
+			events = []client.Event{}
+		}
+		return writeJSON(c.stdout, events)
+	case "ics":
+		return writeICalendar(c.stdout, events, time.Now())
+	}
+	return writeTable(c.stdout, events)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// location зона события, при неизвестной - UTC
+func location(event client.Event) *time.Location {
+	loc, err := time.LoadLocation(event.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// writeTable выводит события таблицей, время - в зоне события
+func writeTable(w io.Writer, events []client.Event) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDATE\tTIME\tTZ\tDESCRIPTION\tVERSION")
+	for _, event := range events {
+		when := "all day"
+		if !event.AllDay {
+			loc := location(event)
+			start, end := event.Start.In(loc), event.End.In(loc)
+			when = start.Format("15:04") + "-" + end.Format("15:04")
+			if end.Format(dateLayout) != start.Format(dateLayout) {
+				when = start.Format("15:04") + "-" + end.Format("2006-01-02 15:04")
+			}
+		}
+		id := event.ID
+		if event.RecurrenceID != "" {
+			id += "@" + event.RecurrenceID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", id, event.Date, when, event.TimeZone, event.Description, event.Version)
+	}
+	return tw.Flush()
+}
+
+const (
+	icalMaxLineOctets = 75
+	icalDateLayout    = "20060102"
+	icalTimeLayout    = "20060102T150405"
+	icalUTCTimeLayout = "20060102T150405Z"
+)
+
+// icalEscaper экранирует текстовые значения свойств
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+// icalWriter пишет строки свойств с переносом по 75 октетов, запоминая первую ошибку
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *icalWriter) line(line string) {
+	for iw.err == nil && len(line) > icalMaxLineOctets {
+		cut := icalMaxLineOctets
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		_, iw.err = fmt.Fprintf(iw.w, "%s\r\n ", line[:cut])
+		line = line[cut:]
+	}
+	if iw.err == nil {
+		_, iw.err = fmt.Fprintf(iw.w, "%s\r\n", line)
+	}
+}
+
+// icalTimeProp форматирует время события так же, как выгрузка сервера: дата, UTC или местное время с TZID
+func icalTimeProp(name string, t time.Time, event client.Event) string {
+	if event.AllDay {
+		return name + ";VALUE=DATE:" + t.In(location(event)).Format(icalDateLayout)
+	}
+	loc := location(event)
+	if loc == time.UTC {
+		return name + ":" + t.UTC().Format(icalUTCTimeLayout)
+	}
+	return name + ";TZID=" + loc.String() + ":" + t.In(loc).Format(icalTimeLayout)
+}
+
+// occurrenceStart время начала вхождения серии event в дату date
+func occurrenceStart(event client.Event, date string) time.Time {
+	loc := location(event)
+	day, _ := time.ParseInLocation(dateLayout, date, loc)
+	start := event.Start.In(loc)
+	return time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, loc)
+}
+
+// writeICalendar выводит события периода в VCALENDAR. Вхождения серий выгружаются
+// отдельными VEVENT с RECURRENCE-ID без RRULE: в периоде есть только часть серии
+func writeICalendar(w io.Writer, events []client.Event, now time.Time) error {
+	iw := &icalWriter{w: w}
+	iw.line("BEGIN:VCALENDAR")
+	iw.line("VERSION:2.0")
+	iw.line("PRODID:-//wb-tech-level-2//calctl//EN")
+	for _, event := range events {
+		uid := event.UID
+		if event.SeriesID != "" {
+			uid = event.SeriesID
+		}
+		if uid == "" {
+			uid = event.ID
+		}
+
+		iw.line("BEGIN:VEVENT")
+		iw.line("UID:" + icalEscaper.Replace(uid))
+		iw.line("DTSTAMP:" + now.UTC().Format(icalUTCTimeLayout))
+		if event.RecurrenceID != "" {
+			iw.line(icalTimeProp("RECURRENCE-ID", occurrenceStart(event, event.RecurrenceID), event))
+		}
+		iw.line(icalTimeProp("DTSTART", event.Start, event))
+		iw.line(icalTimeProp("DTEND", event.End, event))
+		iw.line("SUMMARY:" + icalEscaper.Replace(event.Description))
+		if event.RRule != "" && event.RecurrenceID == "" {
+			iw.line("RRULE:" + event.RRule)
+			for _, date := range event.ExDates {
+				iw.line(icalTimeProp("EXDATE", occurrenceStart(event, date), event))
+			}
+		}
+		iw.line("END:VEVENT")
+	}
+	iw.line("END:VCALENDAR")
+	return iw.err
+}
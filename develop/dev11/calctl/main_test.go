@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeServer отвечает как сервер календаря: события за день для ключа k, на остальные методы - ошибками
+func newFakeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	reply := func(w http.ResponseWriter, status int, body string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "k" {
+			reply(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/events_for_day":
+			reply(w, http.StatusOK, `{"result":[{"id":"e1","user_id":"1","date":"2026-10-19",
+				"start":"2026-10-19T07:00:00Z","end":"2026-10-19T08:00:00Z","time_zone":"Europe/Moscow",
+				"description":"Стендап, daily","version":3}]}`)
+		case "/create_event":
+			if r.Header.Get("X-Tenant-ID") == "small" {
+				reply(w, http.StatusServiceUnavailable, `{"error":"Event quota exceeded","details":{"max_events":1}}`)
+				return
+			}
+			reply(w, http.StatusConflict, `{"error":"Event conflicts","details":{"conflicting_ids":["e1"]}}`)
+		case "/update_event":
+			reply(w, http.StatusPreconditionFailed, `{"error":"Version mismatch"}`)
+		case "/delete_event":
+			reply(w, http.StatusServiceUnavailable, `{"error":"Event not found"}`)
+		case "/import":
+			w.Header().Set("Retry-After", "1")
+			reply(w, http.StatusTooManyRequests, `{"error":"Too many requests"}`)
+		default:
+			reply(w, http.StatusInternalServerError, `{"error":"Internal error"}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Вывод в разных форматах и коды выхода по классам ошибок API
+func TestRun(t *testing.T) {
+	server := newFakeServer(t)
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := `{"server": "` + server.URL + `", "api_key": "k", "user_id": "1", "output": "json"}`
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{"table", []string{"day", "-o", "table", "-date", "2026-10-19"}, exitOK, "e1  2026-10-19  10:00-11:00  Europe/Moscow  Стендап, daily  3"},
+		{"json from config", []string{"day", "-date", "2026-10-19"}, exitOK, `"id": "e1"`},
+		{"ics", []string{"day", "-o", "ics", "-date", "2026-10-19"}, exitOK, "DTSTART;TZID=Europe/Moscow:20261019T100000\r\nDTEND;TZID=Europe/Moscow:20261019T110000\r\nSUMMARY:Стендап\\, daily\r\n"},
+		{"unsupported format", []string{"rm", "-id", "e1", "-o", "ics"}, exitUsage, ""},
+		{"missing id", []string{"update", "-date", "2026-10-19"}, exitUsage, ""},
+		{"conflict", []string{"add", "-date", "2026-10-19"}, exitConflict, ""},
+		{"quota exceeded", []string{"add", "-tenant", "small", "-date", "2026-10-19"}, exitQuotaExceeded, ""},
+		{"version mismatch", []string{"update", "-id", "e1", "-version", "2"}, exitVersionMismatch, ""},
+		{"not found", []string{"rm", "-id", "e2"}, exitNotFound, ""},
+		{"rate limited", []string{"import"}, exitRateLimited, ""},
+		{"server error", []string{"export"}, exitUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{tt.args[0], "-config", configPath}, tt.args[1:]...)
+			code := run(args, strings.NewReader(""), &stdout, &stderr)
+			if code != tt.code {
+				t.Fatalf("exit code = %d, want %d, stderr: %s", code, tt.code, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.output) {
+				t.Errorf("output = %q, want it to contain %q", stdout.String(), tt.output)
+			}
+		})
+	}
+
+	// явно указанный конфиг обязателен, учетные данные берутся только из него
+	var stderr bytes.Buffer
+	if code := run([]string{"day", "-server", server.URL, "-config", filepath.Join(t.TempDir(), "none.json")}, nil, &bytes.Buffer{}, &stderr); code != exitUsage {
+		t.Errorf("missing explicit config: exit code = %d, want %d", code, exitUsage)
+	}
+	os.WriteFile(configPath, []byte(`{"server": "`+server.URL+`"}`), 0o644)
+	if code := run([]string{"day", "-config", configPath}, nil, &bytes.Buffer{}, &stderr); code != exitForbidden {
+		t.Errorf("no api key: exit code = %d, want %d", code, exitForbidden)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Лента изменений событий пользователя: своих, тех, где он участник, и из доступных ему общих календарей.
+
+	GET /events/stream?user_id=     Server-Sent Events
+	GET /events/ws?user_id=         WebSocket (RFC 6455), см. websocket.go
+
+Каждое изменение календаря получает следующий номер последовательности и рассылается подписчикам.
+Номера начинаются заново при каждом запуске сервера, поэтому id изменения - номер запуска (epoch) и номер через дефис:
+
+	id: lx3k9q2a1b-42
+	event: updated
+	data: {"id":"lx3k9q2a1b-42","seq":42,"type":"updated","event":{...}}
+
+Переподключившийся клиент передает id последнего полученного изменения в заголовке Last-Event-ID
+(или в параметре last_event_id) и получает пропущенные изменения из истории последних changeHistory изменений.
+Если пропущенное уже вытеснено из истории или id не из этого запуска сервера, приходит событие reset:
+клиенту нужно перечитать события запросом и продолжить с id из reset.
+*/
+
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+	changeReset   = "reset"
+
+	changeHistory     = 1000
+	subscriberBuffer  = 64
+	heartbeatInterval = 15 * time.Second
+)
+
+// Change изменение события
+type Change struct {
+	ID    string `json:"id"`
+	Seq   uint64 `json:"seq"`
+	Type  string `json:"type"`
+	Event *Event `json:"event,omitempty"` // пустое у reset
+
+	audience []string // пользователи, которым видно изменение
+}
+
+// Subscription подписка на изменения событий пользователя.
+// Канал C закрывается, если подписчик не успевает читать изменения или лента закрыта
+type Subscription struct {
+	C      <-chan Change
+	ch     chan Change
+	userID string
+}
+
+// ChangeFeed нумерует изменения, хранит недавнюю историю и рассылает изменения подписчикам
+type ChangeFeed struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []Change // последние изменения по возрастанию Seq, не больше limit
+	limit       int
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+func NewChangeFeed(limit int) *ChangeFeed {
+	return &ChangeFeed{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		limit:       limit,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// change изменение с номером seq этого запуска, вызывается под f.mu
+func (f *ChangeFeed) change(seq uint64, kind string) Change {
+	return Change{ID: f.epoch + "-" + strconv.FormatUint(seq, 10), Seq: seq, Type: kind}
+}
+
+// position номер изменения из id, если id выдан этим запуском ленты
+func (f *ChangeFeed) position(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != f.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// Publish присваивает изменению номер и рассылает его подписчикам из audience, не блокируясь на медленных
+func (f *ChangeFeed) Publish(kind string, event Event, audience []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	change := f.change(f.seq, kind)
+	change.Event, change.audience = &event, audience
+	if len(f.history) == f.limit {
+		f.history = append(f.history[:0], f.history[1:]...)
+	}
+	f.history = append(f.history, change)
+
+	for sub := range f.subscribers {
+		if !containsString(audience, sub.userID) {
+			continue
+		}
+		select {
+		case sub.ch <- change:
+		default:
+			// подписчик отстал: закрываем канал, клиент переподключится с Last-Event-ID
+			delete(f.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe подписывает на изменения пользователя после изменения с id after и возвращает пропущенные изменения,
+// пустой after - только новые изменения. Если часть изменений после after недоступна или after из другого
+// запуска, ok равен false, а вместо пропущенных возвращается одно событие reset
+func (f *ChangeFeed) Subscribe(userID, after string) (sub *Subscription, missed []Change, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan Change, subscriberBuffer)
+	sub = &Subscription{C: ch, ch: ch, userID: userID}
+	if f.closed {
+		close(ch)
+		return sub, nil, true
+	}
+	f.subscribers[sub] = struct{}{}
+	if after == "" {
+		return sub, nil, true
+	}
+
+	seq, ok := f.position(after)
+	ok = ok && seq <= f.seq && (seq == f.seq || (len(f.history) > 0 && f.history[0].Seq <= seq+1))
+	if !ok {
+		return sub, []Change{f.change(f.seq, changeReset)}, false
+	}
+	for _, change := range f.history {
+		if change.Seq > seq && containsString(change.audience, userID) {
+			missed = append(missed, change)
+		}
+	}
+	return sub, missed, true
+}
+
+// Unsubscribe отменяет подписку
+func (f *ChangeFeed) Unsubscribe(sub *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Close закрывает все подписки, чтобы потоковые обработчики завершились при остановке сервера
+func (f *ChangeFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// parseFeedParams парсит user_id и id последнего полученного изменения
+func parseFeedParams(r *http.Request) (string, string, error) {
+	userID := r.URL.Query().Get("user_id")
+	if _, err := strconv.Atoi(userID); err != nil {
+		return "", "", invalid("user_id", "must be an integer")
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	return userID, lastID, nil
+}
+
+// writeSSE отправляет изменение в формате Server-Sent Events
+func writeSSE(w http.ResponseWriter, change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", change.ID, change.Type, data)
+	return err
+}
+
+func eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	userID, after, err := parseFeedParams(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	// поток живет дольше WriteTimeout сервера
+	rc := http.NewResponseController(w)
+	if err = rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	feed := calendarFrom(r.Context()).feed
+	sub, pending, _ := feed.Subscribe(userID, after)
+	defer feed.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, change := range pending {
+		if writeSSE(w, change) != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if writeSSE(w, change) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
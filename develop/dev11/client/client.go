@@ -0,0 +1,637 @@
+// Package client клиент HTTP API календаря из develop/dev11. Описание API - openapi.json рядом с сервером
+// или GET /openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attendee участник события
+type Attendee struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// Event событие календаря
+type Event struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Date        string    `json:"date"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	TimeZone    string    `json:"time_zone"`
+	AllDay      bool      `json:"all_day"`
+	Description string    `json:"description"`
+
+	RRule        string   `json:"rrule,omitempty"`
+	ExDates      []string `json:"exdates,omitempty"`
+	SeriesID     string   `json:"series_id,omitempty"`
+	RecurrenceID string   `json:"recurrence_id,omitempty"`
+	UID          string   `json:"uid,omitempty"`
+	Reminders    []int    `json:"reminders,omitempty"`
+
+	Attendees  []Attendee `json:"attendees,omitempty"`
+	CalendarID string     `json:"calendar_id,omitempty"`
+	Version    int64      `json:"version"`
+}
+
+// EventPage страница результатов Events
+type EventPage struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// BusyInterval интервал занятости [Start, End)
+type BusyInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// SharedCalendar общий календарь
+type SharedCalendar struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	OwnerID string            `json:"owner_id"`
+	Grants  map[string]string `json:"grants,omitempty"`
+}
+
+// ImportResult итоги импорта iCalendar
+type ImportResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Errors  []struct {
+		Index int    `json:"index"`
+		UID   string `json:"uid,omitempty"`
+		Error string `json:"error"`
+	} `json:"errors,omitempty"`
+}
+
+// AuditEntry запись журнала об изменении события. Before нет у создания, After - у удаления
+type AuditEntry struct {
+	Seq     uint64    `json:"seq"`
+	Op      uint64    `json:"op"`
+	Undoes  uint64    `json:"undoes,omitempty"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	EventID string    `json:"event_id"`
+	Before  *Event    `json:"before,omitempty"`
+	After   *Event    `json:"after,omitempty"`
+}
+
+// TenantUsage квоты арендатора и их использование, 0 в квоте - без ограничения
+type TenantUsage struct {
+	Tenant          string  `json:"tenant"`
+	Events          int     `json:"events"`
+	MaxEvents       int     `json:"max_events"`
+	RateLimit       float64 `json:"rate_limit"`
+	RateBurst       int     `json:"rate_burst"`
+	RequestsAllowed uint64  `json:"requests_allowed"`
+	RequestsLimited uint64  `json:"requests_limited"`
+}
+
+// BatchOp операция пакета: Op - create, update или delete, поля события как в теле API v2.
+// Для delete достаточно ID, UserID и Version
+type BatchOp struct {
+	Op              string   `json:"op"`
+	ID              string   `json:"id,omitempty"`
+	UserID          string   `json:"user_id"`
+	Date            string   `json:"date,omitempty"`
+	Start           string   `json:"start,omitempty"`
+	End             string   `json:"end,omitempty"`
+	Duration        string   `json:"duration,omitempty"`
+	TimeZone        string   `json:"time_zone,omitempty"`
+	Description     string   `json:"description,omitempty"`
+	RRule           string   `json:"rrule,omitempty"`
+	ExDates         []string `json:"exdates,omitempty"`
+	Reminders       []int    `json:"reminders,omitempty"`
+	Attendees       []string `json:"attendees,omitempty"`
+	CalendarID      string   `json:"calendar_id,omitempty"`
+	Occurrence      string   `json:"occurrence,omitempty"`
+	Version         int64    `json:"version,omitempty"`
+	RejectConflicts bool     `json:"reject_conflicts,omitempty"`
+}
+
+// BatchItem результат операции пакета. Event есть у выполненных create и update, Err - у неудавшейся
+// операции; Err.StatusCode 424 - операция не выполнена из-за ошибки другой операции пакета
+type BatchItem struct {
+	Index  int
+	Status int
+	Event  *Event
+	Err    *Error
+}
+
+func (item *BatchItem) UnmarshalJSON(data []byte) error {
+	var wire struct {
+		errorBody
+		Index  int             `json:"index"`
+		Status int             `json:"status"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	*item = BatchItem{Index: wire.Index, Status: wire.Status}
+	if wire.Error != "" {
+		item.Err = wire.apiError(wire.Status)
+		return nil
+	}
+	// delete отвечает строкой, create и update - событием
+	if len(wire.Result) > 0 && wire.Result[0] == '{' {
+		item.Event = &Event{}
+		return json.Unmarshal(wire.Result, item.Event)
+	}
+	return nil
+}
+
+// BatchResult итоги пакета
+type BatchResult struct {
+	Mode    string      `json:"mode"`
+	Applied int         `json:"applied"`
+	Failed  int         `json:"failed"`
+	Items   []BatchItem `json:"items"`
+}
+
+// EventParams параметры события для CreateEvent, UpdateEvent и DeleteEvent. Пустые поля не отправляются
+type EventParams struct {
+	ID          string
+	UserID      string
+	Date        string // событие на весь день, если Start пустой
+	Start       string // RFC 3339 или YYYY-MM-DDTHH:MM в зоне TimeZone
+	End         string
+	Duration    string // вместо End, например "1h30m"
+	TimeZone    string
+	Description string
+	RRule       string
+	ExDates     []string
+	Reminders   []int
+	Attendees   []string
+	CalendarID  string
+
+	// Occurrence дата вхождения серии, которое меняет или удаляет запрос
+	Occurrence string
+	// Version ожидаемая версия события для If-Match, 0 - не проверять
+	Version int64
+	// RejectConflicts не создавать событие, пересекающееся с существующими
+	RejectConflicts bool
+}
+
+func (p EventParams) values() url.Values {
+	values := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	set("id", p.ID)
+	set("user_id", p.UserID)
+	set("date", p.Date)
+	set("start", p.Start)
+	set("end", p.End)
+	set("duration", p.Duration)
+	set("tz", p.TimeZone)
+	set("description", p.Description)
+	set("rrule", p.RRule)
+	set("exdate", strings.Join(p.ExDates, ","))
+	set("attendees", strings.Join(p.Attendees, ","))
+	set("calendar_id", p.CalendarID)
+	set("occurrence", p.Occurrence)
+	if len(p.Reminders) > 0 {
+		reminders := make([]string, len(p.Reminders))
+		for i, minutes := range p.Reminders {
+			reminders[i] = strconv.Itoa(minutes)
+		}
+		values.Set("reminders", strings.Join(reminders, ","))
+	}
+	if p.RejectConflicts {
+		values.Set("reject_conflicts", "true")
+	}
+	return values
+}
+
+// EventQuery параметры Events. From и To - YYYY-MM-DD (To включительно) или RFC 3339
+type EventQuery struct {
+	UserID   string
+	From     string
+	To       string
+	TimeZone string
+	Limit    int
+	Cursor   string
+	Desc     bool
+}
+
+// Error ответ сервера с ошибкой
+type Error struct {
+	StatusCode int
+	Message    string
+	// Fields ошибки входных данных по полям
+	Fields map[string]string
+	// ConflictingIDs события, с которыми пересекается создаваемое
+	ConflictingIDs []string
+	// RetryAfter через сколько повторить запрос после 429
+	RetryAfter time.Duration
+	// MaxEvents квота арендатора на события, если запрос отклонен из-за нее
+	MaxEvents int
+}
+
+func (e *Error) Error() string {
+	if len(e.Fields) == 0 {
+		return fmt.Sprintf("calendar: %d %s", e.StatusCode, e.Message)
+	}
+
+	fields := make([]string, 0, len(e.Fields))
+	for field, message := range e.Fields {
+		fields = append(fields, field+": "+message)
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("calendar: %d %s (%s)", e.StatusCode, e.Message, strings.Join(fields, "; "))
+}
+
+// NotFound событие не найдено. Методы задания отвечают на это 503, как и на исчерпанную квоту
+func (e *Error) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound ||
+		e.StatusCode == http.StatusServiceUnavailable && e.MaxEvents == 0
+}
+
+// Conflict событие пересекается с существующими
+func (e *Error) Conflict() bool {
+	return len(e.ConflictingIDs) > 0
+}
+
+// QuotaExceeded у арендатора уже максимум событий
+func (e *Error) QuotaExceeded() bool {
+	return e.MaxEvents > 0
+}
+
+// errorBody тело ответа с ошибкой
+type errorBody struct {
+	Error   string `json:"error"`
+	Details struct {
+		Fields         map[string]string `json:"fields"`
+		ConflictingIDs []string          `json:"conflicting_ids"`
+		MaxEvents      int               `json:"max_events"`
+	} `json:"details"`
+}
+
+func (b errorBody) apiError(status int) *Error {
+	return &Error{
+		StatusCode:     status,
+		Message:        b.Error,
+		Fields:         b.Details.Fields,
+		ConflictingIDs: b.Details.ConflictingIDs,
+		MaxEvents:      b.Details.MaxEvents,
+	}
+}
+
+// Client клиент API. APIKey или Token задают учетные данные, если на сервере включена аутентификация,
+// Tenant - арендатора для X-Tenant-ID, пустой - арендатор учетных данных или default
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	APIKey     string
+	Token      string
+	Tenant     string
+}
+
+// New создает клиент сервера с адресом baseURL, например http://localhost:8080
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// do отправляет запрос и превращает ответ с ошибкой в *Error
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.Tenant)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body errorBody
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+		apiErr = body.apiError(resp.StatusCode)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return nil, apiErr
+}
+
+// call выполняет запрос к методу path и раскладывает {"result": ...} в result
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body io.Reader, header http.Header, result interface{}) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return resp, nil
+	}
+	envelope := struct {
+		Result interface{} `json:"result"`
+	}{Result: result}
+	if err = json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("calendar: invalid response: %w", err)
+	}
+	return resp, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, result interface{}) error {
+	_, err := c.call(ctx, http.MethodGet, path, query, nil, nil, result)
+	return err
+}
+
+// postForm отправляет форму, ненулевая version уходит в If-Match
+func (c *Client) postForm(ctx context.Context, path string, form url.Values, version int64, result interface{}) (*http.Response, error) {
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	if version != 0 {
+		header.Set("If-Match", `"`+strconv.FormatInt(version, 10)+`"`)
+	}
+	return c.call(ctx, http.MethodPost, path, nil, strings.NewReader(form.Encode()), header, result)
+}
+
+// CreateEvent создает событие и возвращает его с ID и версией
+func (c *Client) CreateEvent(ctx context.Context, params EventParams) (Event, error) {
+	var event Event
+	_, err := c.postForm(ctx, "/create_event", params.values(), 0, &event)
+	return event, err
+}
+
+// UpdateEvent изменяет событие params.ID, серию целиком или вхождение params.Occurrence,
+// и возвращает новую версию события
+func (c *Client) UpdateEvent(ctx context.Context, params EventParams) (int64, error) {
+	resp, err := c.postForm(ctx, "/update_event", params.values(), params.Version, nil)
+	if err != nil {
+		return 0, err
+	}
+	version, _ := strconv.ParseInt(strings.Trim(resp.Header.Get("ETag"), `"`), 10, 64)
+	return version, nil
+}
+
+// DeleteEvent удаляет событие params.ID пользователя params.UserID или вхождение params.Occurrence
+func (c *Client) DeleteEvent(ctx context.Context, params EventParams) error {
+	form := url.Values{"id": {params.ID}, "user_id": {params.UserID}}
+	if params.Occurrence != "" {
+		form.Set("occurrence", params.Occurrence)
+	}
+	_, err := c.postForm(ctx, "/delete_event", form, params.Version, nil)
+	return err
+}
+
+// Event возвращает событие по ID
+func (c *Client) Event(ctx context.Context, id string) (Event, error) {
+	var event Event
+	err := c.get(ctx, "/event", url.Values{"id": {id}}, &event)
+	return event, err
+}
+
+// noEventsMessage ошибка, которой сервер отвечает на период без событий
+const noEventsMessage = "No events found for the specified user and date"
+
+func (c *Client) period(ctx context.Context, path, userID, date, tz string) ([]Event, error) {
+	query := url.Values{"user_id": {userID}, "date": {date}}
+	if tz != "" {
+		query.Set("tz", tz)
+	}
+	return c.periodEvents(ctx, path, query)
+}
+
+// periodEvents запрашивает события за период, ошибку сервера о пустом периоде превращает в пустой список
+func (c *Client) periodEvents(ctx context.Context, path string, query url.Values) ([]Event, error) {
+	var events []Event
+	err := c.get(ctx, path, query, &events)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable && apiErr.Message == noEventsMessage {
+		return []Event{}, nil
+	}
+	return events, err
+}
+
+// EventsForDay возвращает события пользователя за день date в зоне tz, пустая tz - UTC
+func (c *Client) EventsForDay(ctx context.Context, userID, date, tz string) ([]Event, error) {
+	return c.period(ctx, "/events_for_day", userID, date, tz)
+}
+
+// EventsForWeek возвращает события пользователя за неделю, в которую входит date.
+// Первый день недели задает week_start в конфиге сервера
+func (c *Client) EventsForWeek(ctx context.Context, userID, date, tz string) ([]Event, error) {
+	return c.period(ctx, "/events_for_week", userID, date, tz)
+}
+
+// EventsForISOWeek возвращает события пользователя за неделю ISO 8601 вида 2026-W42, она начинается с понедельника
+func (c *Client) EventsForISOWeek(ctx context.Context, userID, week, tz string) ([]Event, error) {
+	query := url.Values{"user_id": {userID}, "week": {week}}
+	if tz != "" {
+		query.Set("tz", tz)
+	}
+	return c.periodEvents(ctx, "/events_for_week", query)
+}
+
+// EventsForMonth возвращает события пользователя за месяц, в который входит date
+func (c *Client) EventsForMonth(ctx context.Context, userID, date, tz string) ([]Event, error) {
+	return c.period(ctx, "/events_for_month", userID, date, tz)
+}
+
+// Events возвращает страницу событий за диапазон, следующая страница - с Cursor = NextCursor
+func (c *Client) Events(ctx context.Context, q EventQuery) (EventPage, error) {
+	query := url.Values{"user_id": {q.UserID}, "from": {q.From}, "to": {q.To}}
+	if q.TimeZone != "" {
+		query.Set("tz", q.TimeZone)
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		query.Set("cursor", q.Cursor)
+	}
+	if q.Desc {
+		query.Set("order", "desc")
+	}
+
+	var page EventPage
+	err := c.get(ctx, "/events", query, &page)
+	return page, err
+}
+
+// Search ищет события пользователя по описанию: слова, префиксы слово* и фразы в кавычках
+func (c *Client) Search(ctx context.Context, userID, q string) ([]Event, error) {
+	var events []Event
+	err := c.get(ctx, "/search", url.Values{"user_id": {userID}, "q": {q}}, &events)
+	return events, err
+}
+
+// FreeBusy возвращает объединенную занятость пользователей в диапазоне from - to
+func (c *Client) FreeBusy(ctx context.Context, userIDs []string, from, to, tz string) ([]BusyInterval, error) {
+	query := url.Values{"user_ids": {strings.Join(userIDs, ",")}, "from": {from}, "to": {to}}
+	if tz != "" {
+		query.Set("tz", tz)
+	}
+	var intervals []BusyInterval
+	err := c.get(ctx, "/freebusy", query, &intervals)
+	return intervals, err
+}
+
+// RSVP сохраняет ответ участника userID на приглашение: accepted, declined или tentative
+func (c *Client) RSVP(ctx context.Context, id, userID, status string) (Event, error) {
+	var event Event
+	_, err := c.postForm(ctx, "/rsvp", url.Values{"id": {id}, "user_id": {userID}, "status": {status}}, 0, &event)
+	return event, err
+}
+
+// Calendars возвращает общие календари, доступные пользователю
+func (c *Client) Calendars(ctx context.Context, userID string) ([]SharedCalendar, error) {
+	var calendars []SharedCalendar
+	err := c.get(ctx, "/calendars", url.Values{"user_id": {userID}}, &calendars)
+	return calendars, err
+}
+
+// CreateCalendar создает общий календарь пользователя
+func (c *Client) CreateCalendar(ctx context.Context, userID, name string) (SharedCalendar, error) {
+	var calendar SharedCalendar
+	_, err := c.postForm(ctx, "/calendars/create", url.Values{"user_id": {userID}, "name": {name}}, 0, &calendar)
+	return calendar, err
+}
+
+// ShareCalendar выдает granteeID право read или write на календарь, none - отзывает
+func (c *Client) ShareCalendar(ctx context.Context, userID, calendarID, granteeID, permission string) (SharedCalendar, error) {
+	form := url.Values{"user_id": {userID}, "calendar_id": {calendarID}, "grantee_id": {granteeID}, "permission": {permission}}
+	var calendar SharedCalendar
+	_, err := c.postForm(ctx, "/calendars/share", form, 0, &calendar)
+	return calendar, err
+}
+
+// Audit возвращает до limit записей журнала о событиях пользователя, новые первыми. Пустой eventID - все события
+func (c *Client) Audit(ctx context.Context, userID, eventID string, limit int) ([]AuditEntry, error) {
+	query := url.Values{"user_id": {userID}}
+	if eventID != "" {
+		query.Set("event_id", eventID)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var entries []AuditEntry
+	err := c.get(ctx, "/audit", query, &entries)
+	return entries, err
+}
+
+// Undo отменяет n последних операций пользователя и возвращает записи журнала об отмене
+func (c *Client) Undo(ctx context.Context, userID string, n int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	_, err := c.postForm(ctx, "/undo", url.Values{"user_id": {userID}, "n": {strconv.Itoa(n)}}, 0, &entries)
+	return entries, err
+}
+
+// Batch выполняет до 1000 операций одним запросом. atomic - все или ничего, иначе каждая операция независимо
+func (c *Client) Batch(ctx context.Context, ops []BatchOp, atomic bool) (BatchResult, error) {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	mode := "best_effort"
+	if atomic {
+		mode = "atomic"
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	var result BatchResult
+	_, err = c.call(ctx, http.MethodPost, "/events/batch", url.Values{"mode": {mode}}, bytes.NewReader(body), header, &result)
+	return result, err
+}
+
+// BatchStream отправляет операции из ops в NDJSON, по одной на строку, и вызывает fn для каждого результата
+// по мере выполнения. Операции выполняются независимо, ошибка fn прерывает поток
+func (c *Client) BatchStream(ctx context.Context, ops io.Reader, fn func(BatchItem) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/events/batch/stream", ops)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var item BatchItem
+		if err = decoder.Decode(&item); err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("calendar: invalid response: %w", err)
+		}
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// TenantUsage возвращает квоты арендатора запроса и их использование
+func (c *Client) TenantUsage(ctx context.Context) (TenantUsage, error) {
+	var usage TenantUsage
+	err := c.get(ctx, "/tenant", nil, &usage)
+	return usage, err
+}
+
+// Export выгружает события пользователя в iCalendar
+func (c *Client) Export(ctx context.Context, userID string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/export.ics?"+url.Values{"user_id": {userID}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Import загружает события пользователя из файла iCalendar
+func (c *Client) Import(ctx context.Context, userID string, ics io.Reader) (ImportResult, error) {
+	header := http.Header{"Content-Type": {"text/calendar"}}
+	var result ImportResult
+	_, err := c.call(ctx, http.MethodPost, "/import", url.Values{"user_id": {userID}}, ics, header, &result)
+	return result, err
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+Настройки сервера. Порядок применения: значения по умолчанию, файл конфига (JSON),
+переменные окружения CALENDAR_*, явно переданные флаги.
+
+	{"port": 8080, "storage": "file", "data_dir": "data", "read_timeout": "10s",
+	 "api_keys": {"secret-key": {"user_id": "3", "role": "user", "tenant": "team-a"}}, "token_secret": "...",
+	 "rate_limit": 10, "rate_burst": 20, "ip_rate_limit": 50, "ip_rate_burst": 100,
+	 "max_body_bytes": 1048576, "week_start": "monday",
+	 "tenants": {"team-a": {"max_events": 10000, "rate_limit": 50, "rate_burst": 100}}}
+*/
+
+const defaultConfigFile = "config.json"
+
+// Duration длительность, которая в JSON записывается строкой вида "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Config настройки сервера
+type Config struct {
+	Port            int      `json:"port"`
+	RPCPort         int      `json:"rpc_port"` // JSON-RPC поверх TCP, 0 - выключен
+	Storage         string   `json:"storage"`
+	DataDir         string   `json:"data_dir"`
+	Notifier        string   `json:"notifier"`
+	WebhookURL      string   `json:"webhook_url"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	APIKeys     map[string]Principal `json:"api_keys"`
+	TokenSecret string               `json:"token_secret"`
+
+	// RateLimit запросов в секунду на клиента, 0 - без ограничения, RateBurst - размер корзины
+	RateLimit    float64 `json:"rate_limit"`
+	RateBurst    int     `json:"rate_burst"`
+	MaxBodyBytes int64   `json:"max_body_bytes"`
+
+	// IPRateLimit и IPRateBurst то же для IP адреса до аутентификации, 0 - без ограничения
+	IPRateLimit float64 `json:"ip_rate_limit"`
+	IPRateBurst int     `json:"ip_rate_burst"`
+
+	// WeekStart первый день недели: monday, sunday, ...
+	WeekStart string `json:"week_start"`
+
+	// Tenants арендаторы и их квоты, default есть всегда
+	Tenants map[string]TenantQuota `json:"tenants"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:            8080,
+		Storage:         "memory",
+		DataDir:         "data",
+		Notifier:        "log",
+		ReadTimeout:     Duration{10 * time.Second},
+		WriteTimeout:    Duration{30 * time.Second},
+		IdleTimeout:     Duration{2 * time.Minute},
+		ShutdownTimeout: Duration{15 * time.Second},
+		RateLimit:       10,
+		RateBurst:       20,
+		IPRateLimit:     50,
+		IPRateBurst:     100,
+		MaxBodyBytes:    1 << 20,
+		WeekStart:       "monday",
+	}
+}
+
+// loadConfigFile читает файл конфига поверх текущих значений.
+// Отсутствие файла по умолчанию не считается ошибкой
+func (c *Config) loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && path == defaultConfigFile {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv применяет переменные окружения CALENDAR_*
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	strings := map[string]*string{
+		"CALENDAR_STORAGE":      &c.Storage,
+		"CALENDAR_DATA_DIR":     &c.DataDir,
+		"CALENDAR_NOTIFIER":     &c.Notifier,
+		"CALENDAR_WEBHOOK_URL":  &c.WebhookURL,
+		"CALENDAR_TOKEN_SECRET": &c.TokenSecret,
+		"CALENDAR_WEEK_START":   &c.WeekStart,
+	}
+	for name, field := range strings {
+		if value, ok := lookup(name); ok {
+			*field = value
+		}
+	}
+
+	if value, ok := lookup("CALENDAR_PORT"); ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid CALENDAR_PORT: %w", err)
+		}
+		c.Port = port
+	}
+	if value, ok := lookup("CALENDAR_RPC_PORT"); ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid CALENDAR_RPC_PORT: %w", err)
+		}
+		c.RPCPort = port
+	}
+	if value, ok := lookup("CALENDAR_RATE_LIMIT"); ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid CALENDAR_RATE_LIMIT: %w", err)
+		}
+		c.RateLimit = rate
+	}
+	if value, ok := lookup("CALENDAR_RATE_BURST"); ok {
+		burst, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid CALENDAR_RATE_BURST: %w", err)
+		}
+		c.RateBurst = burst
+	}
+	if value, ok := lookup("CALENDAR_MAX_BODY_BYTES"); ok {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid CALENDAR_MAX_BODY_BYTES: %w", err)
+		}
+		c.MaxBodyBytes = limit
+	}
+
+	durations := map[string]*Duration{
+		"CALENDAR_READ_TIMEOUT":     &c.ReadTimeout,
+		"CALENDAR_WRITE_TIMEOUT":    &c.WriteTimeout,
+		"CALENDAR_IDLE_TIMEOUT":     &c.IdleTimeout,
+		"CALENDAR_SHUTDOWN_TIMEOUT": &c.ShutdownTimeout,
+	}
+	for name, field := range durations {
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		field.Duration = duration
+	}
+	return nil
+}
+
+// registerConfigFlags объявляет флаги, которыми можно переопределить настройки
+func registerConfigFlags(flags *flag.FlagSet) {
+	flags.Int("port", 8080, "Port for the server")
+	flags.Int("rpc-port", 0, "Port for the JSON-RPC server, 0 disables it")
+	flags.String("storage", "memory", "Storage backend: memory or file")
+	flags.String("data", "data", "Directory for the file storage")
+	flags.String("notifier", "log", "Reminder notifier: log or webhook")
+	flags.String("webhook-url", "", "URL for the webhook notifier")
+}
+
+// applyFlags применяет флаги, переданные явно: они важнее конфига и окружения
+func (c *Config) applyFlags(flags *flag.FlagSet) {
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.(flag.Getter).Get()
+		switch f.Name {
+		case "port":
+			c.Port = value.(int)
+		case "rpc-port":
+			c.RPCPort = value.(int)
+		case "storage":
+			c.Storage = value.(string)
+		case "data":
+			c.DataDir = value.(string)
+		case "notifier":
+			c.Notifier = value.(string)
+		case "webhook-url":
+			c.WebhookURL = value.(string)
+		}
+	})
+}
+
+func (c *Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.RPCPort < 0 || c.RPCPort > 65535 || c.RPCPort == c.Port {
+		return fmt.Errorf("invalid rpc_port %d", c.RPCPort)
+	}
+	if c.ReadTimeout.Duration < 0 || c.WriteTimeout.Duration < 0 || c.IdleTimeout.Duration < 0 || c.ShutdownTimeout.Duration < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.RateLimit < 0 || c.IPRateLimit < 0 || c.MaxBodyBytes < 0 {
+		return errors.New("rate_limit, ip_rate_limit and max_body_bytes must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return errors.New("rate_burst must be at least 1 when rate_limit is set")
+	}
+	if c.IPRateLimit > 0 && c.IPRateBurst < 1 {
+		return errors.New("ip_rate_burst must be at least 1 when ip_rate_limit is set")
+	}
+	if _, err := parseWeekday(c.WeekStart); err != nil {
+		return fmt.Errorf("invalid week_start: %w", err)
+	}
+	quotas := c.tenantQuotas()
+	for id, quota := range quotas {
+		if !validTenantID(id) {
+			return fmt.Errorf("invalid tenant %q", id)
+		}
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("invalid quota of tenant %s: %w", id, err)
+		}
+	}
+	for _, principal := range c.APIKeys {
+		if err := validatePrincipal(principal); err != nil {
+			return fmt.Errorf("invalid api_keys entry: %w", err)
+		}
+		if _, ok := quotas[principal.Tenant]; principal.Tenant != "" && !ok {
+			return fmt.Errorf("invalid api_keys entry: unknown tenant %q", principal.Tenant)
+		}
+	}
+	return nil
+}
+
+// tenantQuotas арендаторы из конфига вместе с default
+func (c *Config) tenantQuotas() map[string]TenantQuota {
+	quotas := make(map[string]TenantQuota, len(c.Tenants)+1)
+	quotas[defaultTenant] = TenantQuota{}
+	for id, quota := range c.Tenants {
+		quotas[id] = quota
+	}
+	return quotas
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+Ошибки бизнес-логики и коды ответа по заданию: ошибка входных данных - 400, ошибка бизнес-логики - 503,
+остальные ошибки - 500.
+
+	*ValidationError    400  {"error": "...", "details": {"fields": {"date": "..."}}}
+	ErrNotFound         503  {"error": "Event not found"}
+	ErrNoEvents         503  {"error": "No events found for the specified user and date"}
+	*ConflictError      409  {"error": "...", "details": {"conflicting_ids": [...]}}
+	ErrForbidden        403  {"error": "Forbidden"}
+	ErrVersionMismatch  412  {"error": "Event was modified"}
+	*QuotaError         503  {"error": "Event quota exceeded", "details": {"max_events": N}}
+	*http.MaxBytesError 413  {"error": "Request body too large"}
+
+Обработчики отвечают через writeResult и writeError, API второй версии - через writeV2Error,
+пакетные операции берут код и тело для каждой операции из errorResponse.
+*/
+
+var (
+	// ErrNotFound событие не найдено или принадлежит другому пользователю
+	ErrNotFound = errors.New("event not found")
+	// ErrForbidden у пользователя нет прав на действие
+	ErrForbidden = errors.New("forbidden")
+	// ErrNoEvents у пользователя нет событий за запрошенный день, неделю или месяц
+	ErrNoEvents = errors.New("no events found")
+	// ErrVersionMismatch событие изменилось после версии, указанной в If-Match
+	ErrVersionMismatch = errors.New("event version mismatch")
+)
+
+// QuotaError у арендатора уже MaxEvents событий
+type QuotaError struct {
+	MaxEvents int `json:"max_events"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("event quota of %d events exceeded", e.MaxEvents)
+}
+
+// ValidationError ошибки входных данных по полям
+type ValidationError struct {
+	Fields map[string]string `json:"fields"`
+}
+
+// invalid создает ошибку одного поля
+func invalid(field, message string) *ValidationError {
+	e := &ValidationError{}
+	e.Add(field, message)
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, field+": "+e.Fields[field])
+	}
+	return "invalid " + strings.Join(parts, "; ")
+}
+
+// Add запоминает ошибку поля, первая ошибка поля важнее следующих
+func (e *ValidationError) Add(field, message string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	if _, ok := e.Fields[field]; !ok {
+		e.Fields[field] = message
+	}
+}
+
+// Merge добавляет ошибки из err, ошибка другого типа относится к полю field
+func (e *ValidationError) Merge(field string, err error) {
+	var other *ValidationError
+	if !errors.As(err, &other) {
+		e.Add(field, err.Error())
+		return
+	}
+	for name, message := range other.Fields {
+		e.Add(name, message)
+	}
+}
+
+// Err возвращает e, если есть хотя бы одна ошибка, иначе nil
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeResult отвечает {"result": ...}
+func writeResult(w http.ResponseWriter, result interface{}) {
+	writeJSON(w, http.StatusOK, APIResponse{Result: result})
+}
+
+// writeError отвечает {"error": ...} с кодом по типу ошибки
+func writeError(w http.ResponseWriter, err error) {
+	status, response := errorResponse(err)
+	writeJSON(w, status, response)
+}
+
+// errorResponse код и тело ответа для ошибки
+func errorResponse(err error) (int, APIResponse) {
+	var (
+		validationErr *ValidationError
+		conflictErr   *ConflictError
+		statusErr     *statusError
+		tooLargeErr   *http.MaxBytesError
+		quotaErr      *QuotaError
+	)
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, APIResponse{Error: "Invalid parameters", Details: validationErr}
+	case errors.Is(err, ErrNotFound):
+		return http.StatusServiceUnavailable, APIResponse{Error: "Event not found"}
+	case errors.Is(err, ErrNoEvents):
+		return http.StatusServiceUnavailable, APIResponse{Error: "No events found for the specified user and date"}
+	case errors.As(err, &conflictErr):
+		return http.StatusConflict, APIResponse{Error: conflictErr.Error(), Details: conflictErr}
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, APIResponse{Error: "Forbidden"}
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed, APIResponse{Error: "Event was modified"}
+	case errors.As(err, &quotaErr):
+		return http.StatusServiceUnavailable, APIResponse{Error: "Event quota exceeded", Details: quotaErr}
+	case errors.As(err, &tooLargeErr):
+		return http.StatusRequestEntityTooLarge, APIResponse{Error: "Request body too large"}
+	case errors.As(err, &statusErr):
+		return statusErr.status, APIResponse{Error: statusErr.message}
+	default:
+		slog.Error("request failed", "error", err)
+		return http.StatusInternalServerError, APIResponse{Error: "Internal error"}
+	}
+}
+
+// allowMethod проверяет метод запроса, на другой метод отвечает 405
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, APIResponse{Error: "Wrong method"})
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Оптимистичная блокировка событий. Ответы с одним событием содержат ETag с его версией:
+
+	ETag: "3"
+
+Запросы на изменение и удаление с заголовком If-Match: "3" выполняются, только если событие
+(для вхождения - серия) все еще в версии 3, иначе 412. If-Match: * и запрос без заголовка не проверяют версию.
+GET /event и GET /api/v2/users/{user_id}/events/{id} с If-None-Match текущей версии отвечают 304.
+*/
+
+// etag ETag версии события
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(w http.ResponseWriter, event Event) {
+	w.Header().Set("ETag", etag(event.Version))
+}
+
+// parseIfMatch возвращает версию из If-Match, 0 - если версию проверять не нужно.
+// Поддерживается один сильный ETag, слабый никогда не совпадает по RFC 9110
+func parseIfMatch(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+	if strings.HasPrefix(value, "W/") {
+		return 0, ErrVersionMismatch
+	}
+
+	unquoted, ok := strings.CutPrefix(value, `"`)
+	if ok {
+		unquoted, ok = strings.CutSuffix(unquoted, `"`)
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if !ok || err != nil || version < 1 {
+		return 0, invalid("If-Match", `expected a single entity tag like "3"`)
+	}
+	return version, nil
+}
+
+// notModified отвечает 304, если у клиента уже есть текущая версия события
+func notModified(w http.ResponseWriter, r *http.Request, event Event) bool {
+	tag := etag(event.Version)
+	for _, value := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == tag || value == "*" {
+			setETag(w, event)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// форматы начала и конца события: с явным смещением или местное время в зоне события
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+var errEndBeforeStart = errors.New("end must not be before start")
+
+// eventTiming параметры запроса, задающие время события.
+// Событие без start считается событием на весь день date, как в первой версии API
+type eventTiming struct {
+	Date     string
+	Start    string
+	End      string
+	Duration string
+	TimeZone string
+}
+
+// loadLocation загружает IANA зону, пустое имя означает UTC
+func loadLocation(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+func parseEventTime(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.In(loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DDTHH:MM", value)
+}
+
+// apply проверяет параметры и заполняет время события, ошибки возвращаются как *ValidationError
+func (t eventTiming) apply(event *Event) error {
+	loc, err := loadLocation(t.TimeZone)
+	if err != nil {
+		return invalid("time_zone", err.Error())
+	}
+	event.TimeZone = loc.String()
+
+	if t.Start == "" {
+		if t.Date == "" {
+			return invalid("date", "either date or start is required")
+		}
+		day, err := time.ParseInLocation(dateLayout, t.Date, loc)
+		if err != nil {
+			return invalid("date", fmt.Sprintf("invalid date %q, expected YYYY-MM-DD", t.Date))
+		}
+		event.AllDay = true
+		event.Date = t.Date
+		event.Start = day
+		event.End = day.AddDate(0, 0, 1)
+		return nil
+	}
+
+	start, err := parseEventTime(t.Start, loc)
+	if err != nil {
+		return invalid("start", err.Error())
+	}
+	end := start
+	switch {
+	case t.End != "":
+		if end, err = parseEventTime(t.End, loc); err != nil {
+			return invalid("end", err.Error())
+		}
+	case t.Duration != "":
+		duration, err := time.ParseDuration(t.Duration)
+		if err != nil || duration < 0 {
+			return invalid("duration", fmt.Sprintf("invalid duration %q", t.Duration))
+		}
+		end = start.Add(duration)
+	}
+	if end.Before(start) {
+		return invalid("end", errEndBeforeStart.Error())
+	}
+
+	event.AllDay = false
+	event.Date = start.Format(dateLayout)
+	event.Start = start
+	event.End = end
+	return nil
+}
+
+// fillLegacyTime дополняет событие, сохраненное до появления времени, до события на весь день
+func (e *Event) fillLegacyTime() {
+	if !e.Start.IsZero() {
+		return
+	}
+
+	day, err := time.Parse(dateLayout, e.Date)
+	if err != nil {
+		return
+	}
+	e.AllDay = true
+	e.TimeZone = time.UTC.String()
+	e.Start = day
+	e.End = day.AddDate(0, 0, 1)
+}
+
+// inWindow проверяет, пересекается ли событие с окном [from, to).
+// События на весь день привязаны к дате и попадают в окно по календарной дате в зоне окна
+func (e Event) inWindow(from, to time.Time) bool {
+	if e.AllDay {
+		return e.Date >= from.Format(dateLayout) && e.Date < to.Format(dateLayout)
+	}
+	if e.End.After(e.Start) {
+		return e.Start.Before(to) && e.End.After(from)
+	}
+	return !e.Start.Before(from) && e.Start.Before(to)
+}
+
+// startOfDay возвращает полночь даты data.Date в зоне вызывающего data.TimeZone
+func startOfDay(data Event) time.Time {
+	loc, err := loadLocation(data.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	day, _ := time.ParseInLocation(dateLayout, data.Date, loc)
+	return day
+}
+
+// sortEvents упорядочивает события по началу
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Start.Equal(events[j].Start) {
+			return events[i].Start.Before(events[j].Start)
+		}
+		return events[i].ID < events[j].ID
+	})
+}
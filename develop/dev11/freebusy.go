@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Пересечения событий и занятость пользователей.
+
+	POST /create_event ... &reject_conflicts=true   409 и ID пересекающихся событий вместо создания
+	GET  /freebusy?user_ids=1,2,3&from=&to=&tz=     объединенные интервалы занятости пользователей,
+	                                                from и to как в /events
+
+Занятым считается время событий с ненулевой длительностью, события на весь день время не занимают.
+*/
+
+// для новой повторяющейся серии пересечения ищутся на этом горизонте от ее начала
+const conflictHorizon = 366 * 24 * time.Hour
+
+// ConflictError событие пересекается с уже существующими событиями пользователя
+type ConflictError struct {
+	IDs []string `json:"conflicting_ids"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Event conflicts with %d existing event(s)", len(e.IDs))
+}
+
+// BusyInterval интервал занятости [Start, End)
+type BusyInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// busy проверяет, занимает ли событие время
+func (e Event) busy() bool {
+	return !e.AllDay && e.End.After(e.Start)
+}
+
+// conflicts возвращает ID событий пользователя, пересекающихся с event, вызывается под блокировкой.
+// События за все время вхождений выбираются из индекса один раз, каждое сверяется с первым вхождением,
+// которое заканчивается после его начала: у вхождений одна длительность, поэтому их концы упорядочены
+func (c *Calendar) conflicts(event Event) []string {
+	if !event.busy() {
+		return nil
+	}
+
+	occurrences := []Event{event}
+	if event.RRule != "" {
+		occurrences = event.expand(event.Start, event.Start.Add(conflictHorizon))
+	}
+	if len(occurrences) == 0 {
+		return nil
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	from, to := occurrences[0].Start, occurrences[len(occurrences)-1].End
+	for _, other := range c.eventsIn(event.UserID, from, to) {
+		if !other.busy() || other.ID == event.ID || seen[other.ID] {
+			continue
+		}
+		i := sort.Search(len(occurrences), func(i int) bool { return occurrences[i].End.After(other.Start) })
+		if i < len(occurrences) && occurrences[i].Start.Before(other.End) {
+			seen[other.ID] = true
+			ids = append(ids, other.ID)
+		}
+	}
+	return ids
+}
+
+// FreeBusy возвращает объединенные интервалы занятости пользователей в окне [from, to)
+func (c *Calendar) FreeBusy(userIDs []string, from, to time.Time) []BusyInterval {
+	var intervals []BusyInterval
+
+	c.RLock()
+	for _, userID := range userIDs {
+		for _, event := range c.eventsIn(userID, from, to) {
+			if !event.busy() {
+				continue
+			}
+			intervals = append(intervals, BusyInterval{
+				Start: maxTime(event.Start, from).UTC(),
+				End:   minTime(event.End, to).UTC(),
+			})
+		}
+	}
+	c.RUnlock()
+
+	return mergeIntervals(intervals)
+}
+
+// mergeIntervals объединяет пересекающиеся и смежные интервалы
+func mergeIntervals(intervals []BusyInterval) []BusyInterval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+
+	merged := []BusyInterval{}
+	for _, interval := range intervals {
+		last := len(merged) - 1
+		if last >= 0 && !interval.Start.After(merged[last].End) {
+			merged[last].End = maxTime(merged[last].End, interval.End)
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// parseUserIDs парсит список user_ids через запятую
+func parseUserIDs(value string) ([]string, error) {
+	var userIDs []string
+	for _, userID := range strings.Split(value, ",") {
+		userID = strings.TrimSpace(userID)
+		if _, err := strconv.Atoi(userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+func freeBusyHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	userIDs, err := parseUserIDs(query.Get("user_ids"))
+	if err != nil {
+		writeError(w, invalid("user_ids", "must be a comma separated list of integers"))
+		return
+	}
+	from, to, err := parseRange(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeResult(w, calendarFrom(r.Context()).FreeBusy(userIDs, from, to))
+}
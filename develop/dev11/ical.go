@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Импорт и экспорт событий в формате iCalendar (RFC 5545).
+
+	GET  /export.ics?user_id=  VCALENDAR со всеми событиями пользователя
+	POST /import?user_id=      .ics файл в поле file формы multipart/form-data или в теле запроса
+
+Импорт идемпотентен: VEVENT с уже известным UID (и RECURRENCE-ID) заменяет событие, а не создает новое.
+Ошибки отдельных VEVENT возвращаются списком, остальные события при этом импортируются.
+Время с TZID выгружается с IANA именем зоны без VTIMEZONE, такие файлы понимают распространенные клиенты.
+*/
+
+const (
+	icalDateLayout     = "20060102"
+	icalTimeLayout     = "20060102T150405"
+	icalUTCTimeLayout  = "20060102T150405Z"
+	icalMaxLineOctets  = 75
+	maxImportFileBytes = 10 << 20
+)
+
+// результат импорта
+type importResult struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Errors  []importError `json:"errors,omitempty"`
+}
+
+// ошибка разбора или сохранения одного VEVENT
+type importError struct {
+	Index int    `json:"index"`
+	UID   string `json:"uid,omitempty"`
+	Error string `json:"error"`
+}
+
+// uid идентификатор события в iCalendar, для созданных через API событий это их ID
+func (e Event) uid() string {
+	if e.UID != "" {
+		return e.UID
+	}
+	return e.ID
+}
+
+// UserEvents возвращает все сохраненные события пользователя без разворачивания серий
+func (c *Calendar) UserEvents(userID string) []Event {
+	var result []Event
+
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, events := range c.Events {
+		for _, event := range events {
+			if event.UserID == userID {
+				result = append(result, event)
+			}
+		}
+	}
+
+	sortEvents(result)
+	return result
+}
+
+// findByUID ищет событие пользователя по UID и RecurrenceID, вызывается под блокировкой
+func (c *Calendar) findByUID(userID, uid, recurrenceID string) (Event, bool) {
+	for _, events := range c.Events {
+		for _, event := range events {
+			if event.UserID == userID && event.uid() == uid && event.RecurrenceID == recurrenceID {
+				return event, true
+			}
+		}
+	}
+	return Event{}, false
+}
+
+// ImportEvent создает событие или заменяет событие пользователя с тем же UID и RecurrenceID.
+// Измененное вхождение привязывается к серии с тем же UID, дата вхождения исключается из серии.
+// Участники и общий календарь, которых нет в iCalendar, берутся из заменяемого события или серии
+func (c *Calendar) ImportEvent(ctx context.Context, data Event) (Event, bool, error) {
+	if err := data.validate(); err != nil {
+		return Event{}, false, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
+
+	current, found := c.findByUID(data.UserID, data.UID, data.RecurrenceID)
+	var series Event
+	if data.RecurrenceID != "" {
+		var ok bool
+		series, ok = c.findByUID(data.UserID, data.UID, "")
+		if !ok || series.RRule == "" {
+			return Event{}, false, fmt.Errorf("recurring event %s for RECURRENCE-ID not found", data.UID)
+		}
+		data.SeriesID = series.ID
+		data.CalendarID = series.CalendarID
+		if !found {
+			current = series
+		}
+	}
+
+	if data.CalendarID == "" {
+		data.CalendarID = current.CalendarID
+	} else if data.CalendarID != current.CalendarID {
+		if err := c.checkCalendar(data.CalendarID, data.UserID); err != nil {
+			return Event{}, false, err
+		}
+	}
+	if data.Attendees == nil {
+		data.Attendees = current.Attendees
+	}
+	data.Attendees = mergeAttendees(data.UserID, data.Attendees, current.Attendees)
+
+	if found {
+		data.ID = current.ID
+		data.UID = current.UID
+	} else {
+		id, err := c.newID()
+		if err != nil {
+			return Event{}, false, err
+		}
+		data.ID = id
+	}
+
+	// сначала сохраняем вхождение, как в updateOccurrence, чтобы при сбое серия не осталась с исключенной датой без вхождения
+	if err := c.save(&data); err != nil {
+		return Event{}, false, err
+	}
+	if data.RecurrenceID != "" && !containsString(series.ExDates, data.RecurrenceID) {
+		series.ExDates = append(append([]string(nil), series.ExDates...), data.RecurrenceID)
+		if err := c.save(&series); err != nil {
+			return Event{}, false, err
+		}
+	}
+	return data, !found, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// icalEscaper экранирует текстовые значения свойств
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+// icalUnescaper снимает экранирование текстовых значений свойств
+var icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// writeICalLine записывает строку свойства, перенося ее по 75 октетов без разрыва UTF-8 символов
+func writeICalLine(w io.Writer, line string) {
+	for len(line) > icalMaxLineOctets {
+		cut := icalMaxLineOctets
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		fmt.Fprintf(w, "%s\r\n ", line[:cut])
+		line = line[cut:]
+	}
+	fmt.Fprintf(w, "%s\r\n", line)
+}
+
+// icalTimeProp форматирует свойство со временем события: дата, UTC или местное время с TZID
+func icalTimeProp(name string, t time.Time, event Event) string {
+	if event.AllDay {
+		return name + ";VALUE=DATE:" + t.Format(icalDateLayout)
+	}
+	loc, err := loadLocation(event.TimeZone)
+	if err != nil || loc == time.UTC {
+		return name + ":" + t.UTC().Format(icalUTCTimeLayout)
+	}
+	return name + ";TZID=" + loc.String() + ":" + t.In(loc).Format(icalTimeLayout)
+}
+
+// occurrenceStart время начала вхождения серии в дату date по исходному расписанию
+func (e Event) occurrenceStart(date string) time.Time {
+	loc, err := loadLocation(e.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	day, _ := time.ParseInLocation(dateLayout, date, loc)
+	return e.occurrenceAt(day, loc).Start
+}
+
+// writeICalendar сериализует события в VCALENDAR
+func writeICalendar(w io.Writer, events []Event, now time.Time) {
+	writeICalLine(w, "BEGIN:VCALENDAR")
+	writeICalLine(w, "VERSION:2.0")
+	writeICalLine(w, "PRODID:-//wb-tech-level-2//dev11 calendar//EN")
+
+	// даты измененных вхождений выгружаются через RECURRENCE-ID, а не EXDATE серии
+	series := make(map[string]Event)
+	overridden := make(map[string]bool)
+	for _, event := range events {
+		if event.RRule != "" {
+			series[event.ID] = event
+		}
+		if event.SeriesID != "" {
+			overridden[event.SeriesID+"/"+event.RecurrenceID] = true
+		}
+	}
+
+	for _, event := range events {
+		writeICalLine(w, "BEGIN:VEVENT")
+		if parent, ok := series[event.SeriesID]; ok {
+			writeICalLine(w, "UID:"+icalEscaper.Replace(parent.uid()))
+			writeICalLine(w, icalTimeProp("RECURRENCE-ID", parent.occurrenceStart(event.RecurrenceID), parent))
+		} else {
+			writeICalLine(w, "UID:"+icalEscaper.Replace(event.uid()))
+		}
+		writeICalLine(w, "DTSTAMP:"+now.UTC().Format(icalUTCTimeLayout))
+		writeICalLine(w, icalTimeProp("DTSTART", event.Start, event))
+		writeICalLine(w, icalTimeProp("DTEND", event.End, event))
+		writeICalLine(w, "SUMMARY:"+icalEscaper.Replace(event.Description))
+		if event.RRule != "" {
+			writeICalLine(w, "RRULE:"+event.RRule)
+		}
+		for _, date := range event.ExDates {
+			if overridden[event.ID+"/"+date] {
+				continue
+			}
+			writeICalLine(w, icalTimeProp("EXDATE", event.occurrenceStart(date), event))
+		}
+		writeICalLine(w, "END:VEVENT")
+	}
+
+	writeICalLine(w, "END:VCALENDAR")
+}
+
+// свойство iCalendar: имя, параметры и значение
+type icalProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// parseICalLine разбирает строку свойства NAME;PARAM=VALUE:VALUE
+func parseICalLine(line string) (icalProp, error) {
+	prop := icalProp{Params: make(map[string]string)}
+
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		}
+		if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("invalid content line %q", line)
+	}
+
+	prop.Value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+// readICalendar разворачивает перенесенные строки и группирует свойства по VEVENT.
+// Свойства вложенных в VEVENT компонентов (VALARM) пропускаются
+func readICalendar(r io.Reader) ([][]icalProp, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportFileBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("not an iCalendar file")
+	}
+
+	var events [][]icalProp
+	var current []icalProp
+	depth := 0
+	for _, line := range lines {
+		prop, err := parseICalLine(line)
+		if err != nil {
+			if depth > 0 {
+				current = append(current, icalProp{Name: "X-INVALID", Value: err.Error()})
+			}
+			continue
+		}
+
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") && depth == 0:
+			depth = 1
+			current = nil
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT") && depth == 1:
+			depth = 0
+			events = append(events, current)
+		case prop.Name == "BEGIN" && depth > 0:
+			depth++
+		case prop.Name == "END" && depth > 1:
+			depth--
+		case depth == 1:
+			current = append(current, prop)
+		}
+	}
+	return events, nil
+}
+
+// parseICalValue разбирает значение DATE или DATE-TIME с учетом TZID.
+// Возвращает время и признак того, что это дата без времени
+func parseICalValue(prop icalProp) (time.Time, bool, error) {
+	value := prop.Value
+	if prop.Params["VALUE"] == "DATE" || len(value) == len(icalDateLayout) {
+		t, err := time.Parse(icalDateLayout, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid %s value %q", prop.Name, value)
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icalUTCTimeLayout, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid %s value %q", prop.Name, value)
+		}
+		return t, false, nil
+	}
+
+	loc := time.UTC
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		var err error
+		if loc, err = loadLocation(tzid); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	t, err := time.ParseInLocation(icalTimeLayout, value, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s value %q", prop.Name, value)
+	}
+	return t, false, nil
+}
+
+var icalDurationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICalDuration разбирает DURATION, например PT1H30M или P1D
+func parseICalDuration(value string) (time.Duration, error) {
+	match := icalDurationRe.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("invalid DURATION value %q", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(match[i+2])
+		duration += time.Duration(n) * unit
+	}
+	if match[1] == "-" {
+		duration = -duration
+	}
+	return duration, nil
+}
+
+// icalLocalDate дата значения DATE или DATE-TIME в зоне события
+func icalLocalDate(prop icalProp, loc *time.Location) (string, error) {
+	t, isDate, err := parseICalValue(prop)
+	if err != nil {
+		return "", err
+	}
+	if isDate {
+		return t.Format(dateLayout), nil
+	}
+	return t.In(loc).Format(dateLayout), nil
+}
+
+// veventToEvent собирает событие пользователя userID из свойств VEVENT
+func veventToEvent(props []icalProp, userID string) (Event, error) {
+	event := Event{UserID: userID}
+
+	var start, end, recurrenceID *icalProp
+	var duration string
+	var summary, description string
+	var exdates []icalProp
+	for i := range props {
+		prop := props[i]
+		switch prop.Name {
+		case "X-INVALID":
+			return event, fmt.Errorf("%s", prop.Value)
+		case "UID":
+			event.UID = icalUnescaper.Replace(prop.Value)
+		case "DTSTART":
+			start = &props[i]
+		case "DTEND":
+			end = &props[i]
+		case "DURATION":
+			duration = prop.Value
+		case "SUMMARY":
+			summary = icalUnescaper.Replace(prop.Value)
+		case "DESCRIPTION":
+			description = icalUnescaper.Replace(prop.Value)
+		case "RRULE":
+			event.RRule = prop.Value
+		case "EXDATE":
+			exdates = append(exdates, prop)
+		case "RECURRENCE-ID":
+			recurrenceID = &props[i]
+		}
+	}
+
+	if event.UID == "" {
+		return event, fmt.Errorf("missing UID")
+	}
+	if start == nil {
+		return event, fmt.Errorf("missing DTSTART")
+	}
+	event.Description = summary
+	if event.Description == "" {
+		event.Description = description
+	}
+
+	startTime, allDay, err := parseICalValue(*start)
+	if err != nil {
+		return event, err
+	}
+	endTime := startTime
+	switch {
+	case end != nil:
+		if endTime, _, err = parseICalValue(*end); err != nil {
+			return event, err
+		}
+	case duration != "":
+		d, err := parseICalDuration(duration)
+		if err != nil {
+			return event, err
+		}
+		endTime = startTime.Add(d)
+	case allDay:
+		endTime = startTime.AddDate(0, 0, 1)
+	}
+	if endTime.Before(startTime) {
+		return event, errEndBeforeStart
+	}
+
+	event.TimeZone = startTime.Location().String()
+	event.Date = startTime.Format(dateLayout)
+	event.Start = startTime
+	event.End = endTime
+	// многодневные события на весь день храним как событие со временем от полуночи до полуночи
+	event.AllDay = allDay && !endTime.After(startTime.AddDate(0, 0, 1))
+
+	for _, prop := range exdates {
+		for _, value := range strings.Split(prop.Value, ",") {
+			prop.Value = value
+			exdate, err := icalLocalDate(prop, startTime.Location())
+			if err != nil {
+				return event, err
+			}
+			event.ExDates = append(event.ExDates, exdate)
+		}
+	}
+	if recurrenceID != nil {
+		if event.RecurrenceID, err = icalLocalDate(*recurrenceID, startTime.Location()); err != nil {
+			return event, err
+		}
+	}
+
+	if err = validateRecurrence(&event); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+// importICalendar сохраняет события из .ics. Серии импортируются раньше измененных вхождений,
+// чтобы вхождение нашло свою серию независимо от порядка в файле
+func importICalendar(ctx context.Context, calendar *Calendar, r io.Reader, userID string) (importResult, error) {
+	vevents, err := readICalendar(r)
+	if err != nil {
+		return importResult{}, err
+	}
+
+	order := make([]int, len(vevents))
+	for i := range order {
+		order[i] = i
+	}
+	hasRecurrenceID := func(props []icalProp) bool {
+		for _, prop := range props {
+			if prop.Name == "RECURRENCE-ID" {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return !hasRecurrenceID(vevents[order[i]]) && hasRecurrenceID(vevents[order[j]])
+	})
+
+	var result importResult
+	for _, index := range order {
+		event, err := veventToEvent(vevents[index], userID)
+		if err == nil {
+			var created bool
+			if _, created, err = calendar.ImportEvent(ctx, event); err == nil {
+				if created {
+					result.Created++
+				} else {
+					result.Updated++
+				}
+				continue
+			}
+		}
+		result.Errors = append(result.Errors, importError{Index: index, UID: event.UID, Error: err.Error()})
+	}
+
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Index < result.Errors[j].Index })
+	return result, nil
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if _, err := strconv.Atoi(userID); err != nil {
+		writeError(w, invalid("user_id", "must be an integer"))
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	w.WriteHeader(http.StatusOK)
+	writeICalendar(w, calendarFrom(r.Context()).UserEvents(userID), time.Now())
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var file io.Reader = r.Body
+	userID := r.URL.Query().Get("user_id")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		upload, _, err := r.FormFile("file")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, err)
+			return
+		}
+		if err != nil {
+			writeError(w, invalid("file", "multipart field file is required"))
+			return
+		}
+		defer upload.Close()
+		file = upload
+		userID = r.FormValue("user_id")
+	}
+
+	if _, err := strconv.Atoi(userID); err != nil {
+		writeError(w, invalid("user_id", "must be an integer"))
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	result, err := importICalendar(r.Context(), calendarFrom(r.Context()), file, userID)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, err)
+		return
+	}
+	if err != nil {
+		writeError(w, invalid("file", err.Error()))
+		return
+	}
+
+	writeResult(w, result)
+}
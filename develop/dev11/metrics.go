@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Метрики в текстовом формате Prometheus: GET /metrics.
+
+	http_requests_total{tenant, route, method, status}   счетчик запросов
+	http_request_duration_seconds{tenant, route}         гистограмма времени обработки
+
+route - шаблон маршрута из newRouter, а не путь запроса, чтобы число рядов не зависело от ID в путях.
+По той же причине method - стандартный метод HTTP или OTHER: старые маршруты принимают любой метод до allowMethod.
+tenant - арендатор запроса, пустой у запросов, отклоненных до его выбора. Квоты арендаторов - в tenant.go.
+*/
+
+// границы корзин гистограммы времени обработки в секундах
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	Tenant string
+	Route  string
+	Method string
+	Status int
+}
+
+type latencyKey struct {
+	Tenant string
+	Route  string
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] - наблюдения не больше latencyBuckets[i]
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Metrics счетчики и гистограммы запросов
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[latencyKey]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[latencyKey]*histogram),
+	}
+}
+
+// Observe учитывает обработанный запрос арендатора tenant
+func (m *Metrics) Observe(tenant, route, method string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{Tenant: tenant, Route: route, Method: method, Status: status}]++
+	key := latencyKey{Tenant: tenant, Route: route}
+	h, ok := m.latency[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[key] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// WritePrometheus пишет метрики в текстовом формате Prometheus, only - только ряды этого арендатора
+func (m *Metrics) WritePrometheus(w io.Writer, only string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		if only == "" || key.Tenant == only {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+
+	fmt.Fprintln(w, "# HELP http_requests_total Total number of HTTP requests.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "http_requests_total{tenant=%s,route=%s,method=%s,status=\"%d\"} %d\n",
+			labelValue(key.Tenant), labelValue(key.Route), labelValue(key.Method), key.Status, m.requests[key])
+	}
+
+	series := make([]latencyKey, 0, len(m.latency))
+	for key := range m.latency {
+		if only == "" || key.Tenant == only {
+			series = append(series, key)
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Tenant != series[j].Tenant {
+			return series[i].Tenant < series[j].Tenant
+		}
+		return series[i].Route < series[j].Route
+	})
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request latency.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, key := range series {
+		h := m.latency[key]
+		labels := "tenant=" + labelValue(key.Tenant) + ",route=" + labelValue(key.Route)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+// labelValue экранирует значение метки
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+var metrics = NewMetrics()
+
+// observe учитывает запросы маршрута route в metrics
+func observe(route string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			rec := recorderFor(w)
+			started := time.Now()
+			next(rec, r)
+			metrics.Observe(rec.tenant, route, methodLabel(r.Method), rec.Status(), time.Since(started))
+		}
+	}
+}
+
+// methodLabel значение метки method: нестандартные методы клиентов сводятся в OTHER
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	// при включенной аутентификации метрики видит только администратор
+	if !allowed(r, "") {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	// администратор арендатора видит только его ряды, общий ограничитель клиентов - нет
+	var only string
+	if principal, ok := principalFrom(r.Context()); ok {
+		only = principal.Tenant
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	metrics.WritePrometheus(w, only)
+	tenants.WritePrometheus(w, only)
+	if only == "" {
+		limiter.WritePrometheus(w)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+/*
+Цепочка middleware, через которую проходит каждый запрос:
+
+	requestID -> logger -> observe(route) -> limitIP -> authenticate -> selectTenant -> rateLimit -> limitBody(route) -> обработчик
+
+requestID берет X-Request-ID из запроса или создает новый и возвращает его в ответе.
+logger пишет строку access-лога в JSON через log/slog, observe считает метрики маршрута для /metrics.
+limitIP ограничивает частоту запросов с одного адреса еще до проверки ключа или токена.
+selectTenant выбирает арендатора запроса, см. tenant.go.
+rateLimit и limitBody ограничивают частоту запросов клиента и арендатора и размер тела, см. ratelimit.go.
+*/
+
+const maxRequestIDLength = 128
+
+// middleware оборачивает обработчик
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain оборачивает handler в middlewares, первый из них оказывается внешним
+func chain(handler http.HandlerFunc, middlewares ...middleware) http.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// route регистрирует обработчик маршрута pattern со стандартной цепочкой middleware
+func route(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, chain(handler, requestID, logger, observe(pattern), limitIP, authenticate, selectTenant, rateLimit, limitBody(pattern)))
+}
+
+// statusRecorder запоминает код ответа, количество записанных байт и арендатора, которого выбрал selectTenant
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	tenant string
+}
+
+// recorderFor возвращает w, если он уже statusRecorder, иначе оборачивает его
+func recorderFor(w http.ResponseWriter) *statusRecorder {
+	if rec, ok := w.(*statusRecorder); ok {
+		return rec
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// Status код ответа, 200 если обработчик ничего не записал
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap нужен http.ResponseController, чтобы добраться до исходного ResponseWriter
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom возвращает идентификатор запроса, назначенный requestID
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID принимает только короткие идентификаторы из видимых ASCII символов, чтобы их можно было писать в лог
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID назначает запросу X-Request-ID
+func requestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			if id, err = newEventID(); err != nil {
+				writeJSON(w, http.StatusInternalServerError, APIResponse{Error: "Internal error"})
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// logger пишет в лог запрос, код и размер ответа и время обработки
+func logger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := recorderFor(w)
+		started := time.Now()
+		next(rec, r)
+
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", requestIDFrom(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("uri", r.RequestURI),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("tenant", rec.tenant),
+			slog.Int("status", rec.Status()),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(started)),
+		)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+/*
+Описание API в формате OpenAPI 3: GET /openapi.json. Документ доступен без аутентификации.
+Клиент на Go для этого API - пакет wb-tech-level-2/develop/dev11/client.
+*/
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Периоды для /events_for_day, /events_for_week, /events_for_month и GET /api/v2/users/{user_id}/events.
+
+Период включает все свои дни целиком: окно запроса [полночь первого дня, полночь дня после последнего)
+в зоне tz, поэтому события первого и последнего дня попадают в выдачу, а границы не зависят от перехода
+на летнее время.
+
+Неделя начинается с дня week_start из конфига (по умолчанию понедельник), запрос может переопределить его
+параметром week_start=sunday. Вместо date можно передать неделю ISO 8601: week=2026-W42 - она всегда
+начинается с понедельника, первая неделя года содержит 4 января.
+
+Как и раньше, на пустой период /events_for_* отвечают ошибкой бизнес-логики ErrNoEvents (503),
+API второй версии и JSON-RPC - пустым списком.
+*/
+
+const (
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+)
+
+// PeriodQuery запрос событий пользователя за день, неделю или месяц, в который входит Day
+type PeriodQuery struct {
+	UserID    string
+	Period    string
+	Day       time.Time // полночь дня в зоне запроса
+	WeekStart time.Weekday
+}
+
+// Range окно периода [from, to)
+func (q PeriodQuery) Range() (time.Time, time.Time) {
+	year, month, day := q.Day.Date()
+	loc := q.Day.Location()
+
+	switch q.Period {
+	case periodWeek:
+		offset := (int(q.Day.Weekday()) - int(q.WeekStart) + 7) % 7
+		from := time.Date(year, month, day-offset, 0, 0, 0, 0, loc)
+		return from, time.Date(year, month, day-offset+7, 0, 0, 0, 0, loc)
+	case periodMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+	}
+}
+
+// EventsFor возвращает события и вхождения серий за период
+func (c *Calendar) EventsFor(q PeriodQuery) []Event {
+	from, to := q.Range()
+	return c.eventsBetween(q.UserID, from, to)
+}
+
+// WeekStart первый день недели для запросов без week_start
+func (c *Calendar) WeekStart() time.Weekday {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.weekStart
+}
+
+// SetWeekStart меняет первый день недели
+func (c *Calendar) SetWeekStart(day time.Weekday) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.weekStart = day
+}
+
+// parseWeekday парсит название дня недели на английском: monday, sunday, ...
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
+
+// parseISOWeek возвращает полночь понедельника недели ISO 8601 вида 2026-W42 в зоне loc
+func parseISOWeek(value string, loc *time.Location) (time.Time, error) {
+	yearPart, weekPart, ok := strings.Cut(value, "-W")
+	year, yearErr := strconv.Atoi(yearPart)
+	week, weekErr := strconv.Atoi(weekPart)
+	if !ok || len(yearPart) != 4 || len(weekPart) != 2 || yearErr != nil || weekErr != nil {
+		return time.Time{}, fmt.Errorf("invalid week %q, expected YYYY-Www", value)
+	}
+
+	// 28 декабря всегда в последней неделе своего года
+	if _, weeks := time.Date(year, time.December, 28, 0, 0, 0, 0, time.UTC).ISOWeek(); week < 1 || week > weeks {
+		return time.Time{}, fmt.Errorf("week must be between 1 and %d in %d", weeks, year)
+	}
+
+	// 4 января всегда в первой неделе года
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, loc)
+	offset := (int(jan4.Weekday()) + 6) % 7
+	return time.Date(year, time.January, 4-offset+(week-1)*7, 0, 0, 0, 0, loc), nil
+}
+
+// parsePeriodParams парсит параметры tz, date или week и week_start запроса за период.
+// weekStart - первый день недели, если запрос его не задает
+func parsePeriodParams(query url.Values, period string, weekStart time.Weekday) (PeriodQuery, error) {
+	q := PeriodQuery{Period: period, WeekStart: weekStart}
+
+	loc, err := loadLocation(query.Get("tz"))
+	if err != nil {
+		return q, invalid("tz", err.Error())
+	}
+
+	verr := &ValidationError{}
+	date, week := query.Get("date"), query.Get("week")
+	switch {
+	case week != "" && period != periodWeek:
+		verr.Add("week", "is supported only for weekly periods")
+	case week != "" && date != "":
+		verr.Add("week", "date and week are mutually exclusive")
+	case week != "":
+		if q.Day, err = parseISOWeek(week, loc); err != nil {
+			verr.Add("week", err.Error())
+		}
+		q.WeekStart = time.Monday
+	default:
+		if q.Day, err = time.ParseInLocation(dateLayout, date, loc); err != nil {
+			verr.Add("date", "expected YYYY-MM-DD")
+		}
+	}
+
+	if name := query.Get("week_start"); name != "" {
+		if week != "" {
+			verr.Add("week_start", "ISO weeks always start on Monday")
+		} else if q.WeekStart, err = parseWeekday(name); err != nil {
+			verr.Add("week_start", err.Error())
+		}
+	}
+	return q, verr.Err()
+}
+
+// periodHandler обработчик запроса событий за период, в который входит дата из параметров
+func periodHandler(period string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		calendar := calendarFrom(r.Context())
+		query := r.URL.Query()
+		verr := &ValidationError{}
+		userID := query.Get("user_id")
+		if _, err := strconv.Atoi(userID); err != nil {
+			verr.Add("user_id", "must be an integer")
+		}
+		q, err := parsePeriodParams(query, period, calendar.WeekStart())
+		if err != nil {
+			verr.Merge("date", err)
+		}
+		if err = verr.Err(); err != nil {
+			writeError(w, err)
+			return
+		}
+		if !allowed(r, userID) {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		q.UserID = userID
+		events := calendar.EventsFor(q)
+		if len(events) == 0 {
+			writeError(w, ErrNoEvents)
+			return
+		}
+		writeResult(w, events)
+	}
+}
+
+var (
+	eventsForDayHandler   = periodHandler(periodDay)
+	eventsForWeekHandler  = periodHandler(periodWeek)
+	eventsForMonthHandler = periodHandler(periodMonth)
+)
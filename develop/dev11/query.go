@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Запрос событий за произвольный диапазон с постраничной выдачей.
+
+	GET /events?user_id=&from=&to=&tz=&limit=&cursor=&order=asc|desc
+
+from и to - даты YYYY-MM-DD (to включительно) или время в формате RFC 3339 (to не включается),
+диапазон не длиннее 366 дней.
+Ответ: {"result": {"events": [...], "next_cursor": "..."}}, next_cursor пустой на последней странице.
+*/
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+
+	// ограничивает число вхождений, в которые разворачиваются серии за один запрос
+	maxRangeSpan = 366 * 24 * time.Hour
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// EventQuery параметры запроса событий за диапазон [From, To)
+type EventQuery struct {
+	UserID string
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Cursor string
+	Desc   bool
+}
+
+// EventPage страница результатов запроса
+type EventPage struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// позиция в упорядоченной выдаче: начало и ID последнего отданного события
+type cursorKey struct {
+	Start time.Time
+	ID    string
+}
+
+func (k cursorKey) encode() string {
+	raw := fmt.Sprintf("%d/%s", k.Start.UnixNano(), k.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (cursorKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return cursorKey{}, errInvalidCursor
+	}
+
+	nanos, id, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return cursorKey{}, errInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return cursorKey{}, errInvalidCursor
+	}
+	return cursorKey{Start: time.Unix(0, n), ID: id}, nil
+}
+
+// compare сравнивает событие с позицией курсора в порядке возрастания
+func (k cursorKey) compare(event Event) int {
+	if c := event.Start.Compare(k.Start); c != 0 {
+		return c
+	}
+	return strings.Compare(event.ID, k.ID)
+}
+
+// QueryEvents возвращает страницу событий пользователя за диапазон, начиная с позиции после курсора
+func (c *Calendar) QueryEvents(q EventQuery) (EventPage, error) {
+	if q.Limit <= 0 || q.Limit > maxPageLimit {
+		q.Limit = defaultPageLimit
+	}
+
+	var after *cursorKey
+	if q.Cursor != "" {
+		key, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return EventPage{}, invalid("cursor", err.Error())
+		}
+		after = &key
+	}
+
+	events := c.eventsBetween(q.UserID, q.From, q.To)
+	if q.Desc {
+		slices.Reverse(events)
+	}
+
+	page := EventPage{Events: []Event{}}
+	for _, event := range events {
+		if after != nil {
+			cmp := after.compare(event)
+			if (!q.Desc && cmp <= 0) || (q.Desc && cmp >= 0) {
+				continue
+			}
+		}
+
+		if len(page.Events) == q.Limit {
+			last := page.Events[len(page.Events)-1]
+			page.NextCursor = cursorKey{Start: last.Start, ID: last.ID}.encode()
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+
+	return page, nil
+}
+
+// parseRangeBound разбирает границу диапазона: дату в зоне loc или время RFC 3339.
+// Дата в to означает конец этого дня
+func parseRangeBound(value string, loc *time.Location, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	day, err := time.ParseInLocation(dateLayout, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		return day.AddDate(0, 0, 1), nil
+	}
+	return day, nil
+}
+
+// parseRange парсит параметры tz, from и to общего вида для запросов за диапазон
+func parseRange(query url.Values) (time.Time, time.Time, error) {
+	loc, err := loadLocation(query.Get("tz"))
+	if err != nil {
+		return time.Time{}, time.Time{}, invalid("tz", err.Error())
+	}
+
+	verr := &ValidationError{}
+	from, err := parseRangeBound(query.Get("from"), loc, false)
+	if err != nil {
+		verr.Add("from", "expected YYYY-MM-DD or RFC 3339 time")
+	}
+	to, err := parseRangeBound(query.Get("to"), loc, true)
+	if err != nil {
+		verr.Add("to", "expected YYYY-MM-DD or RFC 3339 time")
+	}
+	switch {
+	case len(verr.Fields) > 0:
+	case !from.Before(to):
+		verr.Add("to", "must be after from")
+	case to.Sub(from) > maxRangeSpan:
+		verr.Add("to", "range must not exceed 366 days")
+	}
+	return from, to, verr.Err()
+}
+
+// parseEventQuery парсит параметры /events
+func parseEventQuery(r *http.Request) (*EventQuery, error) {
+	query := r.URL.Query()
+
+	verr := &ValidationError{}
+	userID := query.Get("user_id")
+	if _, err := strconv.Atoi(userID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+
+	from, to, err := parseRange(query)
+	if err != nil {
+		verr.Merge("range", err)
+	}
+
+	q := &EventQuery{UserID: userID, From: from, To: to, Cursor: query.Get("cursor")}
+	if limit := query.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			verr.Add("limit", fmt.Sprintf("must be between 1 and %d", maxPageLimit))
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		verr.Add("order", "must be asc or desc")
+	}
+
+	if err = verr.Err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func eventsRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q, err := parseEventQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, q.UserID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	page, err := calendarFrom(r.Context()).QueryEvents(*q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeResult(w, page)
+}
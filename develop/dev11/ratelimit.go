@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Ограничения на запросы.
+
+Частота: у каждого клиента своя корзина токенов (token bucket) на rate_burst запросов, которая
+пополняется на rate_limit токенов в секунду. Клиент - пользователь из аутентификации, без нее - IP адрес,
+у разных арендаторов корзины одного пользователя разные. После клиента запрос проверяет корзина арендатора
+с его собственными rate_limit и rate_burst из tenants, см. tenant.go.
+Запрос без токена получает 429 и Retry-After с числом секунд до появления следующего токена.
+rate_limit: 0 отключает ограничение.
+
+До аутентификации запрос проверяет корзина его IP адреса на ip_rate_burst запросов с пополнением
+ip_rate_limit в секунду, чтобы перебор API ключей и токенов тоже упирался в лимит.
+Метод auth в JSON-RPC списывает токен из той же корзины.
+
+Размер тела: тело запроса читается не больше max_body_bytes, импорт календаря и пакет операций - не больше
+maxImportFileBytes, поток операций NDJSON - без ограничения.
+Запрос с телом больше лимита получает 413.
+
+Состояние ограничителя отдается в /metrics:
+
+	rate_limit_requests_total{result="allowed"|"limited"}   счетчик решений
+	rate_limit_buckets                                      число клиентов с корзиной
+	rate_limit_exhausted_buckets                            клиенты, у которых сейчас нет токенов
+	rate_limit_refill_per_second, rate_limit_burst          настройки
+*/
+
+// с этим интервалом удаляются полные корзины: они ничем не отличаются от новых
+const bucketSweepInterval = 10 * time.Minute
+
+// лимиты тела для маршрутов, которым нужно больше max_body_bytes, 0 - без лимита
+var bodyLimits = map[string]int64{
+	"/import":              maxImportFileBytes,
+	"/events/batch":        maxImportFileBytes,
+	"/events/batch/stream": 0,
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter ограничитель частоты запросов по алгоритму token bucket
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	allowed   uint64
+	limited   uint64
+	lastSweep time.Time
+}
+
+// NewRateLimiter создает ограничитель на burst запросов с пополнением rate запросов в секунду.
+// При rate <= 0 возвращает nil, ограничение отключено
+func NewRateLimiter(rate float64, burst int, clock Clock) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		clock:     clock,
+		buckets:   make(map[string]*bucket),
+		lastSweep: clock.Now(),
+	}
+}
+
+// refill пополняет корзину за время, прошедшее с прошлого обращения
+func (l *RateLimiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.updated = now
+	}
+}
+
+// Allow забирает токен клиента key. Если токена нет, возвращает false и время до его появления
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed++
+		return true, 0
+	}
+	l.limited++
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep удаляет корзины клиентов, которые давно не обращались, вызывается под l.mu
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Counts число пропущенных и отклоненных запросов
+func (l *RateLimiter) Counts() (allowed, limited uint64) {
+	if l == nil {
+		return 0, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.allowed, l.limited
+}
+
+// WritePrometheus пишет состояние ограничителя в текстовом формате Prometheus
+func (l *RateLimiter) WritePrometheus(w io.Writer) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	exhausted := 0
+	for _, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens < 1 {
+			exhausted++
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP rate_limit_requests_total Rate limiter decisions.")
+	fmt.Fprintln(w, "# TYPE rate_limit_requests_total counter")
+	fmt.Fprintf(w, "rate_limit_requests_total{result=\"allowed\"} %d\n", l.allowed)
+	fmt.Fprintf(w, "rate_limit_requests_total{result=\"limited\"} %d\n", l.limited)
+	fmt.Fprintln(w, "# HELP rate_limit_buckets Clients tracked by the rate limiter.")
+	fmt.Fprintln(w, "# TYPE rate_limit_buckets gauge")
+	fmt.Fprintf(w, "rate_limit_buckets %d\n", len(l.buckets))
+	fmt.Fprintln(w, "# HELP rate_limit_exhausted_buckets Clients currently out of tokens.")
+	fmt.Fprintln(w, "# TYPE rate_limit_exhausted_buckets gauge")
+	fmt.Fprintf(w, "rate_limit_exhausted_buckets %d\n", exhausted)
+	fmt.Fprintln(w, "# HELP rate_limit_refill_per_second Tokens added to each bucket per second.")
+	fmt.Fprintln(w, "# TYPE rate_limit_refill_per_second gauge")
+	fmt.Fprintf(w, "rate_limit_refill_per_second %s\n", strconv.FormatFloat(l.rate, 'g', -1, 64))
+	fmt.Fprintln(w, "# HELP rate_limit_burst Bucket capacity.")
+	fmt.Fprintln(w, "# TYPE rate_limit_burst gauge")
+	fmt.Fprintf(w, "rate_limit_burst %s\n", strconv.FormatFloat(l.burst, 'g', -1, 64))
+}
+
+var (
+	limiter *RateLimiter
+	// ipLimiter ограничивает запросы с одного адреса до аутентификации
+	ipLimiter *RateLimiter
+	// maxBodyBytes лимит тела запроса, 0 - без лимита
+	maxBodyBytes int64
+)
+
+// clientKey ключ корзины: арендатор и пользователь, если запрос аутентифицирован, иначе IP адрес клиента
+func clientKey(r *http.Request) string {
+	return limiterKey(r.Context(), r.RemoteAddr)
+}
+
+// limiterKey ключ корзины для пользователя и арендатора из ctx любого транспорта и адреса клиента remoteAddr
+func limiterKey(ctx context.Context, remoteAddr string) string {
+	var prefix string
+	if tenant, ok := tenantFrom(ctx); ok {
+		prefix = tenant.ID + "/"
+	}
+	if principal, ok := principalFrom(ctx); ok {
+		return prefix + "user:" + principal.UserID
+	}
+	return prefix + ipKey(remoteAddr)
+}
+
+// ipKey ключ корзины по IP адресу клиента remoteAddr
+func ipKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// tooManyRequests отвечает 429 с Retry-After через wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, APIResponse{Error: "Too many requests"})
+}
+
+// limitIP отвечает 429, если закончились токены у IP адреса запроса. Стоит перед authenticate
+func limitIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := ipLimiter.Allow(ipKey(r.RemoteAddr)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimit отвечает 429, если закончились токены у клиента или у арендатора запроса
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.Allow(clientKey(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		if tenantLimited(w, r) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// limitBody ограничивает размер тела запросов маршрута route. Форма разбирается сразу,
+// чтобы превышение лимита вернуло 413, а не ошибку проверки полей
+func limitBody(route string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			limit, ok := bodyLimits[route]
+			if !ok {
+				limit = maxBodyBytes
+			}
+			if limit <= 0 {
+				next(w, r)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				var tooLarge *http.MaxBytesError
+				if err := r.ParseForm(); errors.As(err, &tooLarge) {
+					writeError(w, err)
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Повторяющиеся события по подмножеству RRULE из RFC 5545:
+FREQ=DAILY|WEEKLY|MONTHLY, INTERVAL, BYDAY (только для WEEKLY, без числовых префиксов),
+BYMONTHDAY (только для MONTHLY, отрицательные значения считаются с конца месяца), COUNT или UNTIL, WKST.
+Исключенные вхождения перечисляются в Event.ExDates датами начала вхождения.
+
+Серия хранится одним событием, вхождения вычисляются только в пределах окна запроса.
+Измененное вхождение хранится отдельным событием с SeriesID и RecurrenceID, а его дата добавляется в ExDates серии.
+*/
+
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+)
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// разобранное правило повторения
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay []int
+	Count      int
+	Until      time.Time
+	UntilDate  bool
+	WeekStart  time.Weekday
+}
+
+// parseRRule разбирает значение RRULE, например FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10
+func parseRRule(value string) (*recurrenceRule, error) {
+	rule := &recurrenceRule{Interval: 1, WeekStart: time.Monday}
+
+	for _, part := range strings.Split(strings.TrimPrefix(value, "RRULE:"), ";") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rrule part %q", part)
+		}
+
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err == nil && rule.Interval < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err == nil && rule.Count < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "UNTIL":
+			rule.Until, err = parseICalTime(val)
+			rule.UntilDate = len(val) == len("20060102")
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				weekday, ok := weekdays[strings.ToUpper(day)]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY value %q", day)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(val, ",") {
+				monthDay, err := strconv.Atoi(day)
+				if err != nil || monthDay == 0 || monthDay < -31 || monthDay > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY value %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, monthDay)
+			}
+		case "WKST":
+			weekday, ok := weekdays[strings.ToUpper(val)]
+			if !ok {
+				return nil, fmt.Errorf("invalid WKST value %q", val)
+			}
+			rule.WeekStart = weekday
+		default:
+			return nil, fmt.Errorf("unsupported rrule part %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: %w", name, val, err)
+		}
+	}
+
+	switch {
+	case rule.Freq != freqDaily && rule.Freq != freqWeekly && rule.Freq != freqMonthly:
+		return nil, fmt.Errorf("FREQ must be DAILY, WEEKLY or MONTHLY")
+	case rule.Count > 0 && !rule.Until.IsZero():
+		return nil, fmt.Errorf("COUNT and UNTIL must not be used together")
+	case len(rule.ByDay) > 0 && rule.Freq != freqWeekly:
+		return nil, fmt.Errorf("BYDAY is supported only with FREQ=WEEKLY")
+	case len(rule.ByMonthDay) > 0 && rule.Freq != freqMonthly:
+		return nil, fmt.Errorf("BYMONTHDAY is supported only with FREQ=MONTHLY")
+	}
+	return rule, nil
+}
+
+// parseICalTime разбирает дату или время UTC в форматах iCalendar: 20261231 или 20261231T235959Z
+func parseICalTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected YYYYMMDD or YYYYMMDDTHHMMSSZ")
+}
+
+// civil дата без времени, все вычисления по календарю ведутся в UTC, чтобы не зависеть от переходов на летнее время
+func civil(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(from, to time.Time) int {
+	return int(civil(to).Sub(civil(from)).Hours() / 24)
+}
+
+// periodStart первый день периода номер n, считая от периода, в который входит first
+func (rule *recurrenceRule) periodStart(first time.Time, n int) time.Time {
+	switch rule.Freq {
+	case freqWeekly:
+		offset := (int(first.Weekday()) - int(rule.WeekStart) + 7) % 7
+		return first.AddDate(0, 0, -offset+7*n*rule.Interval)
+	case freqMonthly:
+		return time.Date(first.Year(), first.Month()+time.Month(n*rule.Interval), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return first.AddDate(0, 0, n*rule.Interval)
+	}
+}
+
+// periodsBefore количество целых периодов между first и date
+func (rule *recurrenceRule) periodsBefore(first, date time.Time) int {
+	switch rule.Freq {
+	case freqWeekly:
+		return daysBetween(rule.periodStart(first, 0), date) / 7 / rule.Interval
+	case freqMonthly:
+		months := (date.Year()-first.Year())*12 + int(date.Month()) - int(first.Month())
+		return months / rule.Interval
+	default:
+		return daysBetween(first, date) / rule.Interval
+	}
+}
+
+// candidates даты вхождений в периоде, начинающемся с start, по возрастанию
+func (rule *recurrenceRule) candidates(first, start time.Time) []time.Time {
+	var result []time.Time
+
+	switch rule.Freq {
+	case freqWeekly:
+		days := rule.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{first.Weekday()}
+		}
+		for _, day := range days {
+			offset := (int(day) - int(rule.WeekStart) + 7) % 7
+			result = append(result, start.AddDate(0, 0, offset))
+		}
+	case freqMonthly:
+		monthDays := rule.ByMonthDay
+		if len(monthDays) == 0 {
+			monthDays = []int{first.Day()}
+		}
+		lastDay := start.AddDate(0, 1, -1).Day()
+		for _, monthDay := range monthDays {
+			if monthDay < 0 {
+				monthDay = lastDay + monthDay + 1
+			}
+			if monthDay >= 1 && monthDay <= lastDay {
+				result = append(result, start.AddDate(0, 0, monthDay-1))
+			}
+		}
+	default:
+		result = append(result, start)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+	return result
+}
+
+// occurrenceAt вхождение серии, начинающееся в день date
+func (e Event) occurrenceAt(date time.Time, loc *time.Location) Event {
+	occurrence := e
+	occurrence.Date = date.Format(dateLayout)
+	occurrence.RecurrenceID = occurrence.Date
+	occurrence.ExDates = nil
+
+	if e.AllDay {
+		occurrence.Start = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+		occurrence.End = occurrence.Start.AddDate(0, 0, 1)
+		return occurrence
+	}
+
+	start := e.Start.In(loc)
+	occurrence.Start = time.Date(date.Year(), date.Month(), date.Day(), start.Hour(), start.Minute(), start.Second(), 0, loc)
+	occurrence.End = occurrence.Start.Add(e.End.Sub(e.Start))
+	return occurrence
+}
+
+// expand возвращает вхождения серии, пересекающиеся с окном [from, to).
+// Если COUNT не задан, перебор начинается с периода незадолго до окна, а не с начала серии
+func (e Event) expand(from, to time.Time) []Event {
+	rule, err := parseRRule(e.RRule)
+	if err != nil {
+		return nil
+	}
+	loc, err := loadLocation(e.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	first := civil(e.Start.In(loc))
+	excluded := make(map[string]bool, len(e.ExDates))
+	for _, date := range e.ExDates {
+		excluded[date] = true
+	}
+	toDate := to.Format(dateLayout)
+	lastDate := civil(to.In(loc)).AddDate(0, 0, 1)
+
+	period := 0
+	if rule.Count == 0 {
+		earliest := civil(from.Add(-e.End.Sub(e.Start)).In(loc)).AddDate(0, 0, -1)
+		period = max(0, rule.periodsBefore(first, earliest)-1)
+	}
+
+	var result []Event
+	seen := 0
+	for ; ; period++ {
+		start := rule.periodStart(first, period)
+		if start.After(lastDate) {
+			return result
+		}
+
+		dates := rule.candidates(first, start)
+		if period == 0 && !containsDate(dates, first) {
+			// DTSTART всегда считается первым вхождением
+			dates = append([]time.Time{first}, dates...)
+		}
+
+		for _, date := range dates {
+			if date.Before(first) {
+				continue
+			}
+
+			occurrence := e.occurrenceAt(date, loc)
+			if rule.after(occurrence, date) {
+				return result
+			}
+			if rule.Count > 0 && seen >= rule.Count {
+				return result
+			}
+			seen++
+
+			if (occurrence.AllDay && occurrence.Date >= toDate) || (!occurrence.AllDay && !occurrence.Start.Before(to)) {
+				return result
+			}
+			if !excluded[occurrence.Date] && occurrence.inWindow(from, to) {
+				result = append(result, occurrence)
+			}
+		}
+	}
+}
+
+// after проверяет, что вхождение в день date идет после UNTIL.
+// UNTIL-дата ограничивает вхождения по календарной дате, UNTIL-время - по моменту начала
+func (rule *recurrenceRule) after(occurrence Event, date time.Time) bool {
+	if rule.Until.IsZero() {
+		return false
+	}
+	if rule.UntilDate || occurrence.AllDay {
+		return date.After(civil(rule.Until))
+	}
+	return occurrence.Start.After(rule.Until)
+}
+
+func containsDate(dates []time.Time, date time.Time) bool {
+	for _, d := range dates {
+		if d.Equal(date) {
+			return true
+		}
+	}
+	return false
+}
+
+// occursOn проверяет, есть ли у серии неисключенное вхождение, начинающееся в дату date
+func (e Event) occursOn(date string) bool {
+	loc, err := loadLocation(e.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	day, err := time.ParseInLocation(dateLayout, date, loc)
+	if err != nil {
+		return false
+	}
+
+	for _, occurrence := range e.expand(day, day.AddDate(0, 0, 1)) {
+		if occurrence.Date == date {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRecurrence проверяет правило повторения и исключенные даты события, ошибки возвращаются как *ValidationError
+func validateRecurrence(event *Event) error {
+	if event.RRule == "" {
+		if len(event.ExDates) > 0 {
+			return invalid("exdates", "exdate requires rrule")
+		}
+		return nil
+	}
+
+	if _, err := parseRRule(event.RRule); err != nil {
+		return invalid("rrule", err.Error())
+	}
+	for _, date := range event.ExDates {
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return invalid("exdates", fmt.Sprintf("invalid exdate %q, expected YYYY-MM-DD", date))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Напоминания о событиях. Event.Reminders - за сколько минут до начала напомнить.
+
+Планировщик в фоне находит напоминания, время которых наступило, и доставляет их через Notifier.
+Обработанный момент времени (checkpoint) сохраняется в файл, поэтому после перезапуска срабатывают
+напоминания, пропущенные во время простоя, если событие еще не закончилось, и не срабатывают уже доставленные.
+Неудачная доставка повторяется с экспоненциальной задержкой, после maxAttempts попыток напоминание
+попадает в список недоставленных: GET /reminders/dead_letters.
+
+Наступившие напоминания доставляются одновременно, не больше deliveryWorkers за раз. Stop прерывает
+начатые доставки, прерванные напоминания остаются в повторах без засчитанной попытки.
+*/
+
+const (
+	maxReminderOffset = 7 * 24 * time.Hour
+	reminderLookahead = time.Minute
+	reminderStateFile = "reminders.json"
+	webhookTimeout    = 5 * time.Second
+	deliveryWorkers   = 8
+)
+
+// Reminder напоминание о вхождении события. Tenant заполняет tenantNotifier при отправке
+type Reminder struct {
+	Tenant      string    `json:"tenant,omitempty"`
+	Key         string    `json:"key"`
+	EventID     string    `json:"event_id"`
+	UserID      string    `json:"user_id"`
+	Description string    `json:"description"`
+	Start       time.Time `json:"start"`
+	At          time.Time `json:"at"`
+}
+
+// Notifier доставляет напоминание пользователю. Notify вызывается из нескольких горутин одновременно
+type Notifier interface {
+	Notify(ctx context.Context, reminder Reminder) error
+}
+
+// Clock источник времени планировщика, подменяется в тестах
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// LogNotifier пишет напоминания в лог
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, reminder Reminder) error {
+	log.Printf("Reminder for user %s: %q starts at %s\n", reminder.UserID, reminder.Description, reminder.Start.Format(time.RFC3339))
+	return nil
+}
+
+// WebhookNotifier отправляет напоминание POST запросом с JSON телом
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	body, err := json.Marshal(reminder)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseReminders парсит список смещений в минутах через запятую
+func parseReminders(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var reminders []int
+	for _, part := range strings.Split(value, ",") {
+		minutes, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid reminder %q", part)
+		}
+		reminders = append(reminders, minutes)
+	}
+	return reminders, validateReminders(reminders)
+}
+
+func validateReminders(reminders []int) error {
+	for _, minutes := range reminders {
+		if minutes < 0 || time.Duration(minutes)*time.Minute > maxReminderOffset {
+			return fmt.Errorf("reminder must be between 0 and %d minutes", int(maxReminderOffset.Minutes()))
+		}
+	}
+	return nil
+}
+
+// DueReminders возвращает напоминания, время которых попадает в (from, to], по возрастанию времени.
+// Напоминания о событиях, которые к to уже закончились, пропускаются
+func (c *Calendar) DueReminders(from, to time.Time) []Reminder {
+	var result []Reminder
+
+	c.RLock()
+	events := c.collect(from, to.Add(maxReminderOffset+time.Nanosecond), func(event Event) bool {
+		return len(event.Reminders) > 0
+	})
+	c.RUnlock()
+
+	for _, event := range events {
+		if event.End.Add(reminderLookahead).Before(to) {
+			continue
+		}
+		for _, minutes := range event.Reminders {
+			at := event.Start.Add(-time.Duration(minutes) * time.Minute)
+			if !at.After(from) || at.After(to) {
+				continue
+			}
+			result = append(result, Reminder{
+				Key:         fmt.Sprintf("%s/%s/%d", event.ID, event.Start.UTC().Format(time.RFC3339), minutes),
+				EventID:     event.ID,
+				UserID:      event.UserID,
+				Description: event.Description,
+				Start:       event.Start,
+				At:          at,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].At.Before(result[j].At) })
+	return result
+}
+
+// доставка, ожидающая повторной попытки
+type pendingDelivery struct {
+	Reminder Reminder  `json:"reminder"`
+	Attempts int       `json:"attempts"`
+	NextAt   time.Time `json:"next_at"`
+	LastErr  string    `json:"last_error,omitempty"`
+}
+
+// сохраняемое состояние планировщика
+type schedulerState struct {
+	Checkpoint  time.Time         `json:"checkpoint"`
+	Retries     []pendingDelivery `json:"retries,omitempty"`
+	DeadLetters []pendingDelivery `json:"dead_letters,omitempty"`
+}
+
+// Scheduler планировщик напоминаний
+type Scheduler struct {
+	calendar    *Calendar
+	notifier    Notifier
+	clock       Clock
+	stateFile   string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	workers     int
+
+	mu    sync.Mutex
+	state schedulerState
+
+	// ctx отменяется в Stop и прерывает начатые доставки
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScheduler создает планировщик. Если stateFile не пустой, состояние восстанавливается из него
+// и сохраняется туда после каждой обработки
+func NewScheduler(calendar *Calendar, notifier Notifier, clock Clock, stateFile string) (*Scheduler, error) {
+	s := &Scheduler{
+		calendar:    calendar,
+		notifier:    notifier,
+		clock:       clock,
+		stateFile:   stateFile,
+		maxAttempts: 5,
+		backoff:     10 * time.Second,
+		maxBackoff:  10 * time.Minute,
+		workers:     deliveryWorkers,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if err := s.loadState(); err != nil {
+		return nil, err
+	}
+	if s.state.Checkpoint.IsZero() {
+		s.state.Checkpoint = clock.Now()
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+func (s *Scheduler) loadState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.state)
+}
+
+// saveState атомарно записывает состояние, вызывается под s.mu
+func (s *Scheduler) saveState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	tmp := s.stateFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.stateFile)
+}
+
+// Wake будит планировщик, чтобы он пересчитал ближайшее напоминание после изменения календаря
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start запускает планировщик в отдельной горутине
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// Stop прерывает доставки, останавливает планировщик и ждет завершения текущей обработки
+func (s *Scheduler) Stop() {
+	s.cancel()
+	close(s.stop)
+	<-s.done
+}
+
+// DeadLetters возвращает недоставленные напоминания пользователя, для пустого userID - все
+func (s *Scheduler) DeadLetters(userID string) []pendingDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []pendingDelivery{}
+	for _, letter := range s.state.DeadLetters {
+		if userID == "" || letter.Reminder.UserID == userID {
+			result = append(result, letter)
+		}
+	}
+	return result
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	for {
+		wait := s.tick()
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// tick доставляет наступившие напоминания и повторы и возвращает время до следующей проверки
+func (s *Scheduler) tick() time.Duration {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	due := s.calendar.DueReminders(s.state.Checkpoint, now)
+	var retries, later []pendingDelivery
+	for _, retry := range s.state.Retries {
+		if retry.NextAt.After(now) {
+			later = append(later, retry)
+		} else {
+			retries = append(retries, retry)
+		}
+	}
+	s.state.Retries = later
+	s.mu.Unlock()
+
+	for _, reminder := range due {
+		retries = append(retries, pendingDelivery{Reminder: reminder})
+	}
+	workers := make(chan struct{}, s.workers)
+	var wg sync.WaitGroup
+	for _, delivery := range retries {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(delivery, now)
+			<-workers
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.state.Checkpoint = now
+	if err := s.saveState(); err != nil {
+		log.Println("Failed to save reminder state:", err)
+	}
+	wait := reminderLookahead
+	for _, retry := range s.state.Retries {
+		if d := retry.NextAt.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	s.mu.Unlock()
+
+	if next := s.calendar.DueReminders(now, now.Add(wait)); len(next) > 0 {
+		wait = next[0].At.Sub(now)
+	}
+	return max(wait, 0)
+}
+
+// deliver отправляет напоминание, при ошибке откладывает повтор или переносит в недоставленные
+func (s *Scheduler) deliver(delivery pendingDelivery, now time.Time) {
+	ctx, cancel := context.WithTimeout(s.ctx, webhookTimeout)
+	err := s.notifier.Notify(ctx, delivery.Reminder)
+	cancel()
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// доставку прервал Stop, напоминание уйдет после перезапуска
+	if s.ctx.Err() != nil {
+		delivery.NextAt = now
+		s.state.Retries = append(s.state.Retries, delivery)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastErr = err.Error()
+
+	if delivery.Attempts >= s.maxAttempts {
+		log.Printf("Reminder %s moved to dead letters: %v\n", delivery.Reminder.Key, err)
+		s.state.DeadLetters = append(s.state.DeadLetters, delivery)
+		return
+	}
+
+	backoff := s.backoff << (delivery.Attempts - 1)
+	if backoff > s.maxBackoff || backoff <= 0 {
+		backoff = s.maxBackoff
+	}
+	delivery.NextAt = now.Add(backoff)
+	s.state.Retries = append(s.state.Retries, delivery)
+}
+
+// openNotifier создает Notifier по названию из флага -notifier
+func openNotifier(kind, webhookURL string) (Notifier, error) {
+	switch kind {
+	case "log":
+		return LogNotifier{}, nil
+	case "webhook":
+		if webhookURL == "" {
+			return nil, errors.New("webhook notifier requires -webhook-url")
+		}
+		return NewWebhookNotifier(webhookURL), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
+
+// reminderStatePath файл состояния планировщика рядом с файловым хранилищем
+func reminderStatePath(storageKind, dataDir string) string {
+	if storageKind != "file" {
+		return ""
+	}
+	return filepath.Join(dataDir, reminderStateFile)
+}
+
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if _, err := strconv.Atoi(userID); userID != "" && err != nil {
+		writeError(w, invalid("user_id", "must be an integer"))
+		return
+	}
+	// без user_id отдаются напоминания всех пользователей, это доступно только администратору
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	tenant, ok := tenantFrom(r.Context())
+	if !ok || tenant.scheduler == nil {
+		writeResult(w, []pendingDelivery{})
+		return
+	}
+	writeResult(w, tenant.scheduler.DeadLetters(userID))
+}
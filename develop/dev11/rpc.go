@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+JSON-RPC 2.0 поверх TCP - второй транспорт к тому же Calendar для внутренних сервисов, включается rpc_port.
+
+Сообщения в обе стороны - JSON-объекты по одному на строку, пакет запросов JSON-RPC - массив в одной строке.
+Строка не больше max_body_bytes. Параметры передаются по имени:
+
+	--> {"jsonrpc": "2.0", "id": 1, "method": "events.create", "params": {"user_id": "1", "date": "2026-10-19", "description": "Планерка"}}
+	<-- {"jsonrpc": "2.0", "id": 1, "result": {"id": "5f2b8a1c9d3e4f60", "user_id": "1", ...}}
+
+	auth                 api_key или token и tenant; при включенной аутентификации обязателен до остальных методов.
+	                     Арендатор выбирается как по X-Tenant-ID в HTTP, смена арендатора закрывает подписки.
+	                     Каждый вызов списывает токен из корзины IP адреса, см. ip_rate_limit в ratelimit.go
+	events.create        поля события как в операции /events/batch и reject_conflicts
+	events.update        id, поля события, occurrence, version
+	events.delete        id, user_id, occurrence, version
+	events.get           id
+	events.list          user_id, period (day, week, month), date или week, week_start, tz, как в period.go
+	events.batch         mode и ops - операции как в теле /events/batch
+	changes.subscribe    user_id, last_event_id - id последнего полученного изменения; результат {"subscription": N}
+	changes.unsubscribe  subscription
+
+После changes.subscribe сервер присылает уведомления подписки, как SSE в /events/stream:
+
+	<-- {"jsonrpc": "2.0", "method": "changes.event", "params": {"subscription": 1, "change": {"id": "lx3k9q2a1b-42", "seq": 42, ...}}}
+	<-- {"jsonrpc": "2.0", "method": "changes.closed", "params": {"subscription": 1}}
+
+changes.closed приходит, если клиент не успевает читать изменения или сервер останавливается:
+нужно подписаться снова с last_event_id.
+
+Ошибки - стандартные коды JSON-RPC и коды приложения, data - details из HTTP API:
+
+	-32700 parse error          -32001 unauthenticated   -32009 conflict, data.conflicting_ids
+	-32600 invalid request      -32003 forbidden         -32012 event was modified
+	-32601 method not found     -32004 event not found   -32029 too many requests, data.retry_after в секундах
+	-32602 invalid params, data.fields                   -32053 event quota exceeded, data.max_events
+	-32603 internal error
+*/
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	rpcUnauthenticated = -32001
+	rpcForbidden       = -32003
+	rpcNotFound        = -32004
+	rpcConflict        = -32009
+	rpcVersionMismatch = -32012
+	rpcTooManyRequests = -32029
+	rpcQuotaExceeded   = -32053
+
+	rpcProtocolVersion = "2.0"
+	rpcNotifyChange    = "changes.event"
+	rpcNotifyClosed    = "changes.closed"
+
+	rpcWriteTimeout     = 10 * time.Second
+	rpcSubscriptionsCap = 16 // подписок на одно соединение
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// ID нет у уведомлений, на них не отвечают
+	ID json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// уведомление сервера о подписке
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcChangeParams struct {
+	Subscription uint64  `json:"subscription"`
+	Change       *Change `json:"change,omitempty"`
+}
+
+// rpcError ошибка JSON-RPC
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+var rpcNullID = json.RawMessage("null")
+
+// toRPCError переводит ошибку бизнес-логики в код JSON-RPC, как writeError - в код HTTP
+func toRPCError(err error) *rpcError {
+	var (
+		rpcErr        *rpcError
+		validationErr *ValidationError
+		conflictErr   *ConflictError
+		statusErr     *statusError
+		quotaErr      *QuotaError
+	)
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.As(err, &validationErr):
+		return &rpcError{Code: rpcInvalidParams, Message: "Invalid params", Data: validationErr}
+	case errors.Is(err, ErrNotFound):
+		return &rpcError{Code: rpcNotFound, Message: "Event not found"}
+	case errors.As(err, &conflictErr):
+		return &rpcError{Code: rpcConflict, Message: conflictErr.Error(), Data: conflictErr}
+	case errors.Is(err, ErrForbidden):
+		return &rpcError{Code: rpcForbidden, Message: "Forbidden"}
+	case errors.Is(err, ErrVersionMismatch):
+		return &rpcError{Code: rpcVersionMismatch, Message: "Event was modified"}
+	case errors.As(err, &quotaErr):
+		return &rpcError{Code: rpcQuotaExceeded, Message: "Event quota exceeded", Data: quotaErr}
+	case errors.As(err, &statusErr) && statusErr.status < http.StatusInternalServerError:
+		return &rpcError{Code: rpcInvalidParams, Message: statusErr.message}
+	default:
+		slog.Error("rpc call failed", "error", err)
+		return &rpcError{Code: rpcInternalError, Message: "Internal error"}
+	}
+}
+
+// RPCServer сервер JSON-RPC поверх TCP
+type RPCServer struct {
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[*rpcConn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenRPC начинает слушать addr, например ":8081"
+func ListenRPC(addr string) (*RPCServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCServer{listener: listener, conns: make(map[*rpcConn]struct{})}, nil
+}
+
+// Addr адрес, на котором слушает сервер
+func (s *RPCServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve принимает соединения до Close
+func (s *RPCServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		tenant, _ := tenants.Get(defaultTenant)
+		c := &rpcConn{
+			conn:    conn,
+			ctx:     withTenant(context.Background(), tenant),
+			encoder: json.NewEncoder(conn),
+			feed:    tenant.calendar.feed,
+			subs:    make(map[uint64]*Subscription),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close перестает принимать соединения, присылает подписчикам changes.closed, закрывает соединения
+// и ждет их обработчиков
+func (s *RPCServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.listener.Close()
+	for c := range s.conns {
+		c.closeSubscriptions()
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// rpcConn соединение клиента. Запросы выполняются по очереди, уведомления подписок пишутся из своих горутин
+type rpcConn struct {
+	conn net.Conn
+	ctx  context.Context // с арендатором и с пользователем после auth
+
+	writeMu sync.Mutex
+	encoder *json.Encoder
+
+	mu      sync.Mutex
+	feed    *ChangeFeed // лента арендатора, на которую оформлены subs
+	subs    map[uint64]*Subscription
+	nextSub uint64
+	wg      sync.WaitGroup
+
+	// afterReply запускается после отправки ответа: уведомления подписки не должны обогнать ее номер
+	afterReply []func()
+}
+
+func (c *rpcConn) serve() {
+	defer c.close()
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), messageLimit())
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var err error
+		if reply := c.handle(line); reply != nil {
+			err = c.write(reply)
+		}
+		for _, start := range c.afterReply {
+			start()
+		}
+		c.afterReply = nil
+		if err != nil {
+			return
+		}
+	}
+
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		c.write(rpcResponse{JSONRPC: rpcProtocolVersion, ID: rpcNullID, Error: &rpcError{Code: rpcInvalidRequest, Message: "Message too large"}})
+	}
+}
+
+// close отменяет подписки соединения и ждет их горутин
+func (c *rpcConn) close() {
+	c.conn.Close()
+
+	c.mu.Lock()
+	feed, subs := c.feed, c.subs
+	c.subs = nil
+	c.mu.Unlock()
+	for _, sub := range subs {
+		feed.Unsubscribe(sub)
+	}
+	c.wg.Wait()
+}
+
+func (c *rpcConn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(rpcWriteTimeout))
+	return c.encoder.Encode(v)
+}
+
+// handle выполняет запрос или пакет запросов и возвращает ответ, nil - отвечать не нужно
+func (c *rpcConn) handle(message []byte) interface{} {
+	if message[0] != '[' {
+		// nil *rpcResponse в interface{} не равен nil
+		if reply := c.handleOne(message); reply != nil {
+			return reply
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(message, &batch); err != nil {
+		return rpcResponse{JSONRPC: rpcProtocolVersion, ID: rpcNullID, Error: &rpcError{Code: rpcParseError, Message: "Parse error"}}
+	}
+	if len(batch) == 0 {
+		return rpcResponse{JSONRPC: rpcProtocolVersion, ID: rpcNullID, Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid request"}}
+	}
+
+	var replies []*rpcResponse
+	for _, raw := range batch {
+		if reply := c.handleOne(raw); reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	return replies
+}
+
+func (c *rpcConn) handleOne(raw []byte) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		code, message := rpcInvalidRequest, "Invalid request"
+		if !json.Valid(raw) {
+			code, message = rpcParseError, "Parse error"
+		}
+		return &rpcResponse{JSONRPC: rpcProtocolVersion, ID: rpcNullID, Error: &rpcError{Code: code, Message: message}}
+	}
+	if req.JSONRPC != rpcProtocolVersion || req.Method == "" {
+		id := req.ID
+		if id == nil {
+			id = rpcNullID
+		}
+		return &rpcResponse{JSONRPC: rpcProtocolVersion, ID: id, Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid request"}}
+	}
+
+	result, err := c.call(req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	reply := &rpcResponse{JSONRPC: rpcProtocolVersion, ID: req.ID, Result: result}
+	if err != nil {
+		reply.Result, reply.Error = nil, toRPCError(err)
+	}
+	return reply
+}
+
+// call проверяет аутентификацию и лимиты частоты клиента и арендатора и вызывает метод
+func (c *rpcConn) call(method string, params json.RawMessage) (interface{}, error) {
+	handler, ok := rpcMethods[method]
+	if !ok {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+	}
+	// попытки аутентификации ограничены по адресу, как запросы HTTP до authenticate
+	if method == "auth" {
+		if ok, wait := ipLimiter.Allow(ipKey(c.conn.RemoteAddr().String())); !ok {
+			return nil, rpcTooMany("Too many requests", wait)
+		}
+	}
+	if _, authenticated := principalFrom(c.ctx); method != "auth" && authenticator.Enabled() && !authenticated {
+		return nil, &rpcError{Code: rpcUnauthenticated, Message: errUnauthenticated.Error()}
+	}
+	// ключ корзины тот же, что у HTTP запросов этого клиента
+	if ok, wait := limiter.Allow(limiterKey(c.ctx, c.conn.RemoteAddr().String())); !ok {
+		return nil, rpcTooMany("Too many requests", wait)
+	}
+	if tenant, ok := tenantFrom(c.ctx); ok {
+		if ok, wait := tenant.Allow(); !ok {
+			return nil, rpcTooMany("Tenant request quota exceeded", wait)
+		}
+	}
+	return handler(c, params)
+}
+
+func rpcTooMany(message string, wait time.Duration) *rpcError {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	return &rpcError{Code: rpcTooManyRequests, Message: message, Data: map[string]int{"retry_after": retryAfter}}
+}
+
+// decodeParams раскладывает именованные параметры метода в v
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || params[0] != '{' {
+		return &rpcError{Code: rpcInvalidParams, Message: "params must be an object"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: "Invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+type rpcMethod func(c *rpcConn, params json.RawMessage) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"auth":                (*rpcConn).auth,
+	"events.create":       rpcMutation(batchCreate),
+	"events.update":       rpcMutation(batchUpdate),
+	"events.delete":       rpcMutation(batchDelete),
+	"events.get":          (*rpcConn).getEvent,
+	"events.list":         (*rpcConn).listEvents,
+	"events.batch":        (*rpcConn).batch,
+	"changes.subscribe":   (*rpcConn).subscribe,
+	"changes.unsubscribe": (*rpcConn).unsubscribe,
+}
+
+func (c *rpcConn) auth(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		APIKey string `json:"api_key"`
+		Token  string `json:"token"`
+		Tenant string `json:"tenant"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	var principal Principal
+	if authenticator.Enabled() {
+		var err error
+		switch {
+		case p.APIKey != "":
+			principal, err = authenticator.checkAPIKey(p.APIKey)
+		case p.Token != "":
+			principal, err = authenticator.VerifyToken(p.Token)
+		default:
+			err = errUnauthenticated
+		}
+		if err != nil {
+			return nil, &rpcError{Code: rpcUnauthenticated, Message: err.Error()}
+		}
+		ctx = withPrincipal(ctx, principal)
+	}
+	tenant, err := resolveTenant(ctx, p.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// подписки оформлены на ленту прежнего арендатора
+	if current, _ := tenantFrom(c.ctx); current != tenant {
+		c.closeSubscriptions()
+		c.mu.Lock()
+		c.feed = tenant.calendar.feed
+		c.mu.Unlock()
+	}
+	c.ctx = withTenant(ctx, tenant)
+
+	principal.Tenant = tenant.ID
+	return principal, nil
+}
+
+// rpcMutation метод, который выполняет операцию action так же, как операция /events/batch
+func rpcMutation(action string) rpcMethod {
+	return func(c *rpcConn, params json.RawMessage) (interface{}, error) {
+		var body batchRequest
+		if err := decodeParams(params, &body); err != nil {
+			return nil, err
+		}
+		body.Op = action
+
+		op, err := parseBatchOp(c.ctx, body)
+		if err != nil {
+			return nil, err
+		}
+		event, err := calendarFrom(c.ctx).Apply(c.ctx, op)
+		if err != nil {
+			return nil, err
+		}
+		if action == batchDelete {
+			return "Event deleted successfully", nil
+		}
+		return event, nil
+	}
+}
+
+func (c *rpcConn) getEvent(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.ID == "" {
+		return nil, invalid("id", "is required")
+	}
+
+	event, ok := calendarFrom(c.ctx).GetEvent(p.ID)
+	if !ok || !permittedEvent(c.ctx, event) {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+func (c *rpcConn) listEvents(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		UserID    string `json:"user_id"`
+		Period    string `json:"period"`
+		Date      string `json:"date"`
+		Week      string `json:"week"`
+		WeekStart string `json:"week_start"`
+		TimeZone  string `json:"tz"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	verr := &ValidationError{}
+	if _, err := strconv.Atoi(p.UserID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	if p.Period == "" {
+		p.Period = periodDay
+	}
+	if p.Period != periodDay && p.Period != periodWeek && p.Period != periodMonth {
+		verr.Add("period", "must be day, week or month")
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"date": p.Date, "week": p.Week, "week_start": p.WeekStart, "tz": p.TimeZone} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	calendar := calendarFrom(c.ctx)
+	q, err := parsePeriodParams(query, p.Period, calendar.WeekStart())
+	if err != nil {
+		verr.Merge("date", err)
+	}
+	if err = verr.Err(); err != nil {
+		return nil, err
+	}
+	if !permitted(c.ctx, p.UserID) {
+		return nil, ErrForbidden
+	}
+
+	q.UserID = p.UserID
+	return calendar.EventsFor(q), nil
+}
+
+func (c *rpcConn) batch(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Mode string            `json:"mode"`
+		Ops  []json.RawMessage `json:"ops"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Mode == "" {
+		p.Mode = batchAtomic
+	}
+	if p.Mode != batchAtomic && p.Mode != batchBestEffort {
+		return nil, invalid("mode", "must be atomic or best_effort")
+	}
+	if len(p.Ops) > maxBatchOps {
+		return nil, invalid("ops", "at most "+strconv.Itoa(maxBatchOps)+" operations per batch")
+	}
+
+	items, err := runBatch(c.ctx, p.Ops, p.Mode == batchAtomic, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchResponse(p.Mode, items), nil
+}
+
+func (c *rpcConn) subscribe(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		UserID      string `json:"user_id"`
+		LastEventID string `json:"last_event_id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if _, err := strconv.Atoi(p.UserID); err != nil {
+		return nil, invalid("user_id", "must be an integer")
+	}
+	if !permitted(c.ctx, p.UserID) {
+		return nil, ErrForbidden
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.subs) == rpcSubscriptionsCap {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "Too many subscriptions on the connection"}
+	}
+
+	sub, pending, _ := c.feed.Subscribe(p.UserID, p.LastEventID)
+	c.nextSub++
+	id := c.nextSub
+	c.subs[id] = sub
+
+	c.wg.Add(1)
+	c.afterReply = append(c.afterReply, func() {
+		go c.forward(id, sub, pending)
+	})
+	return map[string]uint64{"subscription": id}, nil
+}
+
+// forward пересылает изменения подписки клиенту, пока подписка или соединение не закроются
+func (c *rpcConn) forward(id uint64, sub *Subscription, pending []Change) {
+	defer c.wg.Done()
+
+	for _, change := range pending {
+		if c.notify(rpcNotifyChange, id, &change) != nil {
+			return
+		}
+	}
+	for change := range sub.C {
+		if c.notify(rpcNotifyChange, id, &change) != nil {
+			return
+		}
+	}
+
+	// канал закрыла лента, а не unsubscribe: клиенту нужно подписаться снова
+	c.mu.Lock()
+	_, active := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if active {
+		c.notify(rpcNotifyClosed, id, nil)
+	}
+}
+
+func (c *rpcConn) notify(method string, id uint64, change *Change) error {
+	return c.write(rpcNotification{JSONRPC: rpcProtocolVersion, Method: method, Params: rpcChangeParams{Subscription: id, Change: change}})
+}
+
+// closeSubscriptions отменяет подписки соединения и сообщает о каждой changes.closed
+func (c *rpcConn) closeSubscriptions() {
+	c.mu.Lock()
+	feed, subs := c.feed, c.subs
+	c.subs = make(map[uint64]*Subscription)
+	c.mu.Unlock()
+
+	for id, sub := range subs {
+		feed.Unsubscribe(sub)
+		c.notify(rpcNotifyClosed, id, nil)
+	}
+}
+
+func (c *rpcConn) unsubscribe(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Subscription uint64 `json:"subscription"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	feed := c.feed
+	sub, ok := c.subs[p.Subscription]
+	delete(c.subs, p.Subscription)
+	c.mu.Unlock()
+	if !ok {
+		return nil, invalid("subscription", "unknown subscription")
+	}
+
+	feed.Unsubscribe(sub)
+	return true, nil
+}
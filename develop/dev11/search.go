@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+Полнотекстовый поиск по описаниям событий.
+
+	GET /search?user_id=&q=&from=&to=&tz=&limit=
+
+q - слова через пробел, событие должно содержать все. Слово со звездочкой на конце (ретро*) ищется по префиксу,
+слова в двойных кавычках ("план спринта") - как фраза подряд. Регистр не важен, ё не отличается от е.
+С from и to (оба или ни одного, формат как у /events) повторяющиеся события возвращаются вхождениями
+в этом диапазоне, без них - сами события. Результаты упорядочены по началу.
+
+Индекс обновляется вместе с индексом по датам при каждом изменении события.
+*/
+
+// searchIndex инвертированный индекс: термин -> событие -> позиции термина в описании
+type searchIndex struct {
+	postings map[string]map[string][]int
+	terms    []string            // упорядоченные термины для поиска по префиксу
+	docs     map[string][]string // термины каждого события, чтобы убрать его из индекса
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string][]int),
+		docs:     make(map[string][]string),
+	}
+}
+
+// foldTerm приводит слово к виду, в котором оно хранится в индексе
+func foldTerm(word string) string {
+	return strings.ReplaceAll(strings.ToLower(word), "ё", "е")
+}
+
+// tokenize разбивает текст на слова из букв и цифр
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = foldTerm(word)
+	}
+	return words
+}
+
+func (s *searchIndex) add(event Event) {
+	s.remove(event.ID)
+
+	words := tokenize(event.Description)
+	if len(words) == 0 {
+		return
+	}
+
+	var terms []string
+	for position, term := range words {
+		postings, ok := s.postings[term]
+		if !ok {
+			postings = make(map[string][]int)
+			s.postings[term] = postings
+			i, _ := slices.BinarySearch(s.terms, term)
+			s.terms = slices.Insert(s.terms, i, term)
+		}
+		if _, ok = postings[event.ID]; !ok {
+			terms = append(terms, term)
+		}
+		postings[event.ID] = append(postings[event.ID], position)
+	}
+	s.docs[event.ID] = terms
+}
+
+func (s *searchIndex) remove(id string) {
+	for _, term := range s.docs[id] {
+		postings := s.postings[term]
+		delete(postings, id)
+		if len(postings) == 0 {
+			delete(s.postings, term)
+			if i, ok := slices.BinarySearch(s.terms, term); ok {
+				s.terms = slices.Delete(s.terms, i, i+1)
+			}
+		}
+	}
+	delete(s.docs, id)
+}
+
+// searchQuery разобранный запрос: каждая группа - слово, префикс или фраза
+type searchQuery struct {
+	words    []string
+	prefixes []string
+	phrases  [][]string
+}
+
+// parseSearchQuery разбирает строку запроса
+func parseSearchQuery(q string) (searchQuery, error) {
+	var query searchQuery
+
+	for rest := q; ; {
+		before, phrase, found := strings.Cut(rest, `"`)
+		for _, field := range strings.Fields(before) {
+			prefix := strings.HasSuffix(field, "*")
+			words := tokenize(field)
+			switch {
+			case len(words) == 0:
+			case prefix:
+				// ретро-встре* - все слова, кроме последнего, точные
+				query.words = append(query.words, words[:len(words)-1]...)
+				query.prefixes = append(query.prefixes, words[len(words)-1])
+			case len(words) > 1:
+				query.phrases = append(query.phrases, words)
+			default:
+				query.words = append(query.words, words[0])
+			}
+		}
+		if !found {
+			break
+		}
+
+		phrase, rest, found = strings.Cut(phrase, `"`)
+		if !found {
+			return searchQuery{}, fmt.Errorf("unterminated phrase")
+		}
+		switch words := tokenize(phrase); len(words) {
+		case 0:
+		case 1:
+			query.words = append(query.words, words[0])
+		default:
+			query.phrases = append(query.phrases, words)
+		}
+	}
+
+	if len(query.words)+len(query.prefixes)+len(query.phrases) == 0 {
+		return searchQuery{}, fmt.Errorf("must contain at least one word")
+	}
+	return query, nil
+}
+
+// intersect оставляет в ids только события из other, nil в ids означает "все события"
+func intersect(ids, other map[string]bool) map[string]bool {
+	if ids == nil {
+		return other
+	}
+	for id := range ids {
+		if !other[id] {
+			delete(ids, id)
+		}
+	}
+	return ids
+}
+
+// match возвращает ID событий, описания которых подходят под запрос
+func (s *searchIndex) match(query searchQuery) map[string]bool {
+	var ids map[string]bool
+
+	for _, word := range query.words {
+		found := make(map[string]bool)
+		for id := range s.postings[word] {
+			found[id] = true
+		}
+		ids = intersect(ids, found)
+	}
+
+	for _, prefix := range query.prefixes {
+		found := make(map[string]bool)
+		for i, _ := slices.BinarySearch(s.terms, prefix); i < len(s.terms) && strings.HasPrefix(s.terms[i], prefix); i++ {
+			for id := range s.postings[s.terms[i]] {
+				found[id] = true
+			}
+		}
+		ids = intersect(ids, found)
+	}
+
+	for _, phrase := range query.phrases {
+		found := make(map[string]bool)
+		for id, positions := range s.postings[phrase[0]] {
+			if s.hasPhrase(id, positions, phrase[1:]) {
+				found[id] = true
+			}
+		}
+		ids = intersect(ids, found)
+	}
+
+	return ids
+}
+
+// hasPhrase проверяет, что после одной из позиций первого слова фразы в событии id идут остальные слова
+func (s *searchIndex) hasPhrase(id string, starts []int, rest []string) bool {
+next:
+	for _, start := range starts {
+		for offset, word := range rest {
+			if !slices.Contains(s.postings[word][id], start+offset+1) {
+				continue next
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// SearchQuery параметры поиска, From и To нулевые, если диапазон не задан
+type SearchQuery struct {
+	UserID string
+	Query  string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// Search ищет видимые пользователю события по описанию
+func (c *Calendar) Search(q SearchQuery) ([]Event, error) {
+	query, err := parseSearchQuery(q.Query)
+	if err != nil {
+		return nil, invalid("q", err.Error())
+	}
+	if q.Limit <= 0 || q.Limit > maxPageLimit {
+		q.Limit = defaultPageLimit
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	ids := c.search.match(query)
+	match := func(event Event) bool {
+		return ids[event.ID] && c.listed(event, q.UserID)
+	}
+
+	var events []Event
+	if q.From.IsZero() {
+		events = []Event{}
+		for id := range ids {
+			if event, ok := c.find(id); ok && match(event) {
+				events = append(events, event)
+			}
+		}
+		sortEvents(events)
+	} else {
+		events = c.collect(q.From, q.To, match)
+	}
+
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+// parseSearchParams парсит параметры /search
+func parseSearchParams(r *http.Request) (*SearchQuery, error) {
+	query := r.URL.Query()
+
+	verr := &ValidationError{}
+	q := &SearchQuery{UserID: query.Get("user_id"), Query: query.Get("q")}
+	if _, err := strconv.Atoi(q.UserID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	if strings.TrimSpace(q.Query) == "" {
+		verr.Add("q", "is required")
+	}
+
+	switch {
+	case query.Has("from") && query.Has("to"):
+		from, to, err := parseRange(query)
+		if err != nil {
+			verr.Merge("range", err)
+		}
+		q.From, q.To = from, to
+	case query.Has("from") || query.Has("to"):
+		verr.Add("to", "from and to must be set together")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			verr.Add("limit", fmt.Sprintf("must be between 1 and %d", maxPageLimit))
+		}
+	}
+
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q, err := parseSearchParams(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, q.UserID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	events, err := calendarFrom(r.Context()).Search(*q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, events)
+}
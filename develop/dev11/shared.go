@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Участники событий и общие календари.
+
+У события может быть список участников (attendees). Участник видит событие в своих запросах
+за день, неделю и месяц, пока не отказался, и отвечает на приглашение:
+
+	POST /rsvp             user_id, id, status=accepted|declined|tentative
+
+Событие можно положить в общий календарь (calendar_id). Владелец календаря выдает другим пользователям
+право read (видеть события календаря) или write (еще и создавать, менять и удалять их):
+
+	POST /calendars/create user_id, name
+	POST /calendars/share  user_id, calendar_id, grantee_id, permission=read|write|none
+	GET  /calendars        ?user_id= - календари, которыми пользователь владеет или к которым у него есть доступ
+
+Событие по-прежнему принадлежит пользователю UserID, который его создал.
+Занятым (/freebusy, reject_conflicts) пользователь считается в своих событиях и в тех, где он участник
+со статусом accepted или tentative.
+*/
+
+const (
+	rsvpNeedsAction = "needs_action"
+	rsvpAccepted    = "accepted"
+	rsvpDeclined    = "declined"
+	rsvpTentative   = "tentative"
+
+	permissionRead  = "read"
+	permissionWrite = "write"
+	permissionNone  = "none"
+
+	sharedCalendarsFile = "calendars.json"
+)
+
+// Attendee участник события
+type Attendee struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// SharedCalendar общий календарь. Grants - права других пользователей: read или write
+type SharedCalendar struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	OwnerID string            `json:"owner_id"`
+	Grants  map[string]string `json:"grants,omitempty"`
+}
+
+// permission право пользователя на календарь, пустая строка - нет доступа
+func (s SharedCalendar) permission(userID string) string {
+	if s.OwnerID == userID {
+		return permissionWrite
+	}
+	return s.Grants[userID]
+}
+
+// attendee возвращает участника userID
+func (e Event) attendee(userID string) (Attendee, bool) {
+	for _, attendee := range e.Attendees {
+		if attendee.UserID == userID {
+			return attendee, true
+		}
+	}
+	return Attendee{}, false
+}
+
+// attends проверяет, занят ли пользователь в событии: он владелец или согласился участвовать
+func (e Event) attends(userID string) bool {
+	if e.UserID == userID {
+		return true
+	}
+	attendee, ok := e.attendee(userID)
+	return ok && (attendee.Status == rsvpAccepted || attendee.Status == rsvpTentative)
+}
+
+// parseAttendees парсит список user_id участников через запятую
+func parseAttendees(value string) []Attendee {
+	if value == "" {
+		return nil
+	}
+
+	attendees := []Attendee{}
+	for _, userID := range strings.Split(value, ",") {
+		attendees = append(attendees, Attendee{UserID: strings.TrimSpace(userID), Status: rsvpNeedsAction})
+	}
+	return attendees
+}
+
+func validateAttendees(attendees []Attendee) error {
+	for _, attendee := range attendees {
+		if _, err := strconv.Atoi(attendee.UserID); err != nil {
+			return fmt.Errorf("invalid attendee %q", attendee.UserID)
+		}
+		switch attendee.Status {
+		case rsvpNeedsAction, rsvpAccepted, rsvpDeclined, rsvpTentative:
+		default:
+			return fmt.Errorf("invalid attendee status %q", attendee.Status)
+		}
+	}
+	return nil
+}
+
+// mergeAttendees собирает новый список участников: владелец и повторы отбрасываются,
+// ответы оставшихся участников берутся из previous
+func mergeAttendees(ownerID string, attendees, previous []Attendee) []Attendee {
+	status := make(map[string]string, len(previous))
+	for _, attendee := range previous {
+		status[attendee.UserID] = attendee.Status
+	}
+
+	var result []Attendee
+	seen := make(map[string]bool)
+	for _, attendee := range attendees {
+		if attendee.UserID == ownerID || seen[attendee.UserID] {
+			continue
+		}
+		seen[attendee.UserID] = true
+		if previousStatus, ok := status[attendee.UserID]; ok {
+			attendee.Status = previousStatus
+		}
+		if attendee.Status == "" {
+			attendee.Status = rsvpNeedsAction
+		}
+		result = append(result, attendee)
+	}
+	return result
+}
+
+// calendarPermission право пользователя на общий календарь события, вызывается под блокировкой
+func (c *Calendar) calendarPermission(event Event, userID string) string {
+	if event.CalendarID == "" {
+		return ""
+	}
+	return c.shared[event.CalendarID].permission(userID)
+}
+
+// canRead проверяет, может ли пользователь видеть событие, вызывается под блокировкой
+func (c *Calendar) canRead(event Event, userID string) bool {
+	if event.UserID == userID || c.calendarPermission(event, userID) != "" {
+		return true
+	}
+	_, ok := event.attendee(userID)
+	return ok
+}
+
+// listed проверяет, показывать ли событие в запросах пользователя за период, вызывается под блокировкой.
+// Отказавшийся участник событие не видит
+func (c *Calendar) listed(event Event, userID string) bool {
+	if event.UserID == userID || c.calendarPermission(event, userID) != "" {
+		return true
+	}
+	attendee, ok := event.attendee(userID)
+	return ok && attendee.Status != rsvpDeclined
+}
+
+// canWrite проверяет, может ли пользователь менять событие, вызывается под блокировкой
+func (c *Calendar) canWrite(event Event, userID string) bool {
+	return event.UserID == userID || c.calendarPermission(event, userID) == permissionWrite
+}
+
+// writable находит событие id, которое пользователь может менять. Чужое видимое событие - ErrForbidden,
+// невидимое - ErrNotFound. Вызывается под блокировкой
+func (c *Calendar) writable(id, userID string) (Event, error) {
+	event, ok := c.find(id)
+	switch {
+	case !ok || !c.canRead(event, userID):
+		return Event{}, ErrNotFound
+	case !c.canWrite(event, userID):
+		return Event{}, ErrForbidden
+	}
+	return event, nil
+}
+
+// checkCalendar проверяет, что пользователь может класть события в общий календарь, вызывается под блокировкой
+func (c *Calendar) checkCalendar(calendarID, userID string) error {
+	if calendarID == "" {
+		return nil
+	}
+	shared, ok := c.shared[calendarID]
+	if !ok || shared.permission(userID) == "" {
+		return invalid("calendar_id", "unknown calendar")
+	}
+	if shared.permission(userID) != permissionWrite {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// audience пользователи, которым нужно сообщить об изменении события, вызывается под блокировкой
+func (c *Calendar) audience(event Event) []string {
+	users := []string{event.UserID}
+	for _, attendee := range event.Attendees {
+		users = append(users, attendee.UserID)
+	}
+	if shared, ok := c.shared[event.CalendarID]; ok && event.CalendarID != "" {
+		users = append(users, shared.OwnerID)
+		for userID := range shared.Grants {
+			users = append(users, userID)
+		}
+	}
+	return users
+}
+
+// CanRead проверяет, может ли пользователь видеть событие
+func (c *Calendar) CanRead(event Event, userID string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.canRead(event, userID)
+}
+
+// RSVP сохраняет ответ участника на приглашение в событие id
+func (c *Calendar) RSVP(ctx context.Context, id, userID, status string) (Event, error) {
+	switch status {
+	case rsvpAccepted, rsvpDeclined, rsvpTentative:
+	default:
+		return Event{}, invalid("status", "must be accepted, declined or tentative")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, userID))
+
+	event, ok := c.find(id)
+	if !ok {
+		return Event{}, ErrNotFound
+	}
+	if _, ok = event.attendee(userID); !ok {
+		return Event{}, ErrNotFound
+	}
+
+	attendees := make([]Attendee, len(event.Attendees))
+	for i, attendee := range event.Attendees {
+		if attendee.UserID == userID {
+			attendee.Status = status
+		}
+		attendees[i] = attendee
+	}
+	event.Attendees = attendees
+
+	if err := c.save(&event); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// OpenSharedCalendars загружает общие календари из файла path и дальше сохраняет их туда.
+// Пустой path - календари хранятся только в памяти
+func (c *Calendar) OpenSharedCalendars(path string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.sharedFile = path
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var calendars []SharedCalendar
+	if err = json.Unmarshal(data, &calendars); err != nil {
+		return err
+	}
+	for _, shared := range calendars {
+		c.shared[shared.ID] = shared
+	}
+	return nil
+}
+
+// saveShared атомарно записывает общие календари, вызывается под блокировкой
+func (c *Calendar) saveShared() error {
+	if c.sharedFile == "" {
+		return nil
+	}
+
+	calendars := make([]SharedCalendar, 0, len(c.shared))
+	for _, shared := range c.shared {
+		calendars = append(calendars, shared)
+	}
+	sort.Slice(calendars, func(i, j int) bool { return calendars[i].ID < calendars[j].ID })
+
+	data, err := json.Marshal(calendars)
+	if err != nil {
+		return err
+	}
+	tmp := c.sharedFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.sharedFile)
+}
+
+// CreateSharedCalendar создает общий календарь пользователя ownerID
+func (c *Calendar) CreateSharedCalendar(ownerID, name string) (SharedCalendar, error) {
+	if strings.TrimSpace(name) == "" {
+		return SharedCalendar{}, invalid("name", "is required")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	id, err := newEventID()
+	if err != nil {
+		return SharedCalendar{}, err
+	}
+	shared := SharedCalendar{ID: id, Name: name, OwnerID: ownerID}
+	c.shared[id] = shared
+	if err = c.saveShared(); err != nil {
+		delete(c.shared, id)
+		return SharedCalendar{}, err
+	}
+	return shared, nil
+}
+
+// ShareCalendar выдает пользователю granteeID право permission на календарь, none отзывает доступ.
+// Менять права может только владелец календаря
+func (c *Calendar) ShareCalendar(calendarID, ownerID, granteeID, permission string) (SharedCalendar, error) {
+	switch permission {
+	case permissionRead, permissionWrite, permissionNone:
+	default:
+		return SharedCalendar{}, invalid("permission", "must be read, write or none")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	shared, ok := c.shared[calendarID]
+	if !ok || shared.permission(ownerID) == "" {
+		return SharedCalendar{}, ErrNotFound
+	}
+	if shared.OwnerID != ownerID {
+		return SharedCalendar{}, ErrForbidden
+	}
+	if granteeID == ownerID {
+		return SharedCalendar{}, invalid("grantee_id", "owner already has full access")
+	}
+
+	previous := shared
+	grants := make(map[string]string, len(shared.Grants)+1)
+	for userID, grant := range shared.Grants {
+		grants[userID] = grant
+	}
+	if permission == permissionNone {
+		delete(grants, granteeID)
+	} else {
+		grants[granteeID] = permission
+	}
+	shared.Grants = grants
+
+	c.shared[calendarID] = shared
+	if err := c.saveShared(); err != nil {
+		c.shared[calendarID] = previous
+		return SharedCalendar{}, err
+	}
+	return shared, nil
+}
+
+// SharedCalendars возвращает календари, которыми пользователь владеет или к которым у него есть доступ
+func (c *Calendar) SharedCalendars(userID string) []SharedCalendar {
+	c.RLock()
+	defer c.RUnlock()
+
+	result := []SharedCalendar{}
+	for _, shared := range c.shared {
+		if shared.permission(userID) != "" {
+			result = append(result, shared)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// sharedCalendarsPath файл общих календарей рядом с файловым хранилищем
+func sharedCalendarsPath(storageKind, dataDir string) string {
+	if storageKind != "file" {
+		return ""
+	}
+	return filepath.Join(dataDir, sharedCalendarsFile)
+}
+
+// parseUserParam парсит обязательный целочисленный параметр с ID пользователя
+func parseUserParam(r *http.Request, name string, verr *ValidationError) string {
+	userID := r.FormValue(name)
+	if _, err := strconv.Atoi(userID); err != nil {
+		verr.Add(name, "must be an integer")
+	}
+	return userID
+}
+
+func rsvpHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verr := &ValidationError{}
+	userID := parseUserParam(r, "user_id", verr)
+	id := r.FormValue("id")
+	if id == "" {
+		verr.Add("id", "is required")
+	}
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	event, err := calendarFrom(r.Context()).RSVP(r.Context(), id, userID, r.FormValue("status"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, event)
+}
+
+func createCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verr := &ValidationError{}
+	userID := parseUserParam(r, "user_id", verr)
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	shared, err := calendarFrom(r.Context()).CreateSharedCalendar(userID, r.FormValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, shared)
+}
+
+func shareCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verr := &ValidationError{}
+	userID := parseUserParam(r, "user_id", verr)
+	granteeID := parseUserParam(r, "grantee_id", verr)
+	calendarID := r.FormValue("calendar_id")
+	if calendarID == "" {
+		verr.Add("calendar_id", "is required")
+	}
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	shared, err := calendarFrom(r.Context()).ShareCalendar(calendarID, userID, granteeID, r.FormValue("permission"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, shared)
+}
+
+func calendarsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	verr := &ValidationError{}
+	userID := parseUserParam(r, "user_id", verr)
+	if err := verr.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	writeResult(w, calendarFrom(r.Context()).SharedCalendars(userID))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Storage хранилище событий календаря, события адресуются по ID.
+// Методы вызываются под блокировкой календаря
+type Storage interface {
+	// Load возвращает все сохраненные события
+	Load() ([]Event, error)
+	// Put добавляет событие или заменяет событие с тем же ID
+	Put(event Event) error
+	// Delete удаляет событие по ID
+	Delete(id string) error
+	Close() error
+}
+
+// openStorage создает хранилище по названию из флага -storage
+func openStorage(kind, dir string) (Storage, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStorage(), nil
+	case "file":
+		return newFileStorage(dir, defaultSnapshotEvery)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", kind)
+	}
+}
+
+// хранилище в памяти, данные теряются при перезапуске
+type memoryStorage struct {
+	events map[string]Event
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{events: make(map[string]Event)}
+}
+
+func (s *memoryStorage) Load() ([]Event, error) {
+	result := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		result = append(result, event)
+	}
+	return result, nil
+}
+
+func (s *memoryStorage) Put(event Event) error {
+	s.events[event.ID] = event
+	return nil
+}
+
+func (s *memoryStorage) Delete(id string) error {
+	delete(s.events, id)
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// apply применяет запись журнала
+func (s *memoryStorage) apply(record journalRecord) {
+	switch record.Op {
+	case opPut:
+		if record.Event != nil {
+			s.Put(*record.Event)
+		}
+	case opDelete:
+		s.Delete(record.ID)
+	}
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+
+	defaultSnapshotEvery = 1000
+)
+
+/*
+Версии формата файлов:
+
+	1  снимок - объект дата -> события без ID, запись журнала {"date", "events"} задает все события даты
+	2  снимок {"version": 2, "events": [...]}, запись журнала {"op", "event", "id"} меняет одно событие.
+	   Снимок без версии в виде массива событий тоже читается как версия 2
+
+Файлы версии 1 переводятся в версию 2 при открытии хранилища: событиям выдаются ID,
+записывается снимок версии 2, журнал очищается.
+*/
+const storageVersion = 2
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// запись журнала: сохранение события целиком или удаление по ID
+type journalRecord struct {
+	Op    string `json:"op"`
+	Event *Event `json:"event,omitempty"`
+	ID    string `json:"id,omitempty"`
+
+	// запись версии 1, читается только при миграции
+	Date   string  `json:"date,omitempty"`
+	Events []Event `json:"events,omitempty"`
+}
+
+// снимок версии 2
+type snapshotData struct {
+	Version int     `json:"version"`
+	Events  []Event `json:"events"`
+}
+
+// файловое хранилище: журнал изменений, в который только дописываются записи,
+// и снимок состояния, который периодически заменяет журнал
+type fileStorage struct {
+	memory        *memoryStorage
+	dir           string
+	journal       *os.File
+	size          int64 // длина журнала до конца последней целой записи
+	records       int
+	snapshotEvery int
+
+	// события по датам из файлов версии 1, nil - миграция не нужна
+	legacy map[string][]Event
+}
+
+// newFileStorage восстанавливает состояние из снимка и журнала в dir
+func newFileStorage(dir string, snapshotEvery int) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStorage{
+		memory:        newMemoryStorage(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayJournal(); err != nil {
+		return nil, err
+	}
+	if err := s.migrate(); err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		events []Event
+		fields map[string]json.RawMessage
+	)
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &events)
+	} else if err = json.Unmarshal(data, &fields); err == nil {
+		if _, ok := fields["version"]; ok {
+			var snapshot snapshotData
+			if err = json.Unmarshal(data, &snapshot); err == nil && snapshot.Version != storageVersion {
+				return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+			}
+			events = snapshot.Events
+		} else {
+			s.legacy = make(map[string][]Event, len(fields))
+			err = json.Unmarshal(data, &s.legacy)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("corrupted snapshot: %w", err)
+	}
+
+	for _, event := range events {
+		s.memory.Put(event)
+	}
+	return nil
+}
+
+// replayJournal применяет записи журнала поверх снимка. Недописанная при падении
+// последняя запись без перевода строки отбрасывается, журнал обрезается до последней целой записи.
+// Испорченная запись с переводом строки - это уже не обрыв записи: журнал не трогается, возвращается ошибка
+func (s *fileStorage) replayJournal() error {
+	journal, err := os.OpenFile(filepath.Join(s.dir, journalFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var valid int64
+	reader := bufio.NewReader(journal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			journal.Close()
+			return err
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			journal.Close()
+			return fmt.Errorf("corrupted journal record %d: %w", s.records+1, err)
+		}
+		if record.Op == "" {
+			s.applyLegacy(record)
+		} else {
+			s.memory.apply(record)
+		}
+		valid += int64(len(line))
+		s.records++
+	}
+
+	if err = journal.Truncate(valid); err != nil {
+		journal.Close()
+		return err
+	}
+	if _, err = journal.Seek(valid, io.SeekStart); err != nil {
+		journal.Close()
+		return err
+	}
+
+	s.journal = journal
+	s.size = valid
+	return nil
+}
+
+// applyLegacy применяет запись версии 1: события даты заменяются целиком
+func (s *fileStorage) applyLegacy(record journalRecord) {
+	if s.legacy == nil {
+		s.legacy = make(map[string][]Event)
+	}
+	if len(record.Events) == 0 {
+		delete(s.legacy, record.Date)
+		return
+	}
+	s.legacy[record.Date] = record.Events
+}
+
+// migrate переводит события из файлов версии 1 в версию 2 и сразу записывает снимок,
+// чтобы старые записи журнала не применились повторно
+func (s *fileStorage) migrate() error {
+	if s.legacy == nil {
+		return nil
+	}
+
+	for date, events := range s.legacy {
+		for _, event := range events {
+			id, err := newEventID()
+			if err != nil {
+				return err
+			}
+			event.ID = id
+			if event.Date == "" {
+				event.Date = date
+			}
+			s.memory.Put(event)
+		}
+	}
+	if err := s.snapshot(); err != nil {
+		return fmt.Errorf("migrate storage to version %d: %w", storageVersion, err)
+	}
+	s.legacy = nil
+	return nil
+}
+
+func (s *fileStorage) Load() ([]Event, error) {
+	return s.memory.Load()
+}
+
+func (s *fileStorage) Put(event Event) error {
+	return s.write(journalRecord{Op: opPut, Event: &event})
+}
+
+func (s *fileStorage) Delete(id string) error {
+	return s.write(journalRecord{Op: opDelete, ID: id})
+}
+
+// write дописывает запись в журнал и только после fsync применяет ее в памяти.
+// Если запись не удалась, журнал обрезается до прежней длины, чтобы недописанная
+// строка не оказалась в середине журнала перед следующими записями
+func (s *fileStorage) write(record journalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	if _, err = s.journal.Write(line); err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		return errors.Join(err, s.rollback())
+	}
+	s.memory.apply(record)
+	s.size += int64(len(line))
+
+	// запись уже в журнале и применится при перезапуске, поэтому неудачный снимок
+	// не ошибка операции: журнал остается, снимок повторится со следующей записью
+	s.records++
+	if s.records >= s.snapshotEvery {
+		if err = s.snapshot(); err != nil {
+			slog.Error("failed to write snapshot", "dir", s.dir, "error", err)
+		}
+	}
+	return nil
+}
+
+// rollback отрезает от журнала все, что дописано после последней целой записи
+func (s *fileStorage) rollback() error {
+	if err := s.journal.Truncate(s.size); err != nil {
+		return err
+	}
+	_, err := s.journal.Seek(s.size, io.SeekStart)
+	return err
+}
+
+// snapshot записывает текущее состояние во временный файл, атомарно подменяет
+// им снимок и очищает журнал. Если упасть между подменой и очисткой, повторное
+// применение журнала ничего не испортит: каждая запись целиком задает событие
+func (s *fileStorage) snapshot() error {
+	events, _ := s.memory.Load()
+	data, err := json.Marshal(snapshotData{Version: storageVersion, Events: events})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if err = s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.size, s.records = 0, 0
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	if err := s.journal.Sync(); err != nil {
+		s.journal.Close()
+		return err
+	}
+	return s.journal.Close()
+}
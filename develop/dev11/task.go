@@ -1,13 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -33,376 +43,937 @@ import (
 	4. Код должен проходить проверки go vet и golint.
 */
 
+// Event событие календаря. Date - дата начала в зоне события, Start и End - границы события,
+// у события на весь день это полночь Date и следующая полночь в зоне TimeZone
 type Event struct {
-	UserID      string `json:"user_id"`
-	Date        string `json:"date"`
-	Description string `json:"description"`
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Date        string    `json:"date"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	TimeZone    string    `json:"time_zone"`
+	AllDay      bool      `json:"all_day"`
+	Description string    `json:"description"`
+
+	RRule        string   `json:"rrule,omitempty"`
+	ExDates      []string `json:"exdates,omitempty"`
+	SeriesID     string   `json:"series_id,omitempty"`
+	RecurrenceID string   `json:"recurrence_id,omitempty"`
+	UID          string   `json:"uid,omitempty"`
+	Reminders    []int    `json:"reminders,omitempty"`
+
+	Attendees  []Attendee `json:"attendees,omitempty"`
+	CalendarID string     `json:"calendar_id,omitempty"`
+
+	// Version растет при каждом изменении события и отдается в ETag.
+	// В запросе на изменение ненулевая Version - ожидаемая текущая версия (If-Match)
+	Version int64 `json:"version"`
 }
 
+// parseEventParams парсит параметры события, ошибки всех полей собираются в один *ValidationError
 func parseEventParams(r *http.Request) (*Event, error) {
 	err := r.ParseForm()
 	if err != nil {
+		return nil, invalid("body", "malformed form")
+	}
+
+	verr := &ValidationError{}
+	if _, err = strconv.Atoi(r.FormValue("user_id")); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+
+	description := r.FormValue("description")
+
+	event := &Event{
+		ID:          r.FormValue("id"),
+		UserID:      r.FormValue("user_id"),
+		Description: description,
+		RRule:       r.FormValue("rrule"),
+		Attendees:   parseAttendees(r.FormValue("attendees")),
+		CalendarID:  r.FormValue("calendar_id"),
+	}
+	if exdate := r.FormValue("exdate"); exdate != "" {
+		event.ExDates = strings.Split(exdate, ",")
+	}
+	if event.Reminders, err = parseReminders(r.FormValue("reminders")); err != nil {
+		verr.Add("reminders", err.Error())
+	}
+
+	timing := eventTiming{
+		Date:     r.FormValue("date"),
+		Start:    r.FormValue("start"),
+		End:      r.FormValue("end"),
+		Duration: r.FormValue("duration"),
+		TimeZone: r.FormValue("tz"),
+	}
+	if err = timing.apply(event); err != nil {
+		verr.Merge("date", err)
+	}
+	if err = validateRecurrence(event); err != nil {
+		verr.Merge("rrule", err)
+	}
+
+	if err = verr.Err(); err != nil {
 		return nil, err
 	}
+	return event, nil
+}
+
+// parseOccurrence парсит необязательный параметр occurrence - дату вхождения повторяющегося события,
+// с которым работает запрос. Без него запрос относится ко всей серии
+func parseOccurrence(r *http.Request) (string, error) {
+	occurrence := r.FormValue("occurrence")
+	if occurrence == "" {
+		return "", nil
+	}
+
+	if _, err := time.Parse(dateLayout, occurrence); err != nil {
+		return "", invalid("occurrence", "expected YYYY-MM-DD")
+	}
+	return occurrence, nil
+}
 
-	_, err = strconv.Atoi(r.FormValue("user_id"))
+// parseUpdateParams парсит параметры /update_event, id события обязателен
+func parseUpdateParams(r *http.Request) (*Event, error) {
+	event, err := parseEventParams(r)
 	if err != nil {
 		return nil, err
 	}
 
-	date := r.FormValue("date")
-	if _, err = time.Parse("2006-01-02", date); err != nil {
+	if event.ID == "" {
+		return nil, invalid("id", "is required")
+	}
+	return event, nil
+}
+
+// parseEventRef парсит id и user_id, которыми адресуется существующее событие
+func parseEventRef(r *http.Request) (*Event, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, invalid("body", "malformed form")
+	}
+
+	verr := &ValidationError{}
+	if _, err = strconv.Atoi(r.FormValue("user_id")); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		verr.Add("id", "is required")
+	}
+	if err = verr.Err(); err != nil {
 		return nil, err
 	}
-	description := r.FormValue("description")
 
-	return &Event{
-		UserID:      r.FormValue("user_id"),
-		Date:        date,
-		Description: description,
-	}, nil
+	return &Event{ID: id, UserID: r.FormValue("user_id")}, nil
+}
+
+// validate проверяет событие перед сохранением, ошибки возвращаются как *ValidationError
+func (e Event) validate() error {
+	verr := &ValidationError{}
+	if _, err := strconv.Atoi(e.UserID); err != nil {
+		verr.Add("user_id", "must be an integer")
+	}
+	if _, err := time.Parse(dateLayout, e.Date); err != nil {
+		verr.Add("date", "expected YYYY-MM-DD")
+	}
+	if e.End.Before(e.Start) {
+		verr.Add("end", errEndBeforeStart.Error())
+	}
+	if err := validateRecurrence(&e); err != nil {
+		verr.Merge("rrule", err)
+	}
+	if err := validateReminders(e.Reminders); err != nil {
+		verr.Add("reminders", err.Error())
+	}
+	if err := validateAttendees(e.Attendees); err != nil {
+		verr.Add("attendees", err.Error())
+	}
+	return verr.Err()
 }
 
+// Calendar хранит события в памяти поверх Storage. Events - события по датам начала,
+// days - упорядоченный список этих дат для запросов по диапазону, recurring - ID повторяющихся серий,
+// которые могут начинаться задолго до окна запроса и проверяются отдельно, shared - общие календари,
+// weekStart - первый день недели для GetEventsWeek, audit - журнал изменений,
+// maxEvents - квота арендатора на число событий, 0 - без ограничения
 type Calendar struct {
-	Events map[string][]Event
+	Events    map[string][]Event
+	days      []string
+	dates     map[string]string
+	recurring map[string]bool
+	longest   time.Duration
+	storage   Storage
+	feed      *ChangeFeed
+
+	shared     map[string]SharedCalendar
+	sharedFile string
+	search     *searchIndex
+	weekStart  time.Weekday
+	audit      *auditLog
+	maxEvents  int
+
+	// onChange вызывается под блокировкой после каждого изменения и не должен блокироваться
+	onChange func()
 	sync.RWMutex
 }
 
 type APIResponse struct {
-	Result interface{} `json:"result,omitempty"`
-	Error  string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
 }
 
-var cache = Calendar{Events: make(map[string][]Event)}
+// NewCalendar загружает события из хранилища
+func NewCalendar(storage Storage) (*Calendar, error) {
+	events, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
 
-func (c *Calendar) AddEvent(data Event) {
-	date := data.Date
-	c.Lock()
-	defer c.Unlock()
-	c.Events[date] = append(c.Events[date], data)
+	c := &Calendar{
+		Events:    make(map[string][]Event),
+		dates:     make(map[string]string),
+		recurring: make(map[string]bool),
+		storage:   storage,
+		feed:      NewChangeFeed(changeHistory),
+		shared:    make(map[string]SharedCalendar),
+		search:    newSearchIndex(),
+		weekStart: time.Monday,
+		audit:     &auditLog{history: auditHistory},
+	}
+	for _, event := range events {
+		event.fillLegacyTime()
+		if event.Version == 0 {
+			event.Version = 1
+		}
+		c.index(event)
+	}
+	return c, nil
 }
 
-func (c *Calendar) DeleteEvent(data Event) bool {
-	var updatedEvents []Event
-	var lenEvents int
+// newEventID генерирует случайный ID события
+func newEventID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
 
-	c.RLock()
+// index добавляет событие в индекс по датам и в поисковый индекс
+func (c *Calendar) index(event Event) {
+	c.search.add(event)
 
-	if events, ok := c.Events[data.Date]; ok {
-		lenEvents = len(events)
-		for _, event := range events {
-			if event.UserID != data.UserID {
-				updatedEvents = append(updatedEvents, event)
-			}
+	if _, ok := c.Events[event.Date]; !ok {
+		i := sort.SearchStrings(c.days, event.Date)
+		c.days = slices.Insert(c.days, i, event.Date)
+	}
+	c.Events[event.Date] = append(c.Events[event.Date], event)
+	c.dates[event.ID] = event.Date
+
+	if event.RRule != "" {
+		c.recurring[event.ID] = true
+	} else if duration := event.End.Sub(event.Start); duration > c.longest {
+		c.longest = duration
+	}
+}
+
+// unindex убирает событие из индекса по датам и из поискового индекса
+func (c *Calendar) unindex(id string) {
+	c.search.remove(id)
+
+	date := c.dates[id]
+	delete(c.dates, id)
+	delete(c.recurring, id)
+
+	var updatedEvents []Event
+	for _, event := range c.Events[date] {
+		if event.ID != id {
+			updatedEvents = append(updatedEvents, event)
 		}
 	}
-	c.RUnlock()
 
-	if lenEvents != len(updatedEvents) {
-		c.Lock()
-		c.Events[data.Date] = updatedEvents
-		c.Unlock()
-		return true
+	if len(updatedEvents) == 0 {
+		delete(c.Events, date)
+		if i, ok := slices.BinarySearch(c.days, date); ok {
+			c.days = slices.Delete(c.days, i, i+1)
+		}
+		return
+	}
+	c.Events[date] = updatedEvents
+}
+
+// find ищет событие по ID, вызывается под блокировкой
+func (c *Calendar) find(id string) (Event, bool) {
+	date, ok := c.dates[id]
+	if !ok {
+		return Event{}, false
 	}
 
-	return false
+	for _, event := range c.Events[date] {
+		if event.ID == id {
+			return event, true
+		}
+	}
+	return Event{}, false
 }
 
-func (c *Calendar) UpdateEvent(data Event) bool {
-	if events, ok := c.Events[data.Date]; ok {
-		for i, event := range events {
-			if event.UserID == data.UserID {
-				c.Events[data.Date][i] = data
-				return true
-			}
+// newID генерирует ID, которого еще нет в календаре, вызывается под блокировкой
+func (c *Calendar) newID() (string, error) {
+	for {
+		id, err := newEventID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := c.dates[id]; !ok {
+			return id, nil
 		}
 	}
+}
 
-	return false
+// save сохраняет новое или измененное событие в хранилище и индексе, проставляет ему следующую версию
+// и записывает изменение в журнал аудита. Версия не меньше event.Version, чтобы восстановленное
+// после удаления событие продолжило нумерацию. Новое событие сверх maxEvents - *QuotaError
+func (c *Calendar) save(event *Event) error {
+	previous, exists := c.find(event.ID)
+	if !exists && c.maxEvents > 0 && len(c.dates) >= c.maxEvents {
+		return &QuotaError{MaxEvents: c.maxEvents}
+	}
+	version := max(previous.Version, event.Version) + 1
+	stored := *event
+	stored.Version = version
+	if err := c.storage.Put(stored); err != nil {
+		return err
+	}
+	event.Version = version
+
+	kind := changeCreated
+	audience := c.audience(stored)
+	if exists {
+		// об изменении узнают и те, кто перестал быть участником
+		audience = append(audience, c.audience(previous)...)
+		c.unindex(event.ID)
+		kind = changeUpdated
+		c.record(auditUpdate, &previous, &stored)
+	} else {
+		c.record(auditCreate, nil, &stored)
+	}
+	c.index(stored)
+	c.changed(kind, stored, audience)
+	return nil
 }
 
-func (c *Calendar) GetEventsDay(data Event) []Event {
-	var result []Event
+// SetMaxEvents меняет квоту на число событий, 0 - без ограничения. Уже сохраненные события не удаляются
+func (c *Calendar) SetMaxEvents(n int) {
+	c.Lock()
+	defer c.Unlock()
 
+	c.maxEvents = n
+}
+
+// Count число сохраненных событий, серия считается одним событием
+func (c *Calendar) Count() int {
 	c.RLock()
 	defer c.RUnlock()
 
-	for _, event := range c.Events[data.Date] {
-		if event.UserID == data.UserID {
-			result = append(result, event)
-		}
+	return len(c.dates)
+}
+
+// checkVersion проверяет ожидаемую версию события, нулевая expected подходит к любой
+func checkVersion(event Event, expected int64) error {
+	if expected != 0 && expected != event.Version {
+		return ErrVersionMismatch
 	}
+	return nil
+}
 
-	return result
+// changed сообщает об изменении события планировщику и подписчикам ленты изменений
+func (c *Calendar) changed(kind string, event Event, audience []string) {
+	c.feed.Publish(kind, event, audience)
+	if c.onChange != nil {
+		c.onChange()
+	}
 }
 
-func (c *Calendar) GetEventsWeek(data Event) []Event {
-	eventDate, _ := time.Parse("2006-01-02", data.Date)
-	weekday := eventDate.Weekday()
-	startWeek := eventDate.AddDate(0, 0, -int(weekday))
+// remove удаляет событие из хранилища и индекса
+func (c *Calendar) remove(id string) error {
+	event, _ := c.find(id)
+	if err := c.storage.Delete(id); err != nil {
+		return err
+	}
+	c.unindex(id)
+	c.record(auditDelete, &event, nil)
+	c.changed(changeDeleted, event, c.audience(event))
+	return nil
+}
 
-	endWeek := startWeek.AddDate(0, 0, 7)
-	var result []Event
+// AddEvent сохраняет событие под новым ID и возвращает его
+func (c *Calendar) AddEvent(ctx context.Context, data Event) (Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
 
-	c.RLock()
-	defer c.RUnlock()
+	return c.addEvent(data, false)
+}
 
-	for date, events := range c.Events {
-		eventDate, _ := time.Parse("2006-01-02", date)
+// AddEventNoConflicts сохраняет событие, только если оно не пересекается с другими событиями пользователя,
+// иначе возвращает *ConflictError со списком пересекающихся событий
+func (c *Calendar) AddEventNoConflicts(ctx context.Context, data Event) (Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
 
-		if eventDate.After(startWeek) && eventDate.Before(endWeek) {
-			for _, event := range events {
-				if event.UserID == data.UserID {
-					result = append(result, event)
-				}
-			}
+	return c.addEvent(data, true)
+}
+
+// addEvent сохраняет событие под новым ID, вызывается под блокировкой
+func (c *Calendar) addEvent(data Event, rejectConflicts bool) (Event, error) {
+	if err := data.validate(); err != nil {
+		return Event{}, err
+	}
+	if err := c.checkCalendar(data.CalendarID, data.UserID); err != nil {
+		return Event{}, err
+	}
+	data.Attendees = mergeAttendees(data.UserID, data.Attendees, nil)
+
+	if rejectConflicts {
+		if ids := c.conflicts(data); len(ids) > 0 {
+			return Event{}, &ConflictError{IDs: ids}
 		}
 	}
 
-	return result
-}
+	id, err := c.newID()
+	if err != nil {
+		return Event{}, err
+	}
+	data.ID = id
 
-func (c *Calendar) GetEventsMonth(data Event) []Event {
-	eventDate, _ := time.Parse("2006-01-02", data.Date)
+	if err = c.save(&data); err != nil {
+		return Event{}, err
+	}
+	return data, nil
+}
 
-	startMonth := time.Date(eventDate.Year(), eventDate.Month(), 1, 0, 0, 0, 0, time.UTC)
-	endMonth := startMonth.AddDate(0, 1, 0)
-	var result []Event
+// DeleteEvent удаляет событие data.ID, если data.UserID может его менять.
+// Вместе с повторяющимся событием удаляются и его измененные вхождения
+func (c *Calendar) DeleteEvent(ctx context.Context, data Event) error {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
 
-	c.RLock()
-	defer c.RUnlock()
+	return c.deleteEvent(data)
+}
 
-	for date, events := range c.Events {
-		eventDate, _ := time.Parse("2006-01-02", date)
+// deleteEvent удаляет событие и его измененные вхождения, вызывается под блокировкой
+func (c *Calendar) deleteEvent(data Event) error {
+	event, err := c.writable(data.ID, data.UserID)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(event, data.Version); err != nil {
+		return err
+	}
 
-		if eventDate.After(startMonth) && eventDate.Before(endMonth) {
-			for _, event := range events {
-				if event.UserID == data.UserID {
-					result = append(result, event)
+	if event.RRule != "" {
+		for _, events := range c.Events {
+			for _, exception := range events {
+				if exception.SeriesID != event.ID {
+					continue
+				}
+				if err := c.remove(exception.ID); err != nil {
+					return err
 				}
 			}
 		}
 	}
 
-	return result
+	return c.remove(data.ID)
 }
 
-func createEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+// UpdateEvent заменяет событие data.ID, в том числе переносит его на другую дату.
+// Для повторяющегося события меняется вся серия, исключенные даты сохраняются, если не переданы новые.
+// Владелец события не меняется, участники и календарь сохраняются, если не переданы новые.
+// Возвращает сохраненное событие с новой версией
+func (c *Calendar) UpdateEvent(ctx context.Context, data Event) (Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
+
+	return c.updateEvent(data)
+}
+
+// updateEvent заменяет событие, вызывается под блокировкой
+func (c *Calendar) updateEvent(data Event) (Event, error) {
+	if err := data.validate(); err != nil {
+		return Event{}, err
 	}
 
-	event, err := parseEventParams(r)
+	event, err := c.writable(data.ID, data.UserID)
 	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+		return Event{}, err
+	}
+	if err = checkVersion(event, data.Version); err != nil {
+		return Event{}, err
+	}
+	if data.CalendarID == "" {
+		data.CalendarID = event.CalendarID
+	} else if data.CalendarID != event.CalendarID {
+		if err = c.checkCalendar(data.CalendarID, data.UserID); err != nil {
+			return Event{}, err
+		}
+	}
+	if data.Attendees == nil {
+		data.Attendees = event.Attendees
 	}
+	data.UserID = event.UserID
+	data.Attendees = mergeAttendees(data.UserID, data.Attendees, event.Attendees)
 
-	cache.AddEvent(*event)
+	if data.RRule != "" && len(data.ExDates) == 0 {
+		data.ExDates = event.ExDates
+	}
+	data.SeriesID = event.SeriesID
+	data.RecurrenceID = event.RecurrenceID
+	data.UID = event.UID
 
-	response := APIResponse{Result: "Successfully added event"}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if err = c.save(&data); err != nil {
+		return Event{}, err
+	}
+	return data, nil
 }
 
-func updateEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+// UpdateOccurrence изменяет одно вхождение occurrence серии data.ID: вхождение исключается из серии
+// и сохраняется отдельным событием, которое возвращается
+func (c *Calendar) UpdateOccurrence(ctx context.Context, data Event, occurrence string) (Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
+
+	return c.updateOccurrence(data, occurrence)
+}
+
+// updateOccurrence изменяет вхождение серии, вызывается под блокировкой
+func (c *Calendar) updateOccurrence(data Event, occurrence string) (Event, error) {
+	if err := data.validate(); err != nil {
+		return Event{}, err
 	}
 
-	event, err := parseEventParams(r)
+	series, err := c.writable(data.ID, data.UserID)
 	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+		return Event{}, err
+	}
+	if err = checkVersion(series, data.Version); err != nil {
+		return Event{}, err
+	}
+	if series.RRule == "" || !series.occursOn(occurrence) {
+		return Event{}, ErrNotFound
 	}
 
-	if cache.UpdateEvent(*event) {
-		response := APIResponse{Result: "Event updated successfully"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
-		return
+	id, err := c.newID()
+	if err != nil {
+		return Event{}, err
+	}
+	exception := data
+	exception.ID = id
+	exception.UserID = series.UserID
+	exception.CalendarID = series.CalendarID
+	if exception.Attendees == nil {
+		exception.Attendees = series.Attendees
 	}
+	exception.Attendees = mergeAttendees(series.UserID, exception.Attendees, series.Attendees)
+	exception.RRule = ""
+	exception.ExDates = nil
+	exception.SeriesID = series.ID
+	exception.RecurrenceID = occurrence
+	exception.UID = series.uid()
+	exception.Version = 0
+
+	// сначала сохраняем вхождение, чтобы при сбое между записями оно не потерялось
+	if err = c.save(&exception); err != nil {
+		return Event{}, err
+	}
+	series.ExDates = append(append([]string(nil), series.ExDates...), occurrence)
+	if err = c.save(&series); err != nil {
+		return Event{}, err
+	}
+	return exception, nil
+}
+
+// DeleteOccurrence исключает вхождение occurrence из серии data.ID
+func (c *Calendar) DeleteOccurrence(ctx context.Context, data Event, occurrence string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.begin(actorFrom(ctx, data.UserID))
 
-	response := APIResponse{Error: "Event not found"}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	json.NewEncoder(w).Encode(response)
+	return c.deleteOccurrence(data, occurrence)
 }
 
-func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+// deleteOccurrence исключает вхождение из серии, вызывается под блокировкой
+func (c *Calendar) deleteOccurrence(data Event, occurrence string) error {
+	series, err := c.writable(data.ID, data.UserID)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(series, data.Version); err != nil {
+		return err
+	}
+	if series.RRule == "" || !series.occursOn(occurrence) {
+		return ErrNotFound
+	}
+
+	series.ExDates = append(append([]string(nil), series.ExDates...), occurrence)
+	return c.save(&series)
+}
+
+// GetEvent возвращает событие по ID
+func (c *Calendar) GetEvent(id string) (Event, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.find(id)
+}
+
+// eventsBetween возвращает события, которые видит пользователь, пересекающиеся с окном [from, to).
+// Обычные события ищутся по упорядоченным датам начала: окно расширяется на самое длинное событие
+// и на сутки в каждую сторону, потому что дата начала считается в зоне события, а не в UTC.
+// Повторяющиеся события разворачиваются во вхождения внутри окна
+func (c *Calendar) eventsBetween(userID string, from, to time.Time) []Event {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.collect(from, to, func(event Event) bool {
+		return c.listed(event, userID)
+	})
+}
+
+// eventsIn возвращает события, в которых пользователь занят, пересекающиеся с окном [from, to).
+// Вызывается под блокировкой
+func (c *Calendar) eventsIn(userID string, from, to time.Time) []Event {
+	return c.collect(from, to, func(event Event) bool {
+		return event.attends(userID)
+	})
+}
+
+// collect возвращает подходящие под match события и вхождения, пересекающиеся с окном [from, to),
+// вызывается под блокировкой
+func (c *Calendar) collect(from, to time.Time, match func(Event) bool) []Event {
+	result := []Event{}
+
+	lower := from.Add(-c.longest).UTC().AddDate(0, 0, -1).Format(dateLayout)
+	upper := to.UTC().AddDate(0, 0, 1).Format(dateLayout)
+	for i := sort.SearchStrings(c.days, lower); i < len(c.days) && c.days[i] <= upper; i++ {
+		for _, event := range c.Events[c.days[i]] {
+			if event.RRule == "" && match(event) && event.inWindow(from, to) {
+				result = append(result, event)
+			}
+		}
+	}
+
+	for id := range c.recurring {
+		if event, ok := c.find(id); ok && match(event) {
+			result = append(result, event.expand(from, to)...)
+		}
+	}
+
+	sortEvents(result)
+	return result
+}
+
+// GetEventsDay возвращает события за день data.Date в зоне data.TimeZone
+func (c *Calendar) GetEventsDay(data Event) []Event {
+	return c.EventsFor(PeriodQuery{UserID: data.UserID, Period: periodDay, Day: startOfDay(data)})
+}
+
+// GetEventsWeek возвращает события за неделю, в которую входит data.Date, неделя начинается с WeekStart
+func (c *Calendar) GetEventsWeek(data Event) []Event {
+	return c.EventsFor(PeriodQuery{UserID: data.UserID, Period: periodWeek, Day: startOfDay(data), WeekStart: c.WeekStart()})
+}
+
+// GetEventsMonth возвращает события за месяц, в который входит data.Date
+func (c *Calendar) GetEventsMonth(data Event) []Event {
+	return c.EventsFor(PeriodQuery{UserID: data.UserID, Period: periodMonth, Day: startOfDay(data)})
+}
+
+func createEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
 	event, err := parseEventParams(r)
 	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, event.UserID) {
+		writeError(w, ErrForbidden)
 		return
 	}
 
-	if cache.DeleteEvent(*event) {
-		response := APIResponse{Result: "Event deleted successfully"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
+	calendar := calendarFrom(r.Context())
+	var created Event
+	if r.FormValue("reject_conflicts") == "true" {
+		created, err = calendar.AddEventNoConflicts(r.Context(), *event)
+	} else {
+		created, err = calendar.AddEvent(r.Context(), *event)
+	}
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	response := APIResponse{Error: "Event not found"}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	json.NewEncoder(w).Encode(response)
+	setETag(w, created)
+	writeResult(w, created)
 }
 
-func eventsForWeekHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+func updateEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
-	event, err := parseEventParams(r)
+	event, err := parseUpdateParams(r)
+	var occurrence string
+	if err == nil {
+		occurrence, err = parseOccurrence(r)
+	}
+	if err == nil {
+		event.Version, err = parseIfMatch(r)
+	}
 	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, event.UserID) {
+		writeError(w, ErrForbidden)
 		return
 	}
 
-	events := cache.GetEventsWeek(*event)
-
-	if len(events) == 0 {
-		response := APIResponse{Error: "No events found for the specified user and date"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	calendar := calendarFrom(r.Context())
+	var updated Event
+	if occurrence != "" {
+		updated, err = calendar.UpdateOccurrence(r.Context(), *event, occurrence)
+	} else {
+		updated, err = calendar.UpdateEvent(r.Context(), *event)
+	}
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	response := APIResponse{Result: events}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	setETag(w, updated)
+	writeResult(w, "Event updated successfully")
 }
 
-func eventsForDayHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
-	event, err := parseEventParams(r)
+	event, err := parseEventRef(r)
+	var occurrence string
+	if err == nil {
+		occurrence, err = parseOccurrence(r)
+	}
+	if err == nil {
+		event.Version, err = parseIfMatch(r)
+	}
 	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, event.UserID) {
+		writeError(w, ErrForbidden)
 		return
 	}
 
-	events := cache.GetEventsDay(*event)
-
-	if len(events) == 0 {
-		response := APIResponse{Error: "No events found for the specified user and date"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	calendar := calendarFrom(r.Context())
+	if occurrence != "" {
+		err = calendar.DeleteOccurrence(r.Context(), *event, occurrence)
+	} else {
+		err = calendar.DeleteEvent(r.Context(), *event)
+	}
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	response := APIResponse{Result: events}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	writeResult(w, "Event deleted successfully")
 }
 
-func eventsForMonthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		response := APIResponse{Error: "Wrong method"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
 		return
 	}
 
-	event, err := parseEventParams(r)
-	if err != nil {
-		response := APIResponse{Error: "Invalid parameters"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, invalid("id", "is required"))
 		return
 	}
 
-	events := cache.GetEventsMonth(*event)
-
-	if len(events) == 0 {
-		response := APIResponse{Error: "No events found for the specified user and date"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	event, ok := calendarFrom(r.Context()).GetEvent(id)
+	if !ok || !allowedEvent(r, event) {
+		writeError(w, ErrNotFound)
+		return
+	}
+	if notModified(w, r, event) {
 		return
 	}
 
-	response := APIResponse{Result: events}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	setETag(w, event)
+	writeResult(w, event)
 }
 
-func startServer(port string) {
+func newRouter() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/create_event", logger(createEventHandler))
-	mux.HandleFunc("/update_event", logger(updateEventHandler))
-	mux.HandleFunc("/delete_event", logger(deleteEventHandler))
+	route(mux, "/create_event", createEventHandler)
+	route(mux, "/update_event", updateEventHandler)
+	route(mux, "/delete_event", deleteEventHandler)
+	route(mux, "/event", eventHandler)
+	route(mux, "/events", eventsRangeHandler)
+	route(mux, "/events/stream", eventStreamHandler)
+	route(mux, "/events/ws", eventWebSocketHandler)
+	route(mux, "/events/batch", batchHandler)
+	route(mux, "/events/batch/stream", batchStreamHandler)
+	route(mux, "/freebusy", freeBusyHandler)
+	route(mux, "/reminders/dead_letters", deadLettersHandler)
+	route(mux, "/export.ics", exportHandler)
+	route(mux, "/import", importHandler)
+	route(mux, "/search", searchHandler)
+	route(mux, "/rsvp", rsvpHandler)
+	route(mux, "/calendars", calendarsHandler)
+	route(mux, "/calendars/create", createCalendarHandler)
+	route(mux, "/calendars/share", shareCalendarHandler)
+	route(mux, "/audit", auditHandler)
+	route(mux, "/undo", undoHandler)
+	route(mux, "/tenant", tenantHandler)
+	route(mux, "/metrics", metricsHandler)
+	mux.HandleFunc("/openapi.json", chain(openAPIHandler, requestID, logger, observe("/openapi.json"), rateLimit))
+
+	route(mux, "/events_for_day", eventsForDayHandler)
+	route(mux, "/events_for_week", eventsForWeekHandler)
+	route(mux, "/events_for_month", eventsForMonthHandler)
+
+	registerV2Routes(mux)
+	return mux
+}
 
-	mux.HandleFunc("/events_for_day", logger(eventsForDayHandler))
-	mux.HandleFunc("/events_for_week", logger(eventsForWeekHandler))
-	mux.HandleFunc("/events_for_month", logger(eventsForMonthHandler))
+// startServer обслуживает запросы до SIGINT или SIGTERM, после чего перестает принимать соединения
+// и ждет завершения текущих запросов не дольше cfg.ShutdownTimeout. Сервер JSON-RPC закрывается последним,
+// его подписчики получают changes.closed. Порт JSON-RPC занимается до запуска HTTP сервера,
+// а если один из серверов остановился с ошибкой, второй тоже останавливается
+func startServer(cfg Config) error {
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", cfg.Port),
+		Handler:      newRouter(),
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
 
-	log.Printf("Starting server on %s...\n", port)
-	log.Fatal(http.ListenAndServe(port, mux))
-}
+	// потоковые подписки не завершаются сами, их закрывает лента изменений
+	server.RegisterOnShutdown(tenants.CloseFeeds)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var rpcServer *RPCServer
+	if cfg.RPCPort != 0 {
+		var err error
+		if rpcServer, err = ListenRPC(fmt.Sprintf(":%d", cfg.RPCPort)); err != nil {
+			return err
+		}
+		defer rpcServer.Close()
+	}
 
-func logger(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%s] %s %s\n", r.Method, r.RequestURI, r.RemoteAddr)
-		next(w, r)
+	serveErr := make(chan error, 2)
+	go func() {
+		log.Printf("Starting server on %s...\n", server.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+	if rpcServer != nil {
+		go func() {
+			log.Printf("Starting JSON-RPC server on %s...\n", rpcServer.Addr())
+			serveErr <- rpcServer.Serve()
+		}()
 	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
 }
 
 func main() {
-	port := flag.Int("port", 8080, "Port for the server")
+	configPath := flag.String("config", defaultConfigFile, "Path to the JSON config file")
+	registerConfigFlags(flag.CommandLine)
+	issueToken := flag.String("issue-token", "", "Print a bearer token for the given user_id and exit")
+	tokenRole := flag.String("role", roleUser, "Role of the issued token: user or admin")
+	tokenTenant := flag.String("tenant", "", "Tenant of the issued token, empty for the default tenant")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "Lifetime of the issued token")
 	flag.Parse()
 
-	startServer(fmt.Sprintf(":%d", *port))
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+
+	cfg := defaultConfig()
+	if err := cfg.loadConfigFile(*configPath); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	cfg.applyFlags(flag.CommandLine)
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	authenticator = NewAuthenticator(cfg.APIKeys, cfg.TokenSecret)
+	if *issueToken != "" {
+		principal := Principal{UserID: *issueToken, Role: *tokenRole, Tenant: *tokenTenant}
+		if err := validatePrincipal(principal); err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := cfg.tenantQuotas()[principal.Tenant]; principal.Tenant != "" && !ok {
+			log.Fatalf("unknown tenant %q", principal.Tenant)
+		}
+		token, err := authenticator.IssueToken(principal, *tokenTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+	if !authenticator.Enabled() {
+		log.Println("Authentication is disabled: no api_keys or token_secret in the config")
+	}
+
+	limiter = NewRateLimiter(cfg.RateLimit, cfg.RateBurst, realClock{})
+	ipLimiter = NewRateLimiter(cfg.IPRateLimit, cfg.IPRateBurst, realClock{})
+	maxBodyBytes = cfg.MaxBodyBytes
+
+	notifier, err := openNotifier(cfg.Notifier, cfg.WebhookURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tenants, err = openTenants(cfg, notifier); err != nil {
+		log.Fatal(err)
+	}
+	tenants.Start()
+
+	serveErr := startServer(cfg)
+
+	// новые запросы уже не принимаются: останавливаем фоновые задачи и сбрасываем хранилища
+	tenants.Close()
+	if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+		log.Fatal(serveErr)
+	}
+	log.Println("Server stopped")
 }
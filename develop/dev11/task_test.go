@@ -1 +1,2277 @@
 package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wb-tech-level-2/develop/dev11/client"
+)
+
+// newTestEvent собирает событие пользователя userID длительностью час, начиная со start
+func newTestEvent(t testing.TB, userID, start, description string) Event {
+	t.Helper()
+
+	event := Event{UserID: userID, Description: description}
+	timing := eventTiming{Start: start, Duration: "1h", TimeZone: "UTC"}
+	if err := timing.apply(&event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// Файловое хранилище восстанавливается из снимка и журнала, отбрасывает недописанную
+// последнюю запись и не теряет записей, если снимок записать не удалось
+func TestFileStorageRecovery(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *fileStorage {
+		t.Helper()
+		storage, err := newFileStorage(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+	ids := func(storage *fileStorage) []string {
+		events, _ := storage.Load()
+		var result []string
+		for _, event := range events {
+			result = append(result, event.ID+":"+event.Description)
+		}
+		slices.Sort(result)
+		return result
+	}
+
+	storage := open()
+	for _, event := range []Event{{ID: "a", Description: "1"}, {ID: "b"}, {ID: "a", Description: "2"}, {ID: "c"}} {
+		if err := storage.Put(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	journal := filepath.Join(dir, journalFile)
+	before, _ := os.ReadFile(journal)
+	file, _ := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0o644)
+	file.WriteString(`{"op":"put","event":{"id":"d"`)
+	file.Close()
+
+	storage = open()
+	if got, want := ids(storage), []string{"a:2", "b:"}; !slices.Equal(got, want) {
+		t.Errorf("events after replay = %v, want %v", got, want)
+	}
+	if after, _ := os.ReadFile(journal); !bytes.Equal(after, before) {
+		t.Errorf("journal after replay = %q, want the torn record cut off: %q", after, before)
+	}
+
+	// снимок не записать: на месте временного файла каталог
+	if err := os.Mkdir(filepath.Join(dir, snapshotFile+".tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"e", "f"} {
+		if err := storage.Put(Event{ID: id}); err != nil {
+			t.Errorf("put %s with a failing snapshot: %v", id, err)
+		}
+	}
+	storage.Close()
+	storage = open()
+	if got, want := ids(storage), []string{"a:2", "b:", "e:", "f:"}; !slices.Equal(got, want) {
+		t.Errorf("events after failed snapshot = %v, want %v", got, want)
+	}
+	storage.Close()
+
+	// испорченная запись в середине журнала - не обрыв: ошибка, журнал не обрезается
+	file, _ = os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0o644)
+	file.WriteString("{\"op\":\"put\",\"event\":{\"id\"\n{\"op\":\"delete\",\"id\":\"a\"}\n")
+	file.Close()
+	before, _ = os.ReadFile(journal)
+	if _, err := newFileStorage(dir, 2); err == nil {
+		t.Error("open with a corrupted record in the middle of the journal: want error")
+	}
+	if after, _ := os.ReadFile(journal); !bytes.Equal(after, before) {
+		t.Errorf("journal after a failed open = %q, want it untouched: %q", after, before)
+	}
+}
+
+// Файлы версии 1 с событиями по датам переводятся в версию 2 при открытии
+func TestFileStorageMigration(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := `{"2026-10-19": [{"user_id": "1", "date": "2026-10-19", "description": "a"}]}`
+	journal := `{"date": "2026-10-19", "events": [{"user_id": "1", "date": "2026-10-19", "description": "a"}, {"user_id": "1", "date": "2026-10-19", "description": "b"}]}
+{"date": "2026-10-20", "events": [{"user_id": "2", "date": "2026-10-20", "description": "c"}]}
+{"date": "2026-10-20", "events": []}
+{"date": "2026-10-21", "events": [{"user_id": "2", "description": "d"}]}
+`
+	os.WriteFile(filepath.Join(dir, snapshotFile), []byte(snapshot), 0o644)
+	os.WriteFile(filepath.Join(dir, journalFile), []byte(journal), 0o644)
+
+	load := func() map[string]Event {
+		t.Helper()
+		storage, err := newFileStorage(dir, defaultSnapshotEvery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.Close()
+		events, _ := storage.Load()
+		result := make(map[string]Event)
+		for _, event := range events {
+			result[event.ID] = event
+		}
+		return result
+	}
+
+	migrated := load()
+	var got []string
+	for id, event := range migrated {
+		if id == "" {
+			t.Errorf("migrated event without ID: %+v", event)
+		}
+		got = append(got, event.Date+":"+event.Description)
+	}
+	slices.Sort(got)
+	if want := []string{"2026-10-19:a", "2026-10-19:b", "2026-10-21:d"}; !slices.Equal(got, want) {
+		t.Errorf("migrated events = %v, want %v", got, want)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if !strings.HasPrefix(string(data), `{"version":2,`) {
+		t.Errorf("snapshot after migration = %.40s, want version 2", data)
+	}
+	if data, _ = os.ReadFile(filepath.Join(dir, journalFile)); len(data) != 0 {
+		t.Errorf("journal after migration = %q, want empty", data)
+	}
+	// ID выдаются один раз
+	if reopened := load(); !maps.EqualFunc(reopened, migrated, func(a, b Event) bool { return a.Description == b.Description }) {
+		t.Errorf("events after reopening = %v, want %v", reopened, migrated)
+	}
+}
+
+// /api/v2 отвечает кодами REST: 201 на создание, 404 на неизвестное событие, 409 на пересечение
+// и на user_id в теле, не совпадающий с адресом, 422 на невалидное событие
+func TestAPIV2(t *testing.T) {
+	server := newTestServer(t)
+	do := func(method, path, body string) (*http.Response, APIResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var apiResp APIResponse
+		json.Unmarshal(data, &apiResp)
+		return resp, apiResp
+	}
+
+	resp, _ := do(http.MethodPost, "/api/v2/users/1/events", `{"start": "2026-10-19T10:00", "duration": "1h", "description": "Планерка"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	location := resp.Header.Get("Location")
+	created, ok := calendarFrom(context.Background()).GetEvent(strings.TrimPrefix(location, "/api/v2/users/1/events/"))
+	if !ok || created.Description != "Планерка" {
+		t.Fatalf("Location %q does not point to the created event", location)
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		wantStatus               int
+		wantDetail               string
+	}{
+		{"unknown event", http.MethodGet, "/api/v2/users/1/events/unknown", "", http.StatusNotFound, ""},
+		{"foreign event", http.MethodGet, "/api/v2/users/2/events/" + created.ID, "", http.StatusNotFound, ""},
+		{"conflict", http.MethodPost, "/api/v2/users/1/events?reject_conflicts=true",
+			`{"start": "2026-10-19T10:30", "duration": "1h", "description": "Созвон"}`, http.StatusConflict,
+			`"conflicting_ids":["` + created.ID + `"]`},
+		{"user_id mismatch", http.MethodPut, "/api/v2/users/1/events/" + created.ID,
+			`{"user_id": "2", "date": "2026-10-20", "description": "Чужое"}`, http.StatusConflict, ""},
+		{"id mismatch", http.MethodPut, "/api/v2/users/1/events/" + created.ID,
+			`{"id": "other", "date": "2026-10-20", "description": "Другое"}`, http.StatusConflict, ""},
+		{"invalid event", http.MethodPost, "/api/v2/users/1/events", `{"date": "2026-13-01", "description": "Никогда"}`,
+			http.StatusUnprocessableEntity, "fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := do(tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d %+v, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			details, _ := json.Marshal(body.Details)
+			if tt.wantDetail != "" && !strings.Contains(string(details), tt.wantDetail) {
+				t.Errorf("details = %s, want %s", details, tt.wantDetail)
+			}
+		})
+	}
+
+	if stored, _ := calendarFrom(context.Background()).GetEvent(created.ID); stored.Description != "Планерка" {
+		t.Errorf("event after rejected updates = %+v, want it unchanged", stored)
+	}
+}
+
+// Вхождения серии в окне запроса: частота, интервал, BYDAY, BYMONTHDAY, COUNT, UNTIL, исключенные даты
+// и местное время начала при переходе на зимнее время
+func TestExpandRecurrence(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		timeZone string
+		rrule    string
+		exdates  []string
+		from, to string
+		want     []string
+	}{
+		{"daily count", "2026-10-19T10:00", "UTC", "FREQ=DAILY;COUNT=3", nil, "2026-10-01", "2026-11-01",
+			[]string{"2026-10-19", "2026-10-20", "2026-10-21"}},
+		{"count before window", "2026-10-01T10:00", "UTC", "FREQ=DAILY;COUNT=5", nil, "2026-10-04", "2026-10-10",
+			[]string{"2026-10-04", "2026-10-05"}},
+		{"window long after start", "2020-01-01T10:00", "UTC", "FREQ=DAILY", nil, "2026-10-19", "2026-10-21",
+			[]string{"2026-10-19", "2026-10-20"}},
+		{"biweekly byday", "2026-10-19T10:00", "UTC", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE", nil, "2026-10-19", "2026-11-10",
+			[]string{"2026-10-19", "2026-10-21", "2026-11-02", "2026-11-04"}},
+		{"last day of month until", "2026-10-31T10:00", "UTC", "FREQ=MONTHLY;BYMONTHDAY=-1;UNTIL=20270101", nil, "2026-10-01", "2027-04-01",
+			[]string{"2026-10-31", "2026-11-30", "2026-12-31"}},
+		{"exdates", "2026-10-19T10:00", "UTC", "FREQ=DAILY", []string{"2026-10-20", "2026-10-22"}, "2026-10-19", "2026-10-24",
+			[]string{"2026-10-19", "2026-10-21", "2026-10-23"}},
+		{"dst change", "2026-10-24T09:00", "Europe/Berlin", "FREQ=DAILY", nil, "2026-10-24", "2026-10-27",
+			[]string{"2026-10-24", "2026-10-25", "2026-10-26"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := Event{UserID: "1", RRule: tt.rrule, ExDates: tt.exdates}
+			timing := eventTiming{Start: tt.start, Duration: "1h", TimeZone: tt.timeZone}
+			if err := timing.apply(&event); err != nil {
+				t.Fatal(err)
+			}
+			loc, _ := loadLocation(tt.timeZone)
+			from, _ := time.ParseInLocation(dateLayout, tt.from, loc)
+			to, _ := time.ParseInLocation(dateLayout, tt.to, loc)
+
+			var dates []string
+			for _, occurrence := range event.expand(from, to) {
+				dates = append(dates, occurrence.Date)
+				if local := occurrence.Start.In(loc); local.Hour() != event.Start.In(loc).Hour() || occurrence.End.Sub(occurrence.Start) != time.Hour {
+					t.Errorf("occurrence %s = %s-%s, want the series local time", occurrence.Date, local, occurrence.End.In(loc))
+				}
+			}
+			if !slices.Equal(dates, tt.want) {
+				t.Errorf("occurrences = %v, want %v", dates, tt.want)
+			}
+			for _, date := range tt.exdates {
+				if event.occursOn(date) {
+					t.Errorf("occursOn(%s) = true for an excluded date", date)
+				}
+			}
+		})
+	}
+}
+
+// Повторный импорт сохраняет участников и общий календарь события, а вхождение,
+// которое не удалось сохранить, не исключается из серии
+func TestImportEvent(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := calendar.CreateSharedCalendar("1", "Команда")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := newTestEvent(t, "1", "2026-10-19T10:00", "Стендап")
+	series.RRule = "FREQ=DAILY"
+	series.CalendarID = shared.ID
+	series.Attendees = []Attendee{{UserID: "2", Status: rsvpNeedsAction}}
+	created, err := calendar.AddEvent(context.Background(), series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = calendar.RSVP(context.Background(), created.ID, "2", rsvpAccepted); err != nil {
+		t.Fatal(err)
+	}
+	accepted := []Attendee{{UserID: "2", Status: rsvpAccepted}}
+
+	data := newTestEvent(t, "1", "2026-10-19T11:00", "Стендап в 11")
+	data.RRule = "FREQ=DAILY"
+	data.UID = created.ID
+	imported, isNew, err := calendar.ImportEvent(context.Background(), data)
+	if err != nil || isNew {
+		t.Fatalf("reimport: new = %v, err = %v", isNew, err)
+	}
+	if imported.ID != created.ID || imported.CalendarID != shared.ID || !slices.Equal(imported.Attendees, accepted) {
+		t.Errorf("reimported = %+v, want the calendar and attendees of %+v", imported, created)
+	}
+
+	exception := newTestEvent(t, "1", "2026-10-20T12:00", "Стендап в 12")
+	exception.UID = created.ID
+	exception.RecurrenceID = "2026-10-20"
+	calendar.SetMaxEvents(1)
+	var quotaErr *QuotaError
+	if _, _, err = calendar.ImportEvent(context.Background(), exception); !errors.As(err, &quotaErr) {
+		t.Fatalf("exception over quota: err = %v, want *QuotaError", err)
+	}
+	if stored, _ := calendar.GetEvent(created.ID); len(stored.ExDates) != 0 {
+		t.Errorf("series exdates after a failed exception = %v, want none", stored.ExDates)
+	}
+
+	calendar.SetMaxEvents(0)
+	if imported, isNew, err = calendar.ImportEvent(context.Background(), exception); err != nil || !isNew {
+		t.Fatalf("exception: new = %v, err = %v", isNew, err)
+	}
+	if imported.SeriesID != created.ID || imported.CalendarID != shared.ID || !slices.Equal(imported.Attendees, accepted) {
+		t.Errorf("exception = %+v, want the series calendar and attendees", imported)
+	}
+	if stored, _ := calendar.GetEvent(created.ID); !slices.Equal(stored.ExDates, []string{"2026-10-20"}) {
+		t.Errorf("series exdates = %v, want [2026-10-20]", stored.ExDates)
+	}
+}
+
+// Диапазон запроса не длиннее года, чтобы серии не разворачивались без ограничения
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantErr  bool
+	}{
+		{"2026-01-01", "2026-12-31", false},
+		{"2028-01-01", "2028-12-31", false}, // високосный год
+		{"2026-10-19T00:00:00Z", "2027-10-20T00:00:00Z", false},
+		{"2026-10-19T00:00:00Z", "2027-10-20T00:00:01Z", true},
+		{"2026-01-01", "2027-01-01", false},
+		{"2026-01-01", "2027-01-02", true},
+		{"0001-01-01", "9999-12-31", true},
+		{"2026-10-20", "2026-10-19", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"/"+tt.to, func(t *testing.T) {
+			_, _, err := parseRange(url.Values{"from": {tt.from}, "to": {tt.to}, "tz": {"Europe/Berlin"}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRange(%s, %s) error = %v, want error %v", tt.from, tt.to, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Запросы первой версии с одной датой дают событие на весь день, start задается
+// с длительностью или концом, а время с явным смещением переводится в зону события
+func TestEventTimingApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		timing     eventTiming
+		start, end string
+		date       string
+		allDay     bool
+		wantField  string
+	}{
+		{name: "date only", timing: eventTiming{Date: "2026-10-19"},
+			start: "2026-10-19T00:00:00Z", end: "2026-10-20T00:00:00Z", date: "2026-10-19", allDay: true},
+		{name: "date only in zone", timing: eventTiming{Date: "2026-10-19", TimeZone: "Europe/Moscow"},
+			start: "2026-10-19T00:00:00+03:00", end: "2026-10-20T00:00:00+03:00", date: "2026-10-19", allDay: true},
+		{name: "start wins over date", timing: eventTiming{Date: "2026-10-01", Start: "2026-10-19T10:00", Duration: "1h"},
+			start: "2026-10-19T10:00:00Z", end: "2026-10-19T11:00:00Z", date: "2026-10-19"},
+		{name: "start without end", timing: eventTiming{Start: "2026-10-19T10:00"},
+			start: "2026-10-19T10:00:00Z", end: "2026-10-19T10:00:00Z", date: "2026-10-19"},
+		{name: "duration", timing: eventTiming{Start: "2026-10-19T10:00:00", Duration: "1h30m"},
+			start: "2026-10-19T10:00:00Z", end: "2026-10-19T11:30:00Z", date: "2026-10-19"},
+		{name: "end wins over duration", timing: eventTiming{Start: "2026-10-19T10:00", End: "2026-10-19T12:00", Duration: "1h"},
+			start: "2026-10-19T10:00:00Z", end: "2026-10-19T12:00:00Z", date: "2026-10-19"},
+		{name: "local time before midnight", timing: eventTiming{Start: "2026-10-19T23:30", Duration: "1h", TimeZone: "Europe/Berlin"},
+			start: "2026-10-19T23:30:00+02:00", end: "2026-10-20T00:30:00+02:00", date: "2026-10-19"},
+		{name: "utc evening is next day in zone", timing: eventTiming{Start: "2026-10-19T22:30:00Z", Duration: "30m", TimeZone: "Europe/Moscow"},
+			start: "2026-10-20T01:30:00+03:00", end: "2026-10-20T02:00:00+03:00", date: "2026-10-20"},
+		{name: "utc morning is previous day in zone", timing: eventTiming{Start: "2026-10-20T02:00:00Z", Duration: "1h", TimeZone: "America/New_York"},
+			start: "2026-10-19T22:00:00-04:00", end: "2026-10-19T23:00:00-04:00", date: "2026-10-19"},
+		{name: "no date and start", timing: eventTiming{Duration: "1h"}, wantField: "date"},
+		{name: "invalid date", timing: eventTiming{Date: "2026-13-01"}, wantField: "date"},
+		{name: "invalid start", timing: eventTiming{Start: "2026-10-19 10:00"}, wantField: "start"},
+		{name: "invalid end", timing: eventTiming{Start: "2026-10-19T10:00", End: "noon"}, wantField: "end"},
+		{name: "invalid duration", timing: eventTiming{Start: "2026-10-19T10:00", Duration: "1 hour"}, wantField: "duration"},
+		{name: "negative duration", timing: eventTiming{Start: "2026-10-19T10:00", Duration: "-1h"}, wantField: "duration"},
+		{name: "end before start", timing: eventTiming{Start: "2026-10-19T10:00", End: "2026-10-19T09:00"}, wantField: "end"},
+		{name: "unknown zone", timing: eventTiming{Date: "2026-10-19", TimeZone: "Mars/Olympus"}, wantField: "time_zone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.timing.TimeZone != "" {
+				if _, err := time.LoadLocation(tt.timing.TimeZone); err != nil && tt.wantField == "" {
+					t.Skip(err)
+				}
+			}
+
+			var event Event
+			err := tt.timing.apply(&event)
+			if tt.wantField != "" {
+				var verr *ValidationError
+				if !errors.As(err, &verr) || verr.Fields[tt.wantField] == "" {
+					t.Fatalf("apply() error = %v, want validation error on %q", err, tt.wantField)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := event.Start.Format(time.RFC3339); got != tt.start {
+				t.Errorf("start = %s, want %s", got, tt.start)
+			}
+			if got := event.End.Format(time.RFC3339); got != tt.end {
+				t.Errorf("end = %s, want %s", got, tt.end)
+			}
+			if event.Date != tt.date || event.AllDay != tt.allDay {
+				t.Errorf("date = %s, all day %v, want %s, %v", event.Date, event.AllDay, tt.date, tt.allDay)
+			}
+		})
+	}
+}
+
+// Событие попадает в окно [from, to) по времени, а событие на весь день - по дате в зоне окна
+func TestEventInWindow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := func(date string, loc *time.Location) (time.Time, time.Time) {
+		from, _ := time.ParseInLocation(dateLayout, date, loc)
+		return from, from.AddDate(0, 0, 1)
+	}
+	allDay := Event{AllDay: true, Date: "2026-10-19"}
+	nearMidnight := Event{}
+	if err := (eventTiming{Start: "2026-10-19T23:30", Duration: "1h", TimeZone: "Europe/Berlin"}).apply(&nearMidnight); err != nil {
+		t.Fatal(err)
+	}
+	instant := Event{}
+	if err := (eventTiming{Start: "2026-10-20T00:00", TimeZone: "Europe/Berlin"}).apply(&instant); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		event Event
+		date  string
+		loc   *time.Location
+		want  bool
+	}{
+		{"all day on its date", allDay, "2026-10-19", berlin, true},
+		{"all day on its date in utc", allDay, "2026-10-19", time.UTC, true},
+		{"all day on next date", allDay, "2026-10-20", berlin, false},
+		{"all day on previous date", allDay, "2026-10-18", berlin, false},
+		{"before midnight on its day", nearMidnight, "2026-10-19", berlin, true},
+		{"after midnight part on next day", nearMidnight, "2026-10-20", berlin, true},
+		{"near midnight in utc", nearMidnight, "2026-10-19", time.UTC, true},
+		{"not on next utc day", nearMidnight, "2026-10-20", time.UTC, false},
+		{"instant at window start", instant, "2026-10-20", berlin, true},
+		{"instant at window end", instant, "2026-10-19", berlin, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := day(tt.date, tt.loc)
+			if got := tt.event.inWindow(from, to); got != tt.want {
+				t.Errorf("inWindow(%s, %s) = %v, want %v", from.Format(time.RFC3339), to.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+// startOfDay отсчитывает день от полуночи в зоне запроса, неизвестная зона считается UTC
+func TestStartOfDay(t *testing.T) {
+	tests := []struct {
+		date, tz string
+		want     string
+	}{
+		{"2026-10-19", "", "2026-10-19T00:00:00Z"},
+		{"2026-10-19", "UTC", "2026-10-19T00:00:00Z"},
+		{"2026-10-19", "Europe/Moscow", "2026-10-19T00:00:00+03:00"},
+		{"2026-10-19", "America/New_York", "2026-10-19T00:00:00-04:00"},
+		{"2026-03-29", "Europe/Berlin", "2026-03-29T00:00:00+01:00"}, // день перехода на летнее время
+		{"2026-10-25", "Europe/Berlin", "2026-10-25T00:00:00+02:00"}, // день перехода на зимнее время
+		{"2026-10-19", "Mars/Olympus", "2026-10-19T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.date+"/"+tt.tz, func(t *testing.T) {
+			if got := startOfDay(Event{Date: tt.date, TimeZone: tt.tz}).Format(time.RFC3339); got != tt.want {
+				t.Errorf("startOfDay(%s, %q) = %s, want %s", tt.date, tt.tz, got, tt.want)
+			}
+		})
+	}
+}
+
+// Серия пересекается с событиями, попавшими на любое из ее вхождений на горизонте года
+func TestConflicts(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(start, rrule string) string {
+		t.Helper()
+		event := newTestEvent(t, "1", start, "")
+		event.RRule = rrule
+		created, err := calendar.AddEvent(context.Background(), event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created.ID
+	}
+	late := add("2027-06-07T10:30", "")
+	weekly := add("2026-11-03T09:30", "FREQ=WEEKLY;BYDAY=TU")
+	add("2026-10-19T11:00", "") // сразу после первого вхождения
+	add("2026-10-20T09:00", "") // сразу перед вторым
+	add("2026-10-21T10:00", "") // в день без вхождения
+	add("2028-01-03T10:00", "") // за горизонтом
+
+	series := newTestEvent(t, "1", "2026-10-19T10:00", "")
+	series.RRule = "FREQ=WEEKLY;BYDAY=MO,TU"
+	calendar.RLock()
+	got := calendar.conflicts(series)
+	calendar.RUnlock()
+	slices.Sort(got)
+	want := []string{late, weekly}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("conflicts = %v, want %v", got, want)
+	}
+}
+
+// /create_event с reject_conflicts отвечает 409 со списком пересекающихся событий,
+// а событие, которое только касается существующего, создает
+func TestCreateEventConflict(t *testing.T) {
+	server := newTestServer(t)
+
+	create := func(start string) (*http.Response, APIResponse) {
+		t.Helper()
+		resp, err := http.PostForm(server.URL+"/create_event?reject_conflicts=true", url.Values{
+			"user_id": {"1"}, "start": {start}, "duration": {"1h"}, "description": {start},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body APIResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	resp, body := create("2026-10-19T10:00")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create = %d %+v", resp.StatusCode, body)
+	}
+	existing := body.Result.(map[string]interface{})["id"]
+
+	resp, body = create("2026-10-19T10:30")
+	details, _ := body.Details.(map[string]interface{})
+	if ids, _ := details["conflicting_ids"].([]interface{}); resp.StatusCode != http.StatusConflict || len(ids) != 1 || ids[0] != existing {
+		t.Errorf("overlapping create = %d %+v, want 409 with conflicting_ids [%v]", resp.StatusCode, body, existing)
+	}
+
+	if resp, body = create("2026-10-19T11:00"); resp.StatusCode != http.StatusOK {
+		t.Errorf("adjacent create = %d %+v, want 200", resp.StatusCode, body)
+	}
+}
+
+// Занятость нескольких пользователей сливается в общие интервалы: пересекающиеся и смежные
+// интервалы разных пользователей объединяются, события на весь день и без длительности
+// время не занимают, а интервалы обрезаются по окну
+func TestFreeBusy(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(userID string, timing eventTiming) {
+		t.Helper()
+		event := Event{UserID: userID}
+		timing.TimeZone = "UTC"
+		if err := timing.apply(&event); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := calendar.AddEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("1", eventTiming{Start: "2026-10-19T10:00", Duration: "1h"})
+	add("2", eventTiming{Start: "2026-10-19T10:30", Duration: "90m"}) // пересекается с событием 1
+	add("3", eventTiming{Start: "2026-10-19T10:15", Duration: "30m"}) // внутри события 1
+	add("1", eventTiming{Start: "2026-10-19T13:00", Duration: "1h"})
+	add("3", eventTiming{Start: "2026-10-19T14:00", Duration: "1h"}) // начинается в конце события 1
+	add("2", eventTiming{Start: "2026-10-19T16:00", Duration: "30m"})
+	add("2", eventTiming{Start: "2026-10-19T16:31", Duration: "29m"}) // через минуту после
+	add("1", eventTiming{Date: "2026-10-19"})
+	add("1", eventTiming{Start: "2026-10-19T18:00"})
+	add("4", eventTiming{Start: "2026-10-19T12:00", Duration: "1h"}) // соединил бы интервалы, но не запрошен
+	add("3", eventTiming{Start: "2026-10-19T23:30", Duration: "1h"})
+
+	from := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	got := calendar.FreeBusy([]string{"1", "2", "3"}, from, from.AddDate(0, 0, 1))
+
+	var intervals []string
+	for _, interval := range got {
+		intervals = append(intervals, interval.Start.Format("15:04")+"-"+interval.End.Format("15:04"))
+	}
+	want := []string{"10:00-12:00", "13:00-15:00", "16:00-16:30", "16:31-17:00", "23:30-00:00"}
+	if !slices.Equal(intervals, want) {
+		t.Errorf("free/busy = %v, want %v", intervals, want)
+	}
+
+	if got := calendar.FreeBusy([]string{"5"}, from, from.AddDate(0, 0, 1)); got == nil || len(got) != 0 {
+		t.Errorf("free/busy without events = %#v, want an empty list", got)
+	}
+}
+
+// Участник видит приглашение, пока не отказался, и занят в нем, если согласился.
+// Право write на общий календарь позволяет менять чужое событие, право read на изменение дает 403
+func TestSharedCalendarAccess(t *testing.T) {
+	server := newTestServer(t)
+
+	request := func(method, path string, form url.Values) (int, APIResponse) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body APIResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	post := func(path string, form url.Values) map[string]interface{} {
+		t.Helper()
+		status, body := request(http.MethodPost, path, form)
+		if status != http.StatusOK {
+			t.Fatalf("%s %v = %d %+v", path, form, status, body)
+		}
+		result, _ := body.Result.(map[string]interface{})
+		return result
+	}
+
+	calendarID := post("/calendars/create", url.Values{"user_id": {"1"}, "name": {"team"}})["id"].(string)
+	post("/calendars/share", url.Values{"user_id": {"1"}, "calendar_id": {calendarID}, "grantee_id": {"2"}, "permission": {"write"}})
+	post("/calendars/share", url.Values{"user_id": {"1"}, "calendar_id": {calendarID}, "grantee_id": {"3"}, "permission": {"read"}})
+	id := post("/create_event", url.Values{
+		"user_id": {"1"}, "calendar_id": {calendarID}, "attendees": {"4,5,6"},
+		"start": {"2026-10-19T10:00"}, "duration": {"1h"}, "description": {"Планерка"},
+	})["id"].(string)
+	post("/rsvp", url.Values{"user_id": {"4"}, "id": {id}, "status": {"declined"}})
+	post("/rsvp", url.Values{"user_id": {"5"}, "id": {id}, "status": {"accepted"}})
+
+	t.Run("listed", func(t *testing.T) {
+		// 4 отказался, 6 еще не ответил на приглашение
+		for userID, want := range map[string]int{"1": 200, "2": 200, "3": 200, "4": 503, "5": 200, "6": 200, "7": 503} {
+			if status, body := request(http.MethodGet, "/events_for_day?date=2026-10-19&user_id="+userID, nil); status != want {
+				t.Errorf("events of user %s = %d %+v, want %d", userID, status, body, want)
+			}
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		for userIDs, want := range map[string]int{"1": 1, "5": 1, "4": 0, "6": 0, "4,6": 0} {
+			status, body := request(http.MethodGet, "/freebusy?from=2026-10-19&to=2026-10-20&user_ids="+userIDs, nil)
+			if intervals, _ := body.Result.([]interface{}); status != http.StatusOK || len(intervals) != want {
+				t.Errorf("free/busy of %s = %d %+v, want %d intervals", userIDs, status, body, want)
+			}
+		}
+		status, body := request(http.MethodPost, "/create_event?reject_conflicts=true", url.Values{
+			"user_id": {"5"}, "start": {"2026-10-19T10:30"}, "duration": {"1h"}, "description": {"Созвон"},
+		})
+		if status != http.StatusConflict {
+			t.Errorf("conflicting event of an attendee = %d %+v, want 409", status, body)
+		}
+	})
+
+	t.Run("write grant", func(t *testing.T) {
+		post("/update_event", url.Values{
+			"user_id": {"2"}, "id": {id}, "start": {"2026-10-19T11:00"}, "duration": {"1h"}, "description": {"Перенесли"},
+		})
+		event, ok := calendarFrom(context.Background()).GetEvent(id)
+		if !ok || event.Description != "Перенесли" || event.UserID != "1" || event.CalendarID != calendarID || len(event.Attendees) != 3 {
+			t.Errorf("event after update by a writer = %+v, want it moved with the owner, calendar and attendees kept", event)
+		}
+	})
+
+	t.Run("read grant", func(t *testing.T) {
+		update := url.Values{"user_id": {"3"}, "id": {id}, "date": {"2026-10-20"}, "description": {"Чужое"}}
+		if status, body := request(http.MethodPost, "/update_event", update); status != http.StatusForbidden {
+			t.Errorf("update by a reader = %d %+v, want 403", status, body)
+		}
+		if status, body := request(http.MethodPost, "/delete_event", url.Values{"user_id": {"3"}, "id": {id}}); status != http.StatusForbidden {
+			t.Errorf("delete by a reader = %d %+v, want 403", status, body)
+		}
+		if event, _ := calendarFrom(context.Background()).GetEvent(id); event.Description != "Перенесли" {
+			t.Errorf("event after forbidden changes = %+v", event)
+		}
+	})
+}
+
+// fakeClock показывает время, которое выставил тест, и сам не идет
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+// fakeNotifier отвечает ошибкой на первые failures попыток доставить каждое напоминание
+type fakeNotifier struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  map[string]int
+	delivered []string
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, reminder Reminder) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.attempts == nil {
+		n.attempts = make(map[string]int)
+	}
+	n.attempts[reminder.Key]++
+	if n.attempts[reminder.Key] <= n.failures {
+		return errors.New("unavailable")
+	}
+	n.delivered = append(n.delivered, reminder.Key)
+	return nil
+}
+
+// newReminderCalendar календарь с событием пользователя 1 в 10:00 19 октября 2026 и напоминаниями за 15 и 5 минут
+func newReminderCalendar(t *testing.T) (*Calendar, Event) {
+	t.Helper()
+
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := newTestEvent(t, "1", "2026-10-19T10:00", "Стендап")
+	event.Reminders = []int{5, 15}
+	if event, err = calendar.AddEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	return calendar, event
+}
+
+// testTime время clock 19 октября 2026 по UTC
+func testTime(clock string) time.Time {
+	t, _ := time.Parse(time.RFC3339, "2026-10-19T"+clock+"Z")
+	return t
+}
+
+// Напоминания попадают в полуинтервал (from, to] по возрастанию времени, о закончившихся событиях не напоминают
+func TestDueReminders(t *testing.T) {
+	calendar, event := newReminderCalendar(t)
+	series := newTestEvent(t, "2", "2026-10-18T09:00", "Планерка")
+	series.RRule = "FREQ=DAILY"
+	series.Reminders = []int{0}
+	series, err := calendar.AddEvent(context.Background(), series)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{"both reminders", "09:00:00", "09:59:00", []string{event.ID + "/2026-10-19T10:00:00Z/15", event.ID + "/2026-10-19T10:00:00Z/5"}},
+		{"to inclusive", "09:00:00", "09:45:00", []string{event.ID + "/2026-10-19T10:00:00Z/15"}},
+		{"from exclusive", "09:45:00", "09:50:00", nil},
+		{"series occurrence", "08:59:59", "09:00:00", []string{series.ID + "/2026-10-19T09:00:00Z/0"}},
+		{"ended occurrence", "08:00:00", "10:02:00", []string{event.ID + "/2026-10-19T10:00:00Z/15", event.ID + "/2026-10-19T10:00:00Z/5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			for _, reminder := range calendar.DueReminders(testTime(tt.from), testTime(tt.to)) {
+				keys = append(keys, reminder.Key)
+			}
+			if !slices.Equal(keys, tt.want) {
+				t.Errorf("DueReminders(%s, %s) = %v, want %v", tt.from, tt.to, keys, tt.want)
+			}
+		})
+	}
+}
+
+// Неудачная доставка повторяется с удваивающейся задержкой не больше maxBackoff,
+// после maxAttempts попыток напоминание попадает в недоставленные
+func TestSchedulerRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		maxBackoff time.Duration
+		backoffs   []time.Duration
+		dead       bool
+	}{
+		{name: "delivered", failures: 0},
+		{name: "retried", failures: 2, backoffs: []time.Duration{10 * time.Second, 20 * time.Second}},
+		{name: "capped backoff", failures: 4, maxBackoff: 30 * time.Second,
+			backoffs: []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}},
+		{name: "dead letter", failures: 5, dead: true,
+			backoffs: []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: testTime("09:54:30")}
+			calendar, event := newReminderCalendar(t)
+			notifier := &fakeNotifier{failures: tt.failures}
+			scheduler, err := NewScheduler(calendar, notifier, clock, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.maxBackoff > 0 {
+				scheduler.maxBackoff = tt.maxBackoff
+			}
+
+			// напоминание ближе минуты: планировщик спит ровно до него
+			if wait := scheduler.tick(); wait != 30*time.Second {
+				t.Errorf("wait before the reminder = %s, want 30s", wait)
+			}
+			clock.now = testTime("09:55:00")
+			for i, backoff := range tt.backoffs {
+				scheduler.tick()
+				if len(scheduler.state.Retries) != 1 || scheduler.state.Retries[0].NextAt != clock.now.Add(backoff) {
+					t.Fatalf("retries after attempt %d = %+v, want one in %s", i+1, scheduler.state.Retries, backoff)
+				}
+				clock.now = clock.now.Add(backoff)
+			}
+			scheduler.tick()
+
+			key := event.ID + "/2026-10-19T10:00:00Z/5"
+			if len(scheduler.state.Retries) != 0 {
+				t.Errorf("retries left = %+v", scheduler.state.Retries)
+			}
+			if got := notifier.attempts[key]; got != len(tt.backoffs)+1 {
+				t.Errorf("attempts = %d, want %d", got, len(tt.backoffs)+1)
+			}
+			letters := scheduler.DeadLetters("1")
+			if tt.dead != (len(letters) == 1) || tt.dead == slices.Contains(notifier.delivered, key) {
+				t.Errorf("dead letters = %+v, delivered = %v, want dead %v", letters, notifier.delivered, tt.dead)
+			}
+			if tt.dead && (letters[0].Attempts != 5 || letters[0].LastErr != "unavailable") {
+				t.Errorf("dead letter = %+v, want 5 attempts with the last error", letters[0])
+			}
+		})
+	}
+}
+
+// После перезапуска планировщик доставляет напоминания, пропущенные за время простоя,
+// не повторяет доставленные и продолжает отложенные повторы
+func TestSchedulerCheckpoint(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), reminderStateFile)
+	calendar, event := newReminderCalendar(t)
+	clock := &fakeClock{now: testTime("09:40:00")}
+	notifier := &fakeNotifier{failures: 1}
+
+	restart := func() *Scheduler {
+		t.Helper()
+		scheduler, err := NewScheduler(calendar, notifier, clock, stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return scheduler
+	}
+
+	scheduler := restart()
+	scheduler.tick()
+	clock.now = testTime("09:45:00")
+	scheduler.tick() // первая попытка за 15 минут неудачна
+
+	// простой с 09:45 до 09:58: пропущено напоминание за 5 минут, повтор за 15 минут просрочен
+	clock.now = testTime("09:58:00")
+	scheduler = restart()
+	if scheduler.state.Checkpoint != testTime("09:45:00") || len(scheduler.state.Retries) != 1 {
+		t.Fatalf("restored state = %+v, want checkpoint 09:45 and one retry", scheduler.state)
+	}
+	scheduler.tick()
+
+	clock.now = testTime("09:59:00")
+	restart().tick()
+
+	prefix := event.ID + "/2026-10-19T10:00:00Z/"
+	want := []string{prefix + "15", prefix + "5"}
+	slices.Sort(notifier.delivered)
+	if !slices.Equal(notifier.delivered, want) {
+		t.Errorf("delivered = %v, want %v once each", notifier.delivered, want)
+	}
+}
+
+// blockingNotifier не завершает доставку до отмены контекста и запоминает, сколько доставок шло одновременно
+type blockingNotifier struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	started     chan string
+}
+
+func (n *blockingNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	n.mu.Lock()
+	n.inFlight++
+	n.maxInFlight = max(n.maxInFlight, n.inFlight)
+	n.mu.Unlock()
+	n.started <- reminder.Key
+
+	<-ctx.Done()
+	n.mu.Lock()
+	n.inFlight--
+	n.mu.Unlock()
+	return ctx.Err()
+}
+
+// Доставки идут одновременно не больше workers за раз, Stop не ждет таймаута вебхука:
+// прерванные и не начатые доставки остаются в повторах без засчитанной попытки
+func TestSchedulerStop(t *testing.T) {
+	calendar, _ := newReminderCalendar(t)
+	other := newTestEvent(t, "2", "2026-10-19T10:00", "Обед")
+	other.Reminders = []int{10}
+	if _, err := calendar.AddEvent(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: testTime("09:40:00")}
+	notifier := &blockingNotifier{started: make(chan string, 3)}
+	scheduler, err := NewScheduler(calendar, notifier, clock, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.workers = 2
+	clock.now = testTime("09:56:00")
+	scheduler.Start()
+
+	for range 2 {
+		select {
+		case <-notifier.started:
+		case <-time.After(time.Second):
+			t.Fatal("deliveries did not start")
+		}
+	}
+	select {
+	case key := <-notifier.started:
+		t.Fatalf("delivery of %s started while two are in flight", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(webhookTimeout / 2):
+		t.Fatal("Stop waits for the webhook timeout")
+	}
+
+	if notifier.maxInFlight != 2 {
+		t.Errorf("max deliveries in flight = %d, want 2", notifier.maxInFlight)
+	}
+	if len(scheduler.state.Retries) != 3 || len(scheduler.state.DeadLetters) != 0 {
+		t.Fatalf("state after stop = %+v, want three retries", scheduler.state)
+	}
+	for _, retry := range scheduler.state.Retries {
+		if retry.Attempts != 0 || retry.NextAt != clock.now {
+			t.Errorf("interrupted delivery = %+v, want no attempts and retry right after restart", retry)
+		}
+	}
+}
+
+// Токен проверяется по подписи и сроку, учетные данные берутся из X-API-Key или Authorization: Bearer
+func TestAuthenticate(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	auth := NewAuthenticator(map[string]Principal{"key-1": {UserID: "1", Role: roleUser}}, "secret")
+	auth.now = func() time.Time { return now }
+
+	token, err := auth.IssueToken(Principal{UserID: "3", Role: roleAdmin, Tenant: "team-a"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"3","role":"admin","exp":9999999999}`))
+	other := NewAuthenticator(nil, "other")
+	unknownRole := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"3","role":"root","exp":9999999999}`))
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		elapsed time.Duration
+		want    Principal
+		wantErr error
+	}{
+		{name: "token", header: "Authorization", value: "Bearer " + token, want: Principal{UserID: "3", Role: roleAdmin, Tenant: "team-a"}},
+		{name: "scheme case", header: "Authorization", value: "bearer " + token, elapsed: 59 * time.Minute, want: Principal{UserID: "3", Role: roleAdmin, Tenant: "team-a"}},
+		{name: "expired", header: "Authorization", value: "Bearer " + token, elapsed: time.Hour, wantErr: errTokenExpired},
+		{name: "forged payload", header: "Authorization", value: "Bearer " + forged + "." + signature, wantErr: errInvalidToken},
+		{name: "truncated signature", header: "Authorization", value: "Bearer " + payload + "." + signature[1:], wantErr: errInvalidToken},
+		{name: "other secret", header: "Authorization", value: "Bearer " + payload + "." + other.sign(payload), wantErr: errInvalidToken},
+		{name: "unknown role", header: "Authorization", value: "Bearer " + unknownRole + "." + auth.sign(unknownRole), wantErr: errInvalidToken},
+		{name: "no signature", header: "Authorization", value: "Bearer " + payload, wantErr: errInvalidToken},
+		{name: "basic scheme", header: "Authorization", value: "Basic dXNlcjpwYXNz", wantErr: errUnauthenticated},
+		{name: "api key", header: "X-API-Key", value: "key-1", want: Principal{UserID: "1", Role: roleUser}},
+		{name: "wrong api key", header: "X-API-Key", value: "key-2", wantErr: errInvalidAPIKey},
+		{name: "no credentials", wantErr: errUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth.now = func() time.Time { return now.Add(tt.elapsed) }
+			r := httptest.NewRequest(http.MethodGet, "/events", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			principal, err := auth.Authenticate(r)
+			if !errors.Is(err, tt.wantErr) || principal != tt.want {
+				t.Errorf("Authenticate() = %+v, %v, want %+v, %v", principal, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Нестандартные методы учитываются в метриках как OTHER, чтобы клиент не мог плодить ряды
+func TestMetricsMethodLabel(t *testing.T) {
+	server := newTestServer(t)
+	for _, method := range []string{"BREW", "X-1", http.MethodDelete} {
+		req, _ := http.NewRequest(method, server.URL+"/events_for_day?user_id=1&date=2026-10-19", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body strings.Builder
+	bufio.NewReader(resp.Body).WriteTo(&body)
+	for _, series := range []string{`route="/events_for_day",method="OTHER",status="405"} 2`, `route="/events_for_day",method="DELETE",status="405"}`} {
+		if !strings.Contains(body.String(), series) {
+			t.Errorf("metrics do not contain %s", series)
+		}
+	}
+	if strings.Contains(body.String(), "BREW") {
+		t.Errorf("metrics contain the raw method BREW")
+	}
+}
+
+// На пустой период старые методы отвечают ошибкой бизнес-логики, клиент превращает ее в пустой список
+func TestEmptyPeriod(t *testing.T) {
+	server := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/events_for_month?user_id=1&date=2026-10-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body APIResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Error != "No events found for the specified user and date" {
+		t.Errorf("empty month = %d %+v, want 503 with the no events error", resp.StatusCode, body)
+	}
+
+	events, err := client.New(server.URL).EventsForDay(context.Background(), "1", "2026-10-19", "")
+	if err != nil || events == nil || len(events) != 0 {
+		t.Errorf("client empty day = %v, %v, want an empty list", events, err)
+	}
+}
+
+// Подписчик продолжает ленту с id последнего изменения, id из другого запуска или вытесненный из истории
+// приводят к reset с текущим id, с которого лента продолжается
+func TestChangeFeedResume(t *testing.T) {
+	feed := NewChangeFeed(3)
+	previousRun := NewChangeFeed(3)
+	event := Event{ID: "e1", UserID: "1"}
+	for range 2 {
+		previousRun.Publish(changeCreated, event, []string{"1"})
+	}
+
+	var ids []string
+	for range 5 {
+		feed.Publish(changeUpdated, event, []string{"1"})
+		ids = append(ids, feed.history[len(feed.history)-1].ID)
+	}
+	last := ids[len(ids)-1]
+
+	tests := []struct {
+		name   string
+		after  string
+		want   []string
+		wantOK bool
+	}{
+		{"new changes only", "", nil, true},
+		{"resume", ids[2], ids[3:], true},
+		{"up to date", last, nil, true},
+		{"evicted", ids[0], []string{last}, false},
+		{"previous run", previousRun.history[1].ID, []string{last}, false},
+		{"seq without epoch", "4", []string{last}, false},
+		{"garbage", "x-y", []string{last}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, pending, ok := feed.Subscribe("1", tt.after)
+			defer feed.Unsubscribe(sub)
+
+			var got []string
+			for _, change := range pending {
+				got = append(got, change.ID)
+				if !ok && change.Type != changeReset {
+					t.Errorf("change = %+v, want reset", change)
+				}
+			}
+			if ok != tt.wantOK || !slices.Equal(got, tt.want) {
+				t.Errorf("Subscribe(%q) = %v, %v, want %v, %v", tt.after, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	if feed.epoch == previousRun.epoch || !strings.HasPrefix(last, feed.epoch+"-") {
+		t.Errorf("id %s of this run, %s of the previous one: want different epochs", last, previousRun.history[1].ID)
+	}
+}
+
+// Слова, префиксы и фразы запроса: все должны встретиться в описании, регистр и ё не важны,
+// результаты упорядочены по началу и видны только тем, кто видит событие
+func TestSearch(t *testing.T) {
+	if got, want := tokenize("Ёлка, корпоратив-2026!"), []string{"елка", "корпоратив", "2026"}; !slices.Equal(got, want) {
+		t.Errorf("tokenize() = %v, want %v", got, want)
+	}
+
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, e := range []struct{ userID, start, description string }{
+		{"1", "2026-10-20T10:00", "План спринта и ретро"},
+		{"1", "2026-10-19T10:00", "Ретро спринта 42"},
+		{"1", "2026-10-18T10:00", "Ретроспектива"},
+		{"1", "2026-10-21T10:00", "Ёлка, корпоратив!"},
+		{"2", "2026-10-17T10:00", "Ретро другой команды"},
+	} {
+		created, err := calendar.AddEvent(context.Background(), newTestEvent(t, e.userID, e.start, e.description))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[created.ID] = e.description
+	}
+
+	tests := []struct {
+		q       string
+		want    []string
+		wantErr bool
+	}{
+		{q: "ретро", want: []string{"Ретро спринта 42", "План спринта и ретро"}},
+		{q: "РЕТРО*", want: []string{"Ретроспектива", "Ретро спринта 42", "План спринта и ретро"}},
+		{q: "спринта ретро", want: []string{"Ретро спринта 42", "План спринта и ретро"}},
+		{q: `"план спринта"`, want: []string{"План спринта и ретро"}},
+		{q: `"спринта план"`},
+		{q: "ретро-спринта", want: []string{"Ретро спринта 42"}},
+		{q: "елка", want: []string{"Ёлка, корпоратив!"}},
+		{q: "42 корпоратив"},
+		{q: "команды"},
+		{q: `"план`, wantErr: true},
+		{q: "* !!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			events, err := calendar.Search(SearchQuery{UserID: "1", Query: tt.q})
+			if tt.wantErr {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Errorf("Search(%q) error = %v, want *ValidationError", tt.q, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, names[event.ID])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+// Неудачные попытки аутентификации расходуют корзину IP адреса: перебор ключей получает 429
+func TestLimitIPBeforeAuthenticate(t *testing.T) {
+	server := newTestServer(t)
+	authenticator = NewAuthenticator(map[string]Principal{"key-1": {UserID: "1", Role: roleUser}}, "")
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)}
+	ipLimiter = NewRateLimiter(1, 3, clock)
+
+	get := func(key string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/events_for_day?user_id=1&date=2026-10-19", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := range 3 {
+		if resp := get(fmt.Sprintf("guess-%d", i)); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want %d", i, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	resp := get("guess-3")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("after burst: status = %d, Retry-After = %q, want 429, 1", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp = get("key-1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("valid key from the same address: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	// событий нет, поэтому 503, но запрос прошел аутентификацию
+	if resp = get("key-1"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("after refill: status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// loadConfig собирает конфиг так же, как main: значения по умолчанию, файл с содержимым file,
+// если он задан, окружение env и флаги args
+func loadConfig(t *testing.T, file string, env map[string]string, args ...string) (Config, error) {
+	t.Helper()
+
+	cfg := defaultConfig()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.loadConfigFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.applyEnv(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}); err != nil {
+		return cfg, err
+	}
+
+	flags := flag.NewFlagSet("calendar", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	cfg.applyFlags(flags)
+	return cfg, cfg.validate()
+}
+
+// Файл конфига важнее значений по умолчанию, окружение важнее файла, а явно переданный флаг -
+// всего остального, даже если он равен значению по умолчанию
+func TestConfigPrecedence(t *testing.T) {
+	const file = `{"port": 9000, "storage": "file", "data_dir": "/var/lib/calendar", "rate_limit": 5, "read_timeout": "3s"}`
+
+	tests := []struct {
+		name        string
+		file        string
+		env         map[string]string
+		args        []string
+		port        int
+		storage     string
+		dataDir     string
+		rateLimit   float64
+		readTimeout time.Duration
+	}{
+		{name: "defaults",
+			port: 8080, storage: "memory", dataDir: "data", rateLimit: 10, readTimeout: 10 * time.Second},
+		{name: "file", file: file,
+			port: 9000, storage: "file", dataDir: "/var/lib/calendar", rateLimit: 5, readTimeout: 3 * time.Second},
+		{name: "env over file", file: file,
+			env:  map[string]string{"CALENDAR_PORT": "9100", "CALENDAR_DATA_DIR": "/tmp/calendar", "CALENDAR_READ_TIMEOUT": "4s"},
+			port: 9100, storage: "file", dataDir: "/tmp/calendar", rateLimit: 5, readTimeout: 4 * time.Second},
+		{name: "env over defaults",
+			env:  map[string]string{"CALENDAR_STORAGE": "file", "CALENDAR_RATE_LIMIT": "2.5"},
+			port: 8080, storage: "file", dataDir: "data", rateLimit: 2.5, readTimeout: 10 * time.Second},
+		{name: "flags over env", file: file,
+			env:  map[string]string{"CALENDAR_PORT": "9100", "CALENDAR_DATA_DIR": "/tmp/calendar"},
+			args: []string{"-port", "9200", "-data", "./data"},
+			port: 9200, storage: "file", dataDir: "./data", rateLimit: 5, readTimeout: 3 * time.Second},
+		{name: "flag equal to default", file: file,
+			env:  map[string]string{"CALENDAR_STORAGE": "file"},
+			args: []string{"-port=8080", "-storage=memory"},
+			port: 8080, storage: "memory", dataDir: "/var/lib/calendar", rateLimit: 5, readTimeout: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, tt.file, tt.env, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != tt.port || cfg.Storage != tt.storage || cfg.DataDir != tt.dataDir {
+				t.Errorf("port, storage, data dir = %d, %s, %s, want %d, %s, %s",
+					cfg.Port, cfg.Storage, cfg.DataDir, tt.port, tt.storage, tt.dataDir)
+			}
+			if cfg.RateLimit != tt.rateLimit || cfg.ReadTimeout.Duration != tt.readTimeout {
+				t.Errorf("rate limit, read timeout = %v, %s, want %v, %s", cfg.RateLimit, cfg.ReadTimeout, tt.rateLimit, tt.readTimeout)
+			}
+		})
+	}
+}
+
+// Ошибка в файле, в переменной окружения или в итоговых значениях не дает запустить сервер
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{name: "broken json", file: `{"port": 8080`, wantErr: "invalid config"},
+		{name: "port as string", file: `{"port": "8080"}`, wantErr: "invalid config"},
+		{name: "duration without unit", file: `{"read_timeout": "10"}`, wantErr: "invalid config"},
+		{name: "env port", env: map[string]string{"CALENDAR_PORT": "http"}, wantErr: "invalid CALENDAR_PORT"},
+		{name: "env rpc port", env: map[string]string{"CALENDAR_RPC_PORT": "-"}, wantErr: "invalid CALENDAR_RPC_PORT"},
+		{name: "env rate limit", env: map[string]string{"CALENDAR_RATE_LIMIT": "fast"}, wantErr: "invalid CALENDAR_RATE_LIMIT"},
+		{name: "env body limit", env: map[string]string{"CALENDAR_MAX_BODY_BYTES": "1MB"}, wantErr: "invalid CALENDAR_MAX_BODY_BYTES"},
+		{name: "env timeout", env: map[string]string{"CALENDAR_IDLE_TIMEOUT": "2"}, wantErr: "invalid CALENDAR_IDLE_TIMEOUT"},
+		{name: "zero port", args: []string{"-port", "0"}, wantErr: "invalid port 0"},
+		{name: "port out of range", file: `{"port": 70000}`, wantErr: "invalid port 70000"},
+		{name: "rpc port equals port", env: map[string]string{"CALENDAR_RPC_PORT": "8080"}, wantErr: "invalid rpc_port 8080"},
+		{name: "negative timeout", file: `{"shutdown_timeout": "-1s"}`, wantErr: "timeouts must not be negative"},
+		{name: "negative rate limit", env: map[string]string{"CALENDAR_RATE_LIMIT": "-1"}, wantErr: "must not be negative"},
+		{name: "rate limit without burst", env: map[string]string{"CALENDAR_RATE_BURST": "0"}, wantErr: "rate_burst must be at least 1"},
+		{name: "ip rate limit without burst", file: `{"ip_rate_burst": 0}`, wantErr: "ip_rate_burst must be at least 1"},
+		{name: "week start", env: map[string]string{"CALENDAR_WEEK_START": "someday"}, wantErr: "invalid week_start"},
+		{name: "tenant id", file: `{"tenants": {"team a": {}}}`, wantErr: `invalid tenant "team a"`},
+		{name: "tenant quota", file: `{"tenants": {"team-a": {"max_events": -1}}}`, wantErr: "invalid quota of tenant team-a"},
+		{name: "api key role", file: `{"api_keys": {"key": {"user_id": "1", "role": "root"}}}`, wantErr: "invalid api_keys entry"},
+		{name: "api key tenant", file: `{"api_keys": {"key": {"user_id": "1", "role": "user", "tenant": "team-a"}}}`,
+			wantErr: `unknown tenant "team-a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(t, tt.file, tt.env, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("config error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.loadConfigFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing config file error = %v, want not exist", err)
+	}
+}
+
+// Если порт JSON-RPC занят, сервер не запускается и не оставляет за собой HTTP сервер на своем порту
+func TestStartServerRPCPortBusy(t *testing.T) {
+	newTestServer(t)
+
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free.Close()
+
+	cfg := defaultConfig()
+	cfg.Port = free.Addr().(*net.TCPAddr).Port
+	cfg.RPCPort = busy.Addr().(*net.TCPAddr).Port
+
+	result := make(chan error, 1)
+	go func() { result <- startServer(cfg) }()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("startServer() succeeded with the JSON-RPC port in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("startServer() kept running with the JSON-RPC port in use")
+	}
+
+	listener, err := net.Listen("tcp", free.Addr().String())
+	if err != nil {
+		t.Fatalf("HTTP port is still in use: %v", err)
+	}
+	listener.Close()
+}
+
+// Если один арендатор не открылся, уже открытые закрываются без остановки незапущенных планировщиков
+func TestOpenTenantsFailure(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Storage = "file"
+	cfg.DataDir = t.TempDir()
+	cfg.Tenants = map[string]TenantQuota{"team-a": {}, "team-b": {}, "team-c": {}, "broken": {}}
+
+	// на месте каталога арендатора файл
+	if err := os.MkdirAll(filepath.Join(cfg.DataDir, tenantsDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tenantDataDir(cfg.DataDir, "broken"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := openTenants(cfg, &fakeNotifier{})
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil || !strings.HasPrefix(err.Error(), "tenant broken:") {
+			t.Errorf("openTenants() error = %v, want the broken tenant", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("openTenants() did not return after a tenant failed to open")
+	}
+}
+
+// Одновременные изменения одного события с If-Match не теряют обновлений:
+// проигравший гонку получает ErrVersionMismatch и повторяет чтение
+func TestCalendarOptimisticConcurrency(t *testing.T) {
+	const workers, increments = 8, 50
+
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := calendar.AddEvent(context.Background(), newTestEvent(t, "1", "2026-10-19T10:00", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Version != 1 {
+		t.Fatalf("new event version = %d, want 1", created.Version)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				current, ok := calendar.GetEvent(created.ID)
+				if !ok {
+					errs <- errors.New("event disappeared")
+					return
+				}
+				counter, _ := strconv.Atoi(current.Description)
+				current.Description = strconv.Itoa(counter + 1)
+
+				_, err := calendar.UpdateEvent(context.Background(), current)
+				switch {
+				case errors.Is(err, ErrVersionMismatch):
+				case err != nil:
+					errs <- err
+					return
+				default:
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	final, _ := calendar.GetEvent(created.ID)
+	if want := strconv.Itoa(workers * increments); final.Description != want {
+		t.Errorf("counter = %s, want %s: updates were lost", final.Description, want)
+	}
+	if want := int64(1 + workers*increments); final.Version != want {
+		t.Errorf("version = %d, want %d", final.Version, want)
+	}
+
+	stale := final
+	stale.Version = 1
+	if _, err = calendar.UpdateEvent(context.Background(), stale); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("update with stale version: err = %v, want ErrVersionMismatch", err)
+	}
+	if err = calendar.DeleteEvent(context.Background(), stale); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("delete with stale version: err = %v, want ErrVersionMismatch", err)
+	}
+}
+
+// Стресс-тест для go test -race: все публичные методы Calendar вызываются одновременно
+func TestCalendarConcurrentAccess(t *testing.T) {
+	const workers, iterations = 8, 40
+
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := calendar.CreateSharedCalendar("1", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	sub, _, ok := calendar.feed.Subscribe("4", "")
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+	defer calendar.feed.Unsubscribe(sub)
+
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userID := strconv.Itoa(worker%3 + 1)
+
+			for i := range iterations {
+				start := fmt.Sprintf("2026-10-%02dT%02d:00", i%28+1, worker+8)
+				event := newTestEvent(t, userID, start, fmt.Sprintf("встреча %d отдела %d", i, worker))
+				event.Attendees = []Attendee{{UserID: "4", Status: rsvpNeedsAction}, {UserID: "5", Status: rsvpNeedsAction}}
+				if i%4 == 0 {
+					event.RRule = "FREQ=WEEKLY;COUNT=4"
+				}
+				if i%5 == 0 && userID == "1" {
+					event.CalendarID = shared.ID
+				}
+
+				created, err := calendar.AddEvent(context.Background(), event)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				created.Description += " перенесена"
+				if _, err = calendar.UpdateEvent(context.Background(), created); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = calendar.RSVP(context.Background(), created.ID, "4", rsvpAccepted); err != nil {
+					t.Error(err)
+					return
+				}
+
+				calendar.GetEvent(created.ID)
+				calendar.GetEventsWeek(Event{UserID: "4", Date: created.Date, TimeZone: "UTC"})
+				calendar.FreeBusy([]string{"1", "4", "5"}, from, to)
+				calendar.UserEvents(userID)
+				calendar.SharedCalendars("2")
+				if _, err = calendar.QueryEvents(EventQuery{UserID: "5", From: from, To: to, Limit: 10}); err != nil {
+					t.Error(err)
+				}
+				if _, err = calendar.Search(SearchQuery{UserID: userID, Query: "встреч* перенесена"}); err != nil {
+					t.Error(err)
+				}
+				if i == iterations/2 && worker == 0 {
+					if _, err = calendar.ShareCalendar(shared.ID, "1", "2", permissionWrite); err != nil {
+						t.Error(err)
+					}
+				}
+
+				if i%3 == 0 {
+					if err = calendar.DeleteEvent(context.Background(), Event{ID: created.ID, UserID: userID}); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+
+	// подписчик ленты читает изменения, пока идут записи, медленного подписчика лента отключает
+	go func() {
+		for range sub.C {
+		}
+	}()
+	wg.Wait()
+
+	var total int
+	for _, worker := range []string{"1", "2", "3"} {
+		total += len(calendar.UserEvents(worker))
+	}
+	if want := workers * (iterations - (iterations+2)/3); total != want {
+		t.Errorf("stored events = %d, want %d", total, want)
+	}
+}
+
+// newTestServer запускает сервер на пустом календаре в памяти
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants = NewTenants(NewTenant(defaultTenant, calendar, TenantQuota{}, realClock{}))
+	authenticator, limiter, ipLimiter = nil, nil, nil
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Клиент из пакета client против настоящего роутера
+func TestClientIntegration(t *testing.T) {
+	server := newTestServer(t)
+	api := client.New(server.URL)
+	ctx := context.Background()
+
+	created, err := api.CreateEvent(ctx, client.EventParams{
+		UserID:      "1",
+		Start:       "2026-10-21T10:00",
+		Duration:    "1h",
+		TimeZone:    "Europe/Moscow",
+		Description: "Планирование",
+		Reminders:   []int{15},
+		Attendees:   []string{"2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Version != 1 || created.Start.UTC().Hour() != 7 {
+		t.Fatalf("created = %+v", created)
+	}
+
+	week, err := api.EventsForWeek(ctx, "2", "2026-10-19", "Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(week) != 1 || week[0].ID != created.ID {
+		t.Fatalf("attendee week = %+v, want the created event", week)
+	}
+
+	params := client.EventParams{ID: created.ID, UserID: "1", Date: "2026-10-22", Description: "Ретро", Version: created.Version}
+	version, err := api.UpdateEvent(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("version after update = %d, want 2", version)
+	}
+
+	// повтор с той же версией уже устарел
+	var apiErr *client.Error
+	if _, err = api.UpdateEvent(ctx, params); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale update: err = %v, want 412", err)
+	}
+
+	_, err = api.CreateEvent(ctx, client.EventParams{UserID: "x", Date: "2026-13-01"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Fields["user_id"] == "" || apiErr.Fields["date"] == "" {
+		t.Errorf("invalid create: err = %v, want 400 with user_id and date fields", err)
+	}
+
+	found, err := api.Search(ctx, "1", "ретро")
+	if err != nil || len(found) != 1 {
+		t.Errorf("search = %v, %v", found, err)
+	}
+
+	if err = api.DeleteEvent(ctx, client.EventParams{ID: created.ID, UserID: "1", Version: version}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = api.Event(ctx, created.ID); !errors.As(err, &apiErr) || !apiErr.NotFound() {
+		t.Errorf("deleted event: err = %v, want not found", err)
+	}
+
+	resp, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/create_event", "/update_event", "/delete_event", "/event", "/events_for_week", "/search"} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("openapi.json does not describe %s", path)
+		}
+	}
+}
+
+// Атомарный пакет с неудавшейся операцией не оставляет следов, best_effort и поток NDJSON
+// выполняют операции независимо
+func TestBatch(t *testing.T) {
+	server := newTestServer(t)
+	api := client.New(server.URL)
+	ctx := context.Background()
+
+	existing, err := api.CreateEvent(ctx, client.EventParams{UserID: "1", Date: "2026-10-19", Description: "existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []client.BatchOp{
+		{Op: "create", UserID: "1", Date: "2026-10-20", Description: "new"},
+		{Op: "update", ID: existing.ID, UserID: "1", Date: "2026-10-21", Description: "moved"},
+		{Op: "delete", ID: "missing", UserID: "1"},
+	}
+
+	atomic, err := api.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, item := range atomic.Items {
+		statuses = append(statuses, item.Status)
+	}
+	if want := []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusServiceUnavailable}; atomic.Applied != 0 || !slices.Equal(statuses, want) {
+		t.Fatalf("atomic batch: applied %d, statuses %v, want 0 and %v", atomic.Applied, statuses, want)
+	}
+	if event, err := api.Event(ctx, existing.ID); err != nil || event.Description != "existing" || event.Date != "2026-10-19" {
+		t.Fatalf("event after rolled back batch = %+v, %v, want it unchanged", event, err)
+	}
+	if events, err := api.EventsForDay(ctx, "1", "2026-10-20", ""); err != nil || len(events) != 0 {
+		t.Fatalf("events created by rolled back batch = %+v, %v", events, err)
+	}
+
+	bestEffort, err := api.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bestEffort.Applied != 2 || bestEffort.Failed != 1 || bestEffort.Items[1].Event == nil || bestEffort.Items[1].Event.Description != "moved" {
+		t.Fatalf("best effort batch = %+v", bestEffort)
+	}
+	if item := bestEffort.Items[2]; item.Err == nil || !item.Err.NotFound() {
+		t.Errorf("delete of a missing event: %+v, want not found", item)
+	}
+
+	var stream strings.Builder
+	for i := range 250 {
+		fmt.Fprintf(&stream, `{"op": "create", "user_id": "2", "date": "2026-10-22", "description": "imported %d"}`+"\n", i)
+	}
+	stream.WriteString(`{"op": "delete", "user_id": "2"}` + "\n")
+	var items []client.BatchItem
+	err = api.BatchStream(ctx, strings.NewReader(stream.String()), func(item client.BatchItem) error {
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 251 || items[249].Event == nil || items[250].Err == nil || items[250].Err.Fields["id"] == "" {
+		t.Fatalf("stream returned %d items, last %+v", len(items), items[len(items)-1])
+	}
+	for i, item := range items {
+		if item.Index != i {
+			t.Fatalf("item %d has index %d", i, item.Index)
+		}
+	}
+	if events, err := api.EventsForDay(ctx, "2", "2026-10-22", ""); err != nil || len(events) != 250 {
+		t.Errorf("imported %d events, %v, want 250", len(events), err)
+	}
+}
+
+// Атомарный пакет откатывается по своим записям журнала, даже если история журнала в памяти
+// их уже вытеснила, а с неполным списком записей откат ничего не трогает
+func TestBatchRollbackBeyondAuditHistory(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	calendar.audit.history = 2
+	ctx := context.Background()
+
+	existing, err := calendar.AddEvent(ctx, newTestEvent(t, "1", "2026-10-19T10:00", "existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := existing
+	moved.Description = "moved"
+	ops := []BatchOp{
+		{Action: batchCreate, Event: newTestEvent(t, "1", "2026-10-20T10:00", "first")},
+		{Action: batchCreate, Event: newTestEvent(t, "1", "2026-10-21T10:00", "second")},
+		{Action: batchUpdate, Event: moved},
+		{Action: batchCreate, Event: newTestEvent(t, "1", "2026-10-22T10:00", "third")},
+		{Action: batchDelete, Event: Event{ID: "missing", UserID: "1"}},
+	}
+	results, err := calendar.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if !errors.Is(results[4].Err, ErrNotFound) {
+		t.Errorf("failed operation err = %v, want ErrNotFound", results[4].Err)
+	}
+	if events, _ := calendar.storage.Load(); len(events) != 1 || events[0].Description != "existing" {
+		t.Fatalf("events after rollback = %+v, want only the unchanged existing event", events)
+	}
+
+	// запись второй операции потерялась: откат не начинается
+	if _, err = calendar.Batch(ctx, ops[:2], true); err != nil {
+		t.Fatal(err)
+	}
+	calendar.Lock()
+	last := calendar.audit.seq
+	err = calendar.rollback(last-1, calendar.audit.entries[len(calendar.audit.entries)-1:])
+	calendar.Unlock()
+	if !errors.Is(err, errIncompleteRollback) {
+		t.Errorf("rollback with a missing entry err = %v, want errIncompleteRollback", err)
+	}
+	if events, _ := calendar.storage.Load(); len(events) != 3 || calendar.audit.seq != last {
+		t.Errorf("incomplete rollback changed the calendar: %d events, last entry %d, want 3 and %d", len(events), calendar.audit.seq, last)
+	}
+}
+
+// JSON-RPC поверх TCP: тот же Calendar, подписка на изменения и changes.closed при остановке сервера
+func TestRPCServer(t *testing.T) {
+	newTestServer(t)
+	server, err := ListenRPC("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(conn)
+
+	type message struct {
+		ID     int             `json:"id"`
+		Method string          `json:"method"`
+		Result json.RawMessage `json:"result"`
+		Params json.RawMessage `json:"params"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	call := func(id int, method string, params interface{}) {
+		t.Helper()
+		request, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		if _, err := conn.Write(append(request, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() message {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("connection closed: %v", lines.Err())
+		}
+		var msg message
+		if err := json.Unmarshal(lines.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	call(1, "changes.subscribe", map[string]string{"user_id": "1"})
+	if msg := read(); msg.ID != 1 || msg.Error != nil || string(msg.Result) != `{"subscription":1}` {
+		t.Fatalf("subscribe reply = %+v", msg)
+	}
+
+	call(2, "events.create", map[string]string{"user_id": "1", "date": "2026-10-19", "description": "rpc"})
+	var created Event
+	for range 2 {
+		switch msg := read(); {
+		case msg.ID == 2 && msg.Error == nil:
+			json.Unmarshal(msg.Result, &created)
+		case msg.Method == rpcNotifyChange:
+			var params struct {
+				Change Change `json:"change"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			if params.Change.Type != changeCreated {
+				t.Errorf("change = %+v, want created", params.Change)
+			}
+		default:
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+	if stored, ok := calendarFrom(context.Background()).GetEvent(created.ID); !ok || stored.Description != "rpc" {
+		t.Fatalf("event created over RPC = %+v, %v", stored, ok)
+	}
+
+	call(3, "events.update", map[string]interface{}{"user_id": "1", "id": created.ID, "date": "2026-10-20", "description": "stale", "version": 5})
+	if msg := read(); msg.Error == nil || msg.Error.Code != rpcVersionMismatch {
+		t.Errorf("stale update reply = %+v, want code %d", msg, rpcVersionMismatch)
+	}
+	call(4, "events.get", []string{created.ID})
+	if msg := read(); msg.Error == nil || msg.Error.Code != rpcInvalidParams {
+		t.Errorf("positional params reply = %+v, want code %d", msg, rpcInvalidParams)
+	}
+
+	server.Close()
+	if msg := read(); msg.Method != rpcNotifyClosed {
+		t.Errorf("message on shutdown = %+v, want %s", msg, rpcNotifyClosed)
+	}
+}
+
+// Арендаторы не видят событий друг друга, квоты на события и частоту запросов действуют на каждого отдельно
+func TestTenants(t *testing.T) {
+	server := newTestServer(t)
+	small, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants = NewTenants(append(tenants.All(), NewTenant("small", small, TenantQuota{MaxEvents: 1, RateLimit: 0.001, RateBurst: 3}, realClock{}))...)
+	ctx := context.Background()
+
+	api := client.New(server.URL)
+	api.Tenant = "small"
+	params := client.EventParams{UserID: "1", Date: "2026-10-19", Description: "Стендап"}
+	created, err := api.CreateEvent(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := calendarFrom(ctx).GetEvent(created.ID); ok {
+		t.Errorf("event of tenant small is visible in default")
+	}
+
+	var apiErr *client.Error
+	if _, err = api.CreateEvent(ctx, params); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable ||
+		!apiErr.QuotaExceeded() || apiErr.MaxEvents != 1 || apiErr.NotFound() {
+		t.Errorf("create over quota: err = %v, want 503 with max_events 1", err)
+	}
+	usage, err := api.TenantUsage(ctx)
+	if err != nil || usage.Events != 1 || usage.RequestsAllowed != 3 {
+		t.Errorf("usage = %+v, %v, want 1 event and 3 allowed requests", usage, err)
+	}
+	if _, err = api.TenantUsage(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request over tenant rate: err = %v, want 429", err)
+	}
+
+	// у default квот нет
+	if _, err = client.New(server.URL).CreateEvent(ctx, params); err != nil {
+		t.Errorf("create in default: %v", err)
+	}
+	api.Tenant = "missing"
+	if _, err = api.TenantUsage(ctx); !errors.As(err, &apiErr) || !apiErr.NotFound() {
+		t.Errorf("unknown tenant: err = %v, want 404", err)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body strings.Builder
+	bufio.NewReader(resp.Body).WriteTo(&body)
+	for _, series := range []string{`tenant_events{tenant="small"} 1`, `tenant_max_events{tenant="small"} 1`, `tenant="small"`} {
+		if !strings.Contains(body.String(), series) {
+			t.Errorf("metrics do not contain %s", series)
+		}
+	}
+}
+
+func TestParseISOWeek(t *testing.T) {
+	tests := []struct {
+		week    string
+		monday  string
+		wantErr bool
+	}{
+		{week: "2026-W42", monday: "2026-10-12"},
+		{week: "2026-W01", monday: "2025-12-29"}, // первая неделя начинается в прошлом году
+		{week: "2026-W53", monday: "2026-12-28"},
+		{week: "2021-W01", monday: "2021-01-04"}, // 1-3 января 2021 - 53 неделя 2020
+		{week: "2020-W53", monday: "2020-12-28"},
+		{week: "2025-W52", monday: "2025-12-22"},
+		{week: "2025-W53", wantErr: true},
+		{week: "2026-W00", wantErr: true},
+		{week: "2026-W5", wantErr: true},
+		{week: "2026-42", wantErr: true},
+		{week: "26-W42", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.week, func(t *testing.T) {
+			monday, err := parseISOWeek(tt.week, time.UTC)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseISOWeek(%q) = %v, want error", tt.week, monday)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := monday.Format(dateLayout); got != tt.monday || monday.Weekday() != time.Monday {
+				t.Errorf("parseISOWeek(%q) = %s, want Monday %s", tt.week, got, tt.monday)
+			}
+		})
+	}
+}
+
+func TestPeriodRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		period    string
+		day       string
+		tz        string
+		weekStart time.Weekday
+		from, to  string
+		hours     float64
+	}{
+		{"week with DST start", periodWeek, "2026-03-29", "Europe/Berlin", time.Monday,
+			"2026-03-23T00:00:00+01:00", "2026-03-30T00:00:00+02:00", 167},
+		{"sunday week starting on DST day", periodWeek, "2026-03-29", "Europe/Berlin", time.Sunday,
+			"2026-03-29T00:00:00+01:00", "2026-04-05T00:00:00+02:00", 167},
+		{"week with DST end", periodWeek, "2026-11-01", "America/New_York", time.Monday,
+			"2026-10-26T00:00:00-04:00", "2026-11-02T00:00:00-05:00", 169},
+		{"week across new year", periodWeek, "2026-01-01", "UTC", time.Monday,
+			"2025-12-29T00:00:00Z", "2026-01-05T00:00:00Z", 168},
+		{"sunday week across new year", periodWeek, "2025-12-31", "UTC", time.Sunday,
+			"2025-12-28T00:00:00Z", "2026-01-04T00:00:00Z", 168},
+		{"day is the week start", periodWeek, "2026-10-12", "Europe/Moscow", time.Monday,
+			"2026-10-12T00:00:00+03:00", "2026-10-19T00:00:00+03:00", 168},
+		{"day is the week end", periodWeek, "2026-10-18", "Europe/Moscow", time.Monday,
+			"2026-10-12T00:00:00+03:00", "2026-10-19T00:00:00+03:00", 168},
+		{"25 hour day", periodDay, "2026-10-25", "Europe/Berlin", time.Monday,
+			"2026-10-25T00:00:00+02:00", "2026-10-26T00:00:00+01:00", 25},
+		{"month with DST start", periodMonth, "2026-03-31", "Europe/Berlin", time.Monday,
+			"2026-03-01T00:00:00+01:00", "2026-04-01T00:00:00+02:00", 743},
+		{"december", periodMonth, "2026-12-01", "UTC", time.Monday,
+			"2026-12-01T00:00:00Z", "2027-01-01T00:00:00Z", 744},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.tz)
+			if err != nil {
+				t.Skip(err)
+			}
+			day, _ := time.ParseInLocation(dateLayout, tt.day, loc)
+
+			from, to := PeriodQuery{Period: tt.period, Day: day, WeekStart: tt.weekStart}.Range()
+			if from.Format(time.RFC3339) != tt.from || to.Format(time.RFC3339) != tt.to {
+				t.Errorf("range = [%s, %s), want [%s, %s)", from.Format(time.RFC3339), to.Format(time.RFC3339), tt.from, tt.to)
+			}
+			if hours := to.Sub(from).Hours(); hours != tt.hours {
+				t.Errorf("range length = %vh, want %vh", hours, tt.hours)
+			}
+		})
+	}
+}
+
+// События первого и последнего дня периода попадают в выдачу, соседние дни - нет
+func TestEventsForPeriodBoundaries(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(timing eventTiming, description string) {
+		t.Helper()
+		event := Event{UserID: "1", Description: description}
+		timing.TimeZone = "Europe/Berlin"
+		if err := timing.apply(&event); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := calendar.AddEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(eventTiming{Date: "2026-10-01"}, "first of month")
+	add(eventTiming{Start: "2026-10-18T23:30", Duration: "20m"}, "sunday before")
+	add(eventTiming{Date: "2026-10-19"}, "monday")
+	add(eventTiming{Start: "2026-10-25T23:30", Duration: "20m"}, "sunday after DST end")
+	add(eventTiming{Start: "2026-10-26T00:00", Duration: "20m"}, "next monday")
+	add(eventTiming{Start: "2026-10-31T23:59", Duration: "1m"}, "last minute of month")
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []string
+	}{
+		{"default sunday week", url.Values{"date": {"2026-10-21"}}, []string{"sunday before", "monday"}},
+		{"monday week", url.Values{"date": {"2026-10-21"}, "week_start": {"monday"}}, []string{"monday", "sunday after DST end"}},
+		{"monday week from its last day", url.Values{"date": {"2026-10-25"}, "week_start": {"Monday"}}, []string{"monday", "sunday after DST end"}},
+		{"iso week starts on monday", url.Values{"week": {"2026-W43"}}, []string{"monday", "sunday after DST end"}},
+		{"iso week across months", url.Values{"week": {"2026-W44"}}, []string{"next monday", "last minute of month"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.Set("tz", "Europe/Berlin")
+			q, err := parsePeriodParams(tt.query, periodWeek, time.Sunday)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.UserID = "1"
+			if got := descriptions(calendar.EventsFor(q)); !slices.Equal(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	month := calendar.GetEventsMonth(Event{UserID: "1", Date: "2026-10-15", TimeZone: "Europe/Berlin"})
+	if got := descriptions(month); len(got) != 6 || got[0] != "first of month" || got[5] != "last minute of month" {
+		t.Errorf("month events = %q, want all six from the first to the last day", got)
+	}
+}
+
+// Отмена проходит цепочку создание - изменение - удаление в обратном порядке
+// и не трогает события, которые после операции изменил другой пользователь
+func TestCalendarUndo(t *testing.T) {
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := calendar.AddEvent(context.Background(), newTestEvent(t, "1", "2026-10-19T10:00", "original"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := newTestEvent(t, "1", "2026-10-20T10:00", "changed")
+	changed.ID = created.ID
+	if _, err = calendar.UpdateEvent(context.Background(), changed); err != nil {
+		t.Fatal(err)
+	}
+	if err = calendar.DeleteEvent(context.Background(), Event{ID: created.ID, UserID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, entry := range calendar.Audit(AuditQuery{UserID: "1"}) {
+		actions = append(actions, entry.Action)
+	}
+	if want := []string{auditDelete, auditUpdate, auditCreate}; !slices.Equal(actions, want) {
+		t.Fatalf("audit actions = %q, want %q", actions, want)
+	}
+
+	if _, err = calendar.Undo(context.Background(), "1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if restored, ok := calendar.find(created.ID); !ok || restored.Description != "original" {
+		t.Fatalf("after undoing update and delete event = %+v, %v, want the original one", restored, ok)
+	}
+	if _, err = calendar.Undo(context.Background(), "1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := calendar.find(created.ID); ok {
+		t.Fatal("event still exists after undoing its creation")
+	}
+	if entries, err := calendar.Undo(context.Background(), "1", 1); err != nil || len(entries) != 0 {
+		t.Fatalf("undo with nothing left = %v, %v, want no entries", entries, err)
+	}
+
+	invite := newTestEvent(t, "1", "2026-10-21T10:00", "invite")
+	invite.Attendees = []Attendee{{UserID: "2", Status: rsvpNeedsAction}}
+	if invite, err = calendar.AddEvent(context.Background(), invite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = calendar.RSVP(context.Background(), invite.ID, "2", rsvpAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = calendar.Undo(context.Background(), "1", 1); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("undo after another user's change err = %v, want ErrVersionMismatch", err)
+	}
+	if _, ok := calendar.find(invite.ID); !ok {
+		t.Fatal("rejected undo removed the event")
+	}
+}
+
+// Автор записи - аутентифицированный пользователь, а не user_id запроса. Отмена проверяет права
+// на момент отмены, а журнал после падения отбрасывает недописанную запись
+func TestAuditActorAndRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), auditFile)
+	calendar, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = calendar.OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := withPrincipal(context.Background(), Principal{UserID: "3", Role: roleAdmin})
+	if _, err = calendar.AddEvent(admin, newTestEvent(t, "1", "2026-10-19T10:00", "by admin")); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := calendar.CreateSharedCalendar("1", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = calendar.ShareCalendar(shared.ID, "1", "2", permissionWrite); err != nil {
+		t.Fatal(err)
+	}
+	event := newTestEvent(t, "2", "2026-10-20T10:00", "in team calendar")
+	event.CalendarID = shared.ID
+	created, err := calendar.AddEvent(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, want := range map[string]string{"1": "3", "2": "2"} {
+		if entries := calendar.Audit(AuditQuery{UserID: userID}); len(entries) != 1 || entries[0].Actor != want {
+			t.Errorf("audit of user %s = %+v, want one entry by %s", userID, entries, want)
+		}
+	}
+
+	if _, err = calendar.ShareCalendar(shared.ID, "1", "2", permissionRead); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = calendar.Undo(context.Background(), "2", 1); !errors.Is(err, ErrForbidden) {
+		t.Errorf("undo after losing write access err = %v, want ErrForbidden", err)
+	}
+	if _, ok := calendar.find(created.ID); !ok {
+		t.Error("forbidden undo removed the event")
+	}
+	calendar.CloseAuditLog()
+
+	before, _ := os.ReadFile(path)
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	file.WriteString(`{"seq":3,"op":3,"actor":"1"`)
+	file.Close()
+
+	reopened, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reopened.OpenAuditLog(path); err != nil {
+		t.Fatalf("open audit log with a torn tail: %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, before) {
+		t.Errorf("audit log after reopening = %q, want the torn entry cut off: %q", after, before)
+	}
+	if _, err = reopened.AddEvent(context.Background(), newTestEvent(t, "1", "2026-10-21T10:00", "after restart")); err != nil {
+		t.Fatal(err)
+	}
+	reopened.CloseAuditLog()
+
+	again, err := NewCalendar(newMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = again.OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries := again.Audit(AuditQuery{UserID: "1"}); len(entries) != 2 || entries[0].Seq != 3 {
+		t.Errorf("entries after restart = %+v, want the new one written as seq 3", entries)
+	}
+}
+
+func descriptions(events []Event) []string {
+	result := make([]string, len(events))
+	for i, event := range events {
+		result[i] = event.Description
+	}
+	return result
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Арендаторы (tenants): один сервер обслуживает несколько команд. У каждого арендатора свой Calendar -
+хранилище, индексы, лента изменений, журнал, общие календари и планировщик напоминаний.
+
+Арендаторы и их квоты перечислены в конфиге, арендатор default есть всегда:
+
+	"tenants": {"default": {}, "team-a": {"max_events": 10000, "rate_limit": 50, "rate_burst": 100}}
+
+	max_events   сколько событий может хранить арендатор, серия считается одним событием; 0 - без ограничения
+	rate_limit   запросов в секунду на всех клиентов арендатора, 0 - без ограничения; rate_burst - размер корзины
+
+Арендатор запроса:
+  - учетные данные с tenant (поле API ключа в api_keys или claim токена) привязаны к этому арендатору;
+  - учетные данные без tenant относятся к default, только admin без tenant выбирает арендатора заголовком X-Tenant-ID;
+  - без аутентификации арендатора выбирает X-Tenant-ID, без заголовка - default.
+
+X-Tenant-ID с чужим арендатором - 403, с неизвестным - 404. Ответ содержит X-Tenant-ID арендатора запроса.
+В JSON-RPC арендатора выбирает параметр tenant метода auth.
+
+Событие сверх max_events - ошибка бизнес-логики 503 {"error": "Event quota exceeded", "details": {"max_events": N}},
+запрос сверх rate_limit арендатора - 429 с Retry-After, как и при ограничении клиента.
+Квоты и их использование отдает GET /tenant, в /metrics у рядов запросов есть метка tenant и добавлены:
+
+	tenant_events{tenant}                              число событий
+	tenant_max_events{tenant}                          квота на события, 0 - без ограничения
+	tenant_rate_limit_requests_total{tenant, result}   решения ограничителя арендатора
+
+Администратор, привязанный к арендатору, видит в /metrics только его ряды.
+Файлы default лежат в data_dir, как до появления арендаторов, остальных - в data_dir/tenants/<id>.
+*/
+
+const (
+	defaultTenant     = "default"
+	tenantHeader      = "X-Tenant-ID"
+	maxTenantIDLength = 64
+	tenantsDir        = "tenants"
+)
+
+var errUnknownTenant = &statusError{http.StatusNotFound, "Unknown tenant"}
+
+// TenantQuota квоты арендатора, 0 - без ограничения
+type TenantQuota struct {
+	MaxEvents int     `json:"max_events"`
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+}
+
+func (q TenantQuota) validate() error {
+	if q.MaxEvents < 0 || q.RateLimit < 0 {
+		return fmt.Errorf("max_events and rate_limit must not be negative")
+	}
+	if q.RateLimit > 0 && q.RateBurst < 1 {
+		return fmt.Errorf("rate_burst must be at least 1 when rate_limit is set")
+	}
+	return nil
+}
+
+// validTenantID принимает латиницу, цифры, '-' и '_': ID арендатора становится именем каталога
+func validTenantID(id string) bool {
+	if id == "" || len(id) > maxTenantIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Tenant арендатор и его данные
+type Tenant struct {
+	ID        string
+	Quota     TenantQuota
+	calendar  *Calendar
+	storage   Storage
+	scheduler *Scheduler
+	limiter   *RateLimiter
+}
+
+// NewTenant создает арендатора с календарем calendar и применяет к календарю квоту на события
+func NewTenant(id string, calendar *Calendar, quota TenantQuota, clock Clock) *Tenant {
+	calendar.SetMaxEvents(quota.MaxEvents)
+	return &Tenant{
+		ID:       id,
+		Quota:    quota,
+		calendar: calendar,
+		limiter:  NewRateLimiter(quota.RateLimit, quota.RateBurst, clock),
+	}
+}
+
+// Allow забирает токен из корзины арендатора. Если токена нет, возвращает false и время до его появления
+func (t *Tenant) Allow() (bool, time.Duration) {
+	return t.limiter.Allow(t.ID)
+}
+
+// TenantUsage квоты арендатора и их использование
+type TenantUsage struct {
+	Tenant          string  `json:"tenant"`
+	Events          int     `json:"events"`
+	MaxEvents       int     `json:"max_events"`
+	RateLimit       float64 `json:"rate_limit"`
+	RateBurst       int     `json:"rate_burst"`
+	RequestsAllowed uint64  `json:"requests_allowed"`
+	RequestsLimited uint64  `json:"requests_limited"`
+}
+
+// Usage возвращает квоты арендатора и их использование
+func (t *Tenant) Usage() TenantUsage {
+	allowed, limited := t.limiter.Counts()
+	return TenantUsage{
+		Tenant:          t.ID,
+		Events:          t.calendar.Count(),
+		MaxEvents:       t.Quota.MaxEvents,
+		RateLimit:       t.Quota.RateLimit,
+		RateBurst:       t.Quota.RateBurst,
+		RequestsAllowed: allowed,
+		RequestsLimited: limited,
+	}
+}
+
+// tenantNotifier добавляет в напоминания арендатора, чтобы получатель различал одинаковые user_id
+type tenantNotifier struct {
+	Notifier
+	tenant string
+}
+
+func (n tenantNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	reminder.Tenant = n.tenant
+	return n.Notifier.Notify(ctx, reminder)
+}
+
+// Tenants арендаторы сервера, набор задается при запуске и дальше не меняется
+type Tenants struct {
+	byID map[string]*Tenant
+	ids  []string
+}
+
+func NewTenants(list ...*Tenant) *Tenants {
+	ts := &Tenants{byID: make(map[string]*Tenant, len(list))}
+	for _, tenant := range list {
+		ts.byID[tenant.ID] = tenant
+		ts.ids = append(ts.ids, tenant.ID)
+	}
+	sort.Strings(ts.ids)
+	return ts
+}
+
+// Get возвращает арендатора по ID
+func (ts *Tenants) Get(id string) (*Tenant, bool) {
+	tenant, ok := ts.byID[id]
+	return tenant, ok
+}
+
+// All возвращает арендаторов по возрастанию ID
+func (ts *Tenants) All() []*Tenant {
+	result := make([]*Tenant, len(ts.ids))
+	for i, id := range ts.ids {
+		result[i] = ts.byID[id]
+	}
+	return result
+}
+
+// tenantDataDir каталог файлов арендатора id
+func tenantDataDir(dataDir, id string) string {
+	if id == defaultTenant {
+		return dataDir
+	}
+	return filepath.Join(dataDir, tenantsDir, id)
+}
+
+// openTenants открывает хранилища, журналы и планировщики арендаторов из конфига.
+// Планировщики запускает Start, Close их останавливает и сбрасывает хранилища
+func openTenants(cfg Config, notifier Notifier) (*Tenants, error) {
+	weekStart, err := parseWeekday(cfg.WeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var opened []*Tenant
+	for id, quota := range cfg.tenantQuotas() {
+		tenant, err := openTenant(cfg, id, quota, weekStart, notifier)
+		if err != nil {
+			// планировщики еще не запущены, Stop на них не вернется
+			for _, tenant := range opened {
+				tenant.closeFiles()
+			}
+			return nil, fmt.Errorf("tenant %s: %w", id, err)
+		}
+		opened = append(opened, tenant)
+	}
+	return NewTenants(opened...), nil
+}
+
+func openTenant(cfg Config, id string, quota TenantQuota, weekStart time.Weekday, notifier Notifier) (*Tenant, error) {
+	dir := tenantDataDir(cfg.DataDir, id)
+	storage, err := openStorage(cfg.Storage, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	calendar, err := NewCalendar(storage)
+	if err == nil {
+		calendar.SetWeekStart(weekStart)
+		err = calendar.OpenSharedCalendars(sharedCalendarsPath(cfg.Storage, dir))
+	}
+	if err == nil {
+		err = calendar.OpenAuditLog(auditLogPath(cfg.Storage, dir))
+	}
+	var scheduler *Scheduler
+	if err == nil {
+		scheduler, err = NewScheduler(calendar, tenantNotifier{Notifier: notifier, tenant: id}, realClock{}, reminderStatePath(cfg.Storage, dir))
+	}
+	if err != nil {
+		storage.Close()
+		if calendar != nil {
+			calendar.CloseAuditLog()
+		}
+		return nil, err
+	}
+	calendar.onChange = scheduler.Wake
+
+	tenant := NewTenant(id, calendar, quota, realClock{})
+	tenant.storage = storage
+	tenant.scheduler = scheduler
+	return tenant, nil
+}
+
+// Start запускает планировщики напоминаний
+func (ts *Tenants) Start() {
+	for _, tenant := range ts.All() {
+		if tenant.scheduler != nil {
+			tenant.scheduler.Start()
+		}
+	}
+}
+
+// Close останавливает планировщики, сбрасывает хранилища и журналы, ошибки только пишутся в лог
+func (ts *Tenants) Close() {
+	for _, tenant := range ts.All() {
+		if tenant.scheduler != nil {
+			tenant.scheduler.Stop()
+		}
+		tenant.closeFiles()
+	}
+}
+
+// closeFiles сбрасывает хранилище и журнал аудита арендатора, ошибки только пишутся в лог
+func (t *Tenant) closeFiles() {
+	if t.storage != nil {
+		if err := t.storage.Close(); err != nil {
+			log.Printf("Failed to close storage of tenant %s: %v\n", t.ID, err)
+		}
+	}
+	if err := t.calendar.CloseAuditLog(); err != nil {
+		log.Printf("Failed to close audit log of tenant %s: %v\n", t.ID, err)
+	}
+}
+
+// CloseFeeds закрывает ленты изменений, чтобы завершились потоковые подписки
+func (ts *Tenants) CloseFeeds() {
+	for _, tenant := range ts.All() {
+		tenant.calendar.feed.Close()
+	}
+}
+
+// WritePrometheus пишет квоты и использование арендаторов, only - только этого арендатора
+func (ts *Tenants) WritePrometheus(w io.Writer, only string) {
+	var usages []TenantUsage
+	for _, tenant := range ts.All() {
+		if only == "" || tenant.ID == only {
+			usages = append(usages, tenant.Usage())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP tenant_events Events stored by the tenant.")
+	fmt.Fprintln(w, "# TYPE tenant_events gauge")
+	for _, usage := range usages {
+		fmt.Fprintf(w, "tenant_events{tenant=%s} %d\n", labelValue(usage.Tenant), usage.Events)
+	}
+	fmt.Fprintln(w, "# HELP tenant_max_events Event quota of the tenant, 0 means unlimited.")
+	fmt.Fprintln(w, "# TYPE tenant_max_events gauge")
+	for _, usage := range usages {
+		fmt.Fprintf(w, "tenant_max_events{tenant=%s} %d\n", labelValue(usage.Tenant), usage.MaxEvents)
+	}
+	fmt.Fprintln(w, "# HELP tenant_rate_limit_requests_total Tenant rate limiter decisions.")
+	fmt.Fprintln(w, "# TYPE tenant_rate_limit_requests_total counter")
+	for _, usage := range usages {
+		label := labelValue(usage.Tenant)
+		fmt.Fprintf(w, "tenant_rate_limit_requests_total{tenant=%s,result=\"allowed\"} %d\n", label, usage.RequestsAllowed)
+		fmt.Fprintf(w, "tenant_rate_limit_requests_total{tenant=%s,result=\"limited\"} %d\n", label, usage.RequestsLimited)
+	}
+}
+
+var tenants *Tenants
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom возвращает арендатора, которого выбрал selectTenant
+func tenantFrom(ctx context.Context) (*Tenant, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant, ok
+}
+
+// calendarFrom календарь арендатора из ctx. Без арендатора в ctx - календарь default
+func calendarFrom(ctx context.Context) *Calendar {
+	if tenant, ok := tenantFrom(ctx); ok {
+		return tenant.calendar
+	}
+	tenant, _ := tenants.Get(defaultTenant)
+	return tenant.calendar
+}
+
+// resolveTenant определяет арендатора по пользователю из ctx и запрошенному requested, пустой - не запрошен
+func resolveTenant(ctx context.Context, requested string) (*Tenant, error) {
+	id := requested
+	if principal, ok := principalFrom(ctx); ok {
+		bound := principal.Tenant
+		if bound == "" && !principal.Admin() {
+			bound = defaultTenant
+		}
+		if bound != "" {
+			if requested != "" && requested != bound {
+				return nil, ErrForbidden
+			}
+			id = bound
+		}
+	}
+	if id == "" {
+		id = defaultTenant
+	}
+
+	tenant, ok := tenants.Get(id)
+	if !ok {
+		return nil, errUnknownTenant
+	}
+	return tenant, nil
+}
+
+// selectTenant находит арендатора запроса и кладет его в контекст
+func selectTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := resolveTenant(r.Context(), r.Header.Get(tenantHeader))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.tenant = tenant.ID
+		}
+		w.Header().Set(tenantHeader, tenant.ID)
+		next(w, r.WithContext(withTenant(r.Context(), tenant)))
+	}
+}
+
+// tenantLimited отвечает 429, если у арендатора запроса закончились токены
+func tenantLimited(w http.ResponseWriter, r *http.Request) bool {
+	tenant, ok := tenantFrom(r.Context())
+	if !ok {
+		return false
+	}
+	if ok, wait := tenant.Allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSON(w, http.StatusTooManyRequests, APIResponse{Error: "Tenant request quota exceeded"})
+		return true
+	}
+	return false
+}
+
+func tenantHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	tenant, ok := tenantFrom(r.Context())
+	if !ok {
+		writeError(w, errUnknownTenant)
+		return
+	}
+	writeResult(w, tenant.Usage())
+}
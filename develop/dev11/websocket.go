@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Минимальный WebSocket (RFC 6455) для ленты изменений: GET /events/ws?user_id=&last_event_id=.
+
+Сервер отправляет каждое изменение текстовым кадром с JSON Change, отвечает на ping и close.
+Сообщения клиента, кроме управляющих, игнорируются. Расширения и фрагментированные сообщения не поддерживаются.
+*/
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText   = 0x1
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xA
+	wsFinalBit = 0x80
+	wsMaskBit  = 0x80
+
+	// клиентские кадры нам нужны только управляющие, их полезная нагрузка не больше 125 байт
+	wsMaxClientPayload = 4096
+	wsWriteTimeout     = 10 * time.Second
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// wsConn соединение после рукопожатия
+type wsConn struct {
+	conn interface {
+		io.ReadWriteCloser
+		SetWriteDeadline(time.Time) error
+	}
+	reader *bufio.Reader
+
+	mu     sync.Mutex // кадры пишут обработчик и читающая горутина
+	closed bool
+}
+
+// websocketAccept значение Sec-WebSocket-Accept для ключа клиента
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket проверяет запрос на рукопожатие и переключает соединение на WebSocket.
+// При ошибке ответ уже отправлен или соединение закрыто
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, &statusError{http.StatusBadRequest, "Expected a WebSocket handshake"})
+		return nil, false
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	// сервер мог выставить дедлайны чтения и записи для обычного запроса
+	conn.SetDeadline(time.Time{})
+	if _, err = rw.WriteString(handshake); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, true
+}
+
+// writeFrame отправляет кадр без маски, как положено серверу
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	header := []byte{wsFinalBit | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+	return nil
+}
+
+// readFrame читает кадр клиента, клиентские кадры обязаны быть замаскированы
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&wsMaskBit == 0 {
+		return 0, nil, errWebSocketProtocol
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxClientPayload {
+		return 0, nil, errWebSocketProtocol
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop отвечает на управляющие кадры клиента и закрывает done, когда клиент отключился
+func (c *wsConn) readLoop(done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.conn.Close()
+}
+
+func eventWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	userID, after, err := parseFeedParams(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allowed(r, userID) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	conn, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	defer conn.Close()
+
+	feed := calendarFrom(r.Context()).feed
+	sub, pending, _ := feed.Subscribe(userID, after)
+	defer feed.Unsubscribe(sub)
+
+	send := func(change Change) bool {
+		data, err := json.Marshal(change)
+		return err == nil && conn.writeFrame(wsOpText, data) == nil
+	}
+	for _, change := range pending {
+		if !send(change) {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	go conn.readLoop(done)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case change, ok := <-sub.C:
+			if !ok || !send(change) {
+				return
+			}
+		case <-heartbeat.C:
+			if conn.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		}
+	}
+}